@@ -0,0 +1,233 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditLinkCreate    = "link.create"
+	auditLinkUpdate    = "link.update"
+	auditLinkDelete    = "link.delete"
+	auditLinkTransfer  = "link.transfer"
+	auditLinkImport    = "link.import"
+	auditPatternCreate = "pattern.create"
+	auditPatternUpdate = "pattern.update"
+	auditPatternDelete = "pattern.delete"
+	auditTokensLoad    = "tokens.load"
+)
+
+// auditActions are the actions that can be filtered on the /.audit page.
+var auditActions = []string{
+	auditLinkCreate,
+	auditLinkUpdate,
+	auditLinkDelete,
+	auditLinkTransfer,
+	auditLinkImport,
+	auditPatternCreate,
+	auditPatternUpdate,
+	auditPatternDelete,
+	auditTokensLoad,
+}
+
+// auditPageSize is the number of entries shown on each page of /.audit.
+const auditPageSize = 100
+
+// An auditActor is who made a change recorded in the audit log.
+type auditActor struct {
+	Login     string
+	IP        string
+	UserAgent string
+}
+
+// systemActor makes the changes golink makes itself, such as loading API
+// tokens on startup.
+var systemActor = auditActor{Login: "golink"}
+
+// requestActor returns the user making r, and where it was made from.
+func requestActor(r *http.Request) auditActor {
+	login, _ := currentUser(r)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return auditActor{Login: login, IP: ip, UserAgent: r.UserAgent()}
+}
+
+// record adds an entry for a change a made to target to t's audit log, and
+// queues webhooks for changes to links. before and after are the values of
+// target before and after the change, and are nil if it didn't exist.
+//
+// Changes are recorded after they are made, so failing to record them is
+// logged rather than returned.
+func (a auditActor) record(t *tenant, action, target string, before, after any) {
+	entry := a.entry(action, target, before, after)
+	if err := t.db().AppendAudit(entry); err != nil {
+		log.Printf("recording %s of %q by %s: %v", action, target, a.Login, err)
+	}
+	queueLinkEvent(t, action, a.Login, before, after)
+}
+
+// entry returns the audit log entry for a change a made to target, for
+// changes that are recorded some other way than by record.
+func (a auditActor) entry(action, target string, before, after any) *AuditEntry {
+	return &AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     a.Login,
+		IP:        a.IP,
+		UserAgent: a.UserAgent,
+		Action:    action,
+		Target:    target,
+		Before:    auditValue(before),
+		After:     auditValue(after),
+	}
+}
+
+// auditValue returns v encoded as JSON, or nil if v is nil.
+func auditValue(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	switch v := v.(type) {
+	case *Link:
+		if v == nil {
+			return nil
+		}
+	case *Pattern:
+		if v == nil {
+			return nil
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("encoding audit value: %v", err)
+		return nil
+	}
+	return b
+}
+
+// auditData is the data used by the auditTmpl template.
+type auditData struct {
+	Entries []*AuditEntry
+	Actions []string
+
+	// Actor, Action, Target, Since, and Until are the filters of the page,
+	// as entered in its form.
+	Actor  string
+	Action string
+	Target string
+	Since  string
+	Until  string
+
+	// NextURL links to the page of older entries, if any.
+	NextURL string
+}
+
+// auditQuery returns the query selected by the "actor", "action", "target",
+// "since", and "until" request values. Times are in the form used by
+// datetime-local inputs, or RFC 3339.
+func auditQuery(r *http.Request) (AuditQuery, error) {
+	q := AuditQuery{
+		Actor:  strings.TrimSpace(r.FormValue("actor")),
+		Action: strings.TrimSpace(r.FormValue("action")),
+		Target: strings.TrimSpace(r.FormValue("target")),
+	}
+	var err error
+	if q.Since, err = parseFormTime(r.FormValue("since")); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseFormTime(r.FormValue("until")); err != nil {
+		return q, err
+	}
+	if v := r.FormValue("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			return q, err
+		}
+		q.After = uint(after)
+	}
+	return q, nil
+}
+
+// serveAudit shows admins the audit log, newest first, filtered by the
+// request values read by auditQuery. Requests that don't accept HTML, or set
+// "format" to "jsonl", are sent every matching entry, oldest first, as JSON
+// lines. They can be resumed from the last entry seen by setting "after" to
+// its ID.
+func serveAudit(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !t.isAdmin(login) {
+		http.Error(w, "only admins can see the audit log", http.StatusForbidden)
+		return
+	}
+	q, err := auditQuery(r)
+	if err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("format") == "jsonl" || !acceptHTML(r) {
+		q.Limit = exportBatchSize
+		enc := json.NewEncoder(w)
+		for {
+			entries, err := t.db().LoadAudit(q)
+			if err != nil {
+				log.Printf("streaming audit log: %v", err)
+				panic(http.ErrAbortHandler)
+			}
+			for _, entry := range entries {
+				if err := enc.Encode(entry); err != nil {
+					panic(http.ErrAbortHandler)
+				}
+			}
+			if len(entries) < q.Limit {
+				return
+			}
+			q.After = entries[len(entries)-1].ID
+		}
+	}
+
+	q.Desc = true
+	q.Limit = auditPageSize + 1
+	entries, err := t.db().LoadAudit(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := auditData{
+		Entries: entries,
+		Actions: auditActions,
+		Actor:   q.Actor,
+		Action:  q.Action,
+		Target:  q.Target,
+		Since:   r.FormValue("since"),
+		Until:   r.FormValue("until"),
+	}
+	if len(entries) > auditPageSize {
+		data.Entries = entries[:auditPageSize]
+		next := make(url.Values)
+		for _, k := range []string{"actor", "action", "target", "since", "until"} {
+			if v := r.FormValue(k); v != "" {
+				next.Set(k, v)
+			}
+		}
+		next.Set("after", strconv.FormatUint(uint64(data.Entries[auditPageSize-1].ID), 10))
+		data.NextURL = "/.audit?" + next.Encode()
+	}
+	auditTmpl.Execute(w, data)
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestAuditLinkChanges(t *testing.T) {
+	links := map[string]*Link{}
+	audit := fakeLinks(t, links)
+
+	save := func(form url.Values) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("User-Agent", "test-agent")
+		w := httptest.NewRecorder()
+		serveSave(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("serveSave(%v) = %d: %s", form, w.Code, w.Body)
+		}
+	}
+	save(url.Values{"short": {"docs"}, "long": {"http://docs/"}})
+	save(url.Values{"short": {"docs"}, "long": {"http://docs2/"}})
+
+	r := httptest.NewRequest("POST", "/.delete/docs", strings.NewReader(url.Values{
+		"xsrf": {xsrftoken.Generate(xsrfKey, "foo@example.com", "docs")},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	serveDelete(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("serveDelete() = %d: %s", w.Code, w.Body)
+	}
+
+	entries := *audit
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, ","); got != "link.create,link.update,link.delete" {
+		t.Fatalf("audited actions = %s; want create, update, and delete", got)
+	}
+	create, update, del := entries[0], entries[1], entries[2]
+	if create.Actor != "foo@example.com" || create.IP != "192.0.2.1" || create.UserAgent != "test-agent" || create.Target != "docs" || create.Before != nil {
+		t.Errorf("create entry = %+v", create)
+	}
+	var before, after Link
+	if err := json.Unmarshal(update.Before, &before); err != nil || before.Long != "http://docs/" {
+		t.Errorf("update entry before = %s, %v", update.Before, err)
+	}
+	if err := json.Unmarshal(update.After, &after); err != nil || after.Long != "http://docs2/" {
+		t.Errorf("update entry after = %s, %v", update.After, err)
+	}
+	if del.Before == nil || del.After != nil {
+		t.Errorf("delete entry = %+v", del)
+	}
+}
+
+func TestServeAudit(t *testing.T) {
+	audit := fakeLinks(t, map[string]*Link{})
+	for _, a := range []auditActor{{Login: "amelie@example.com"}, {Login: "bob@example.com"}, {Login: "amelie@example.com"}} {
+		a.record(defaultTenant(), auditLinkCreate, "docs", nil, &Link{Short: "docs"})
+	}
+	systemActor.record(defaultTenant(), auditLinkImport, "wiki", nil, &Link{Short: "wiki"})
+	if len(*audit) != 4 {
+		t.Fatalf("recorded %d entries; want 4", len(*audit))
+	}
+
+	setAPITokens(t, nil, "")
+	w := httptest.NewRecorder()
+	serveAudit(w, httptest.NewRequest("GET", "/.audit", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("serveAudit() by non-admin = %d; want %d", w.Code, http.StatusForbidden)
+	}
+
+	setAPITokens(t, nil, "foo@example.com")
+	stream := func(query string) []*AuditEntry {
+		t.Helper()
+		w := httptest.NewRecorder()
+		serveAudit(w, httptest.NewRequest("GET", "/.audit?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("serveAudit(%s) = %d: %s", query, w.Code, w.Body)
+		}
+		var entries []*AuditEntry
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			entry := new(AuditEntry)
+			if err := dec.Decode(entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+	if got := stream(""); len(got) != 4 || got[0].ID != 1 || got[3].Action != auditLinkImport {
+		t.Errorf("serveAudit() streamed %+v; want all 4 entries, oldest first", got)
+	}
+	if got := stream("actor=amelie@example.com&after=1"); len(got) != 1 || got[0].ID != 3 {
+		t.Errorf("serveAudit(actor, after) streamed %+v; want entry 3", got)
+	}
+
+	r := httptest.NewRequest("GET", "/.audit?action=link.import", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	serveAudit(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "wiki") || strings.Contains(body, "amelie@example.com") {
+		t.Errorf("serveAudit(action=link.import) = %s; want only the import", body)
+	}
+
+	w = httptest.NewRecorder()
+	serveAudit(w, httptest.NewRequest("GET", "/.audit?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("serveAudit(since=yesterday) = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
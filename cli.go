@@ -0,0 +1,624 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	server   = flag.String("server", "", "URL of a running golink, such as http://go, to send commands to instead of using the database")
+	apiToken = flag.String("token", "", "API token used to authenticate commands sent to -server; defaults to $GOLINK_TOKEN")
+	cliUser  = flag.String("user", os.Getenv("USER"), "user that commands run against the database act as")
+)
+
+// localAdmin is the user running a command against the database. They are
+// trusted as an admin, since they can change the database directly anyway.
+var localAdmin string
+
+// A command is a subcommand of the golink binary, such as "golink list".
+type command struct {
+	args string // usage of the command's arguments
+	help string
+	run  func(c *apiClient, w io.Writer, args []string) error
+}
+
+// commands are the subcommands of the golink binary, by name. Running golink
+// with an argument that isn't a command resolves it as a link.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"list":     {args: "[-json] [-sort s] [-desc] [-tag t]", help: "list links", run: runList},
+		"get":      {args: "[-json] name", help: "show a link", run: runGet},
+		"create":   {args: "[-json] [link flags] name [long]", help: "create a link", run: runCreate},
+		"edit":     {args: "[-json] [link flags] name", help: "change the given fields of a link", run: runEdit},
+		"delete":   {args: "name", help: "delete a link", run: runDelete},
+		"export":   {args: "[-format f]", help: "print all links, as JSON lines by default", run: runExport},
+		"import":   {args: "[-json] [-format f] [-update] [file ...]", help: "create the links in files, or stdin, that don't exist", run: runImport},
+		"stats":    {args: "[-json]", help: "list the number of visits of each link", run: runStats},
+		"transfer": {args: "[-json] [-dry-run] from to", help: "move all links owned by one user to another user or group", run: runTransfer},
+		"serve":    {help: "run the golink server (the default)"},
+	}
+
+	flag.Usage = func() {
+		printCommands(flag.CommandLine.Output())
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+}
+
+// runCommand runs the command named by args[0] with c, writing its output to
+// w. If args[0] isn't a command, it is resolved as a link.
+func runCommand(c *apiClient, w io.Writer, args []string) error {
+	name, args := args[0], args[1:]
+	cmd, ok := commands[name]
+	if !ok || cmd.run == nil {
+		destination, err := c.resolve(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, destination)
+		return nil
+	}
+	return cmd.run(c, w, args)
+}
+
+// printCommands prints the usage of each command to w.
+func printCommands(w io.Writer) {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Usage: golink [flags] command [args], or golink [flags] link to resolve a link")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", name, commands[name].args, commands[name].help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands use the database, or the API of -server with -token if set.")
+}
+
+// commandFlags returns the flags of the command name, with the -json flag
+// used by commands that can print JSON instead of a table.
+func commandFlags(name string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet("golink "+name, flag.ContinueOnError)
+	return fs, fs.Bool("json", false, "print JSON instead of a table")
+}
+
+// linkFlags are the flags of the create and edit commands setting link
+// fields, by the name of the form value they are sent as.
+var linkFlags = []struct {
+	name, usage string
+}{
+	{"long", "destination URL or template"},
+	{"alias_of", "short name of the link this link is an alias of"},
+	{"description", "description of the link"},
+	{"tags", "comma-separated tags"},
+	{"owner", "owner of the link"},
+	{"query_mode", `what to do with unused query parameters: "" or "pass", "merge", or "drop"`},
+	{"visibility", `"" (public), "unlisted", or "restricted"`},
+	{"allowed_users", "comma-separated users and groups who can see a restricted link"},
+	{"active_from", "RFC 3339 time before which the link doesn't work yet"},
+	{"expires_at", "RFC 3339 time after which the link no longer works"},
+	{"status", "HTTP status to redirect with: 301, 302, 307, or 308"},
+	{"preview", "always show a preview of the destination: true or false"},
+	{"disabled", "show disabled_reason instead of redirecting: true or false"},
+	{"disabled_reason", "why the link is disabled"},
+	{"locked", "only let admins change the link: true or false"},
+}
+
+// addLinkFlags adds linkFlags to fs, with dashes in place of underscores. It
+// returns a function returning the form values of the flags that were set.
+func addLinkFlags(fs *flag.FlagSet) func() url.Values {
+	values := make(map[string]*string)
+	for _, f := range linkFlags {
+		values[f.name] = fs.String(strings.ReplaceAll(f.name, "_", "-"), "", f.usage)
+	}
+	return func() url.Values {
+		form := make(url.Values)
+		fs.Visit(func(f *flag.Flag) {
+			name := strings.ReplaceAll(f.Name, "-", "_")
+			if v, ok := values[name]; ok {
+				form.Set(name, *v)
+			}
+		})
+		return form
+	}
+}
+
+func runList(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("list")
+	sortBy := fs.String("sort", "name", "sort links by name, clicks, owner, or last_edit")
+	desc := fs.Bool("desc", false, "sort in descending order")
+	tag := fs.String("tag", "", "only list links with this tag")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, ok := linkSorts[*sortBy]; !ok && *sortBy != "name" {
+		return fmt.Errorf("unknown sort %q", *sortBy)
+	}
+	var links []*Link
+	for path := allURL(*sortBy, *desc, *tag, ""); path != ""; {
+		var page []*Link
+		var err error
+		if path, err = c.getPage(path, &page); err != nil {
+			return err
+		}
+		links = append(links, page...)
+	}
+	if *jsonOut {
+		return printJSON(w, links)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHORT\tDESTINATION\tOWNER\tTAGS")
+	for _, link := range links {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", link.Short, destination(link), link.Owner, link.Tags)
+	}
+	return tw.Flush()
+}
+
+func runGet(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("get")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: golink get [-json] name")
+	}
+	link, err := c.get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(w, link)
+	}
+	return printLink(w, link)
+}
+
+func runCreate(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("create")
+	form := addLinkFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("usage: golink create [-json] [link flags] name [long]")
+	}
+	short := fs.Arg(0)
+	if _, err := c.get(short); err == nil {
+		return fmt.Errorf("link %q already exists; use edit to change it", short)
+	}
+	values := form()
+	if fs.NArg() == 2 {
+		values.Set("long", fs.Arg(1))
+	}
+	link, err := c.save(short, values)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(w, link)
+	}
+	return printLink(w, link)
+}
+
+func runEdit(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("edit")
+	form := addLinkFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: golink edit [-json] [link flags] name")
+	}
+	link, err := c.get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// saving a link always sets its destination and owner, so keep the
+	// current ones unless they are being changed
+	values := form()
+	_, setLong := values["long"]
+	_, setAlias := values["alias_of"]
+	switch {
+	case setLong && !setAlias:
+		values.Set("alias_of", "")
+	case !setLong && !setAlias:
+		values.Set("long", link.Long)
+		values.Set("alias_of", link.AliasOf)
+	}
+	if _, ok := values["owner"]; !ok {
+		values.Set("owner", link.Owner)
+	}
+
+	if link, err = c.save(link.Short, values); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(w, link)
+	}
+	return printLink(w, link)
+}
+
+func runDelete(c *apiClient, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("golink delete", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: golink delete name")
+	}
+	resp, err := c.send("POST", "/.delete/"+fs.Arg(0), nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(w, "Deleted %s.\n", fs.Arg(0))
+	return nil
+}
+
+func runExport(c *apiClient, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("golink export", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "format to export: jsonl, csv, yaml, or html for browser bookmarks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := parseFormat(*format); err != nil {
+		return err
+	}
+	resp, err := c.send("GET", "/.export?format="+url.QueryEscape(*format), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func runImport(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("import")
+	format := fs.String("format", "", "format of the links: jsonl, csv, yaml, or html; defaults to the format of each file's extension, or jsonl for stdin")
+	update := fs.Bool("update", false, "update existing links with the imported fields, instead of skipping them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var data importData
+	importFile := func(name string, in io.Reader) error {
+		f := formatOfFile(name)
+		if *format != "" {
+			var err error
+			if f, err = parseFormat(*format); err != nil {
+				return err
+			}
+		}
+		q := url.Values{"format": {f}, "update": {fmt.Sprint(*update)}}
+		resp, err := c.send("POST", "/.import?"+q.Encode(), in, exportFormats[f].contentType)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var d importData
+		if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+			return err
+		}
+		data.Imported += d.Imported
+		return nil
+	}
+	if fs.NArg() == 0 {
+		if err := importFile("", os.Stdin); err != nil {
+			return err
+		}
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = importFile(name, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if *jsonOut {
+		return printJSON(w, data)
+	}
+	fmt.Fprintf(w, "Imported %d links.\n", data.Imported)
+	return nil
+}
+
+func runStats(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("stats")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var visits []visitData
+	if err := c.getJSON("/.stats", &visits); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(w, visits)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHORT\tCLICKS")
+	for _, v := range visits {
+		fmt.Fprintf(tw, "%s\t%d\n", v.Short, v.NumClicks)
+	}
+	return tw.Flush()
+}
+
+func runTransfer(c *apiClient, w io.Writer, args []string) error {
+	fs, jsonOut := commandFlags("transfer")
+	dryRun := fs.Bool("dry-run", false, "list the links that would be transferred without changing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: golink transfer [-dry-run] from to")
+	}
+	form := url.Values{"from": {fs.Arg(0)}, "to": {fs.Arg(1)}, "dry_run": {strconv.FormatBool(*dryRun)}}
+	resp, err := c.send("POST", "/.transfer", strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var data transferData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(w, data)
+	}
+	for _, short := range data.Links {
+		fmt.Fprintln(w, short)
+	}
+	if data.DryRun {
+		fmt.Fprintf(w, "Would transfer %d links from %s to %s.\n", len(data.Links), data.From, data.To)
+	} else {
+		fmt.Fprintf(w, "Transferred %d links from %s to %s.\n", len(data.Links), data.From, data.To)
+	}
+	return nil
+}
+
+// destination describes where link goes, for tables.
+func destination(link *Link) string {
+	if link.AliasOf != "" {
+		return "alias of " + link.AliasOf
+	}
+	return link.Long
+}
+
+// printLink prints the fields of link that are set to w, one per line.
+func printLink(w io.Writer, link *Link) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	field := func(name string, v any) {
+		switch v := v.(type) {
+		case string:
+			if v == "" {
+				return
+			}
+		case bool:
+			if !v {
+				return
+			}
+		case time.Time:
+			if v.IsZero() {
+				return
+			}
+			fmt.Fprintf(tw, "%s:\t%s\n", name, v.Format(time.RFC3339))
+			return
+		}
+		fmt.Fprintf(tw, "%s:\t%v\n", name, v)
+	}
+	field("Short", link.Short)
+	field("Long", link.Long)
+	field("Alias of", link.AliasOf)
+	field("Description", link.Description)
+	field("Tags", link.Tags.String())
+	field("Owner", link.Owner)
+	field("Visibility", link.Visibility)
+	field("Allowed users", link.AllowedUsers.String())
+	field("Locked", link.Locked)
+	field("Disabled", link.Disabled)
+	field("Disabled reason", link.DisabledReason)
+	field("Active from", link.ActiveFrom)
+	field("Expires at", link.ExpiresAt)
+	field("Created", link.Created)
+	field("Last edit", link.LastEdit)
+	return tw.Flush()
+}
+
+// printJSON prints v to w as indented JSON.
+func printJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// apiClient sends commands to golink's API, either of a running server or
+// handled in-process against the database.
+type apiClient struct {
+	base  string // URL of the server, without a trailing slash
+	token string
+	hc    *http.Client
+
+	// local is set if requests are handled in-process.
+	local bool
+}
+
+// remoteClient returns a client of the -server API.
+func remoteClient() *apiClient {
+	token := *apiToken
+	if token == "" {
+		token = os.Getenv("GOLINK_TOKEN")
+	}
+	return &apiClient{
+		base:  strings.TrimSuffix(*server, "/"),
+		token: token,
+		hc:    &http.Client{CheckRedirect: noRedirect},
+	}
+}
+
+// localClient returns a client whose requests are served by h in-process,
+// authenticated as the -user admin by a token that only lives as long as the
+// command.
+func localClient(h http.Handler) *apiClient {
+	b := make([]byte, 24)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if apiTokens == nil {
+		apiTokens = make(map[string]string)
+	}
+	apiTokens[token] = *cliUser
+	localAdmin = *cliUser
+	return &apiClient{
+		base:  "http://" + defaultTenant().Hostname,
+		token: token,
+		hc:    &http.Client{Transport: handlerTransport{h}, CheckRedirect: noRedirect},
+		local: true,
+	}
+}
+
+// noRedirect stops an http.Client from following redirects, so that
+// resolving a link returns its destination.
+func noRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// handlerTransport is an http.RoundTripper that serves requests with a
+// handler, without a network.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.RequestURI = r.URL.RequestURI()
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	w := httptest.NewRecorder()
+	t.h.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// send sends a request to path of the API, returning an error for responses
+// other than successes and redirects.
+func (c *apiClient) send(method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// getJSON decodes the JSON response to a GET request for path into v.
+func (c *apiClient) getJSON(path string, v any) error {
+	resp, err := c.send("GET", path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getPage decodes the JSON response to a GET request for path into v,
+// returning the path of the next page from the response's Link header, if any.
+func (c *apiClient) getPage(path string, v any) (next string, err error) {
+	resp, err := c.send("GET", path, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", err
+	}
+	for _, link := range resp.Header.Values("Link") {
+		target, params, _ := strings.Cut(link, ";")
+		if strings.TrimSpace(params) == `rel="next"` {
+			next = strings.Trim(strings.TrimSpace(target), "<>")
+		}
+	}
+	return next, nil
+}
+
+// get returns the link short.
+func (c *apiClient) get(short string) (*Link, error) {
+	link := new(Link)
+	if err := c.getJSON("/.detail/"+short, link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// save creates or updates the link short with the fields in form, returning
+// the saved link.
+func (c *apiClient) save(short string, form url.Values) (*Link, error) {
+	form.Set("short", short)
+	resp, err := c.send("POST", "/", strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	link := new(Link)
+	if err := json.NewDecoder(resp.Body).Decode(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// resolve returns the destination of the link name. Links resolved against
+// the database follow destinations that are other go links to the end.
+func (c *apiClient) resolve(name string) (string, error) {
+	if c.local {
+		return resolveLink(defaultTenant(), name)
+	}
+	resp, err := c.send("GET", "/"+strings.TrimPrefix(name, "/"), nil, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if dst := resp.Header.Get("Location"); dst != "" {
+		return dst, nil
+	}
+	return "", fmt.Errorf("%s did not redirect", name)
+}
@@ -0,0 +1,344 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+// fakeLinks sets db to a mock database storing links in memory, for the
+// duration of the test. It returns the audit log the database records.
+func fakeLinks(t *testing.T, links map[string]*Link) *[]*AuditEntry {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	m := NewMockDatabase(ctrl)
+	m.EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			c := *link
+			return &c, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	m.EXPECT().LoadAll().DoAndReturn(func() ([]*Link, error) {
+		var all []*Link
+		for _, link := range links {
+			c := *link
+			all = append(all, &c)
+		}
+		return all, nil
+	}).AnyTimes()
+	m.EXPECT().LoadPage(gomock.Any()).DoAndReturn(func(p LinkPage) ([]*Link, string, error) {
+		// pages are always sorted by ID
+		var page []*Link
+		for _, link := range links {
+			id := linkID(link.Short)
+			if id > p.After && strings.HasPrefix(id, p.Prefix) && (p.Tag == "" || link.Tags.Has(p.Tag)) && (p.Owner == "" || link.Owner == p.Owner) {
+				c := *link
+				page = append(page, &c)
+			}
+		}
+		sort.Slice(page, func(i, j int) bool { return linkID(page[i].Short) < linkID(page[j].Short) })
+		if p.Limit > 0 && len(page) > p.Limit {
+			page = page[:p.Limit]
+			return page, linkID(page[p.Limit-1].Short), nil
+		}
+		return page, "", nil
+	}).AnyTimes()
+	m.EXPECT().LoadExpired(gomock.Any()).DoAndReturn(func(q LinkExpiry) ([]*Link, error) {
+		var expired []*Link
+		for _, link := range links {
+			tenant, _, ok := strings.Cut(link.Short, ":")
+			if !ok {
+				tenant = ""
+			}
+			if tenant == q.Tenant && link.ExpiresAt.After(q.Since) && !link.ExpiresAt.After(q.Until) {
+				c := *link
+				expired = append(expired, &c)
+			}
+		}
+		return expired, nil
+	}).AnyTimes()
+	m.EXPECT().Save(gomock.Any()).DoAndReturn(func(link *Link) error {
+		c := *link
+		links[link.Short] = &c
+		return nil
+	}).AnyTimes()
+	m.EXPECT().SaveLinks(gomock.Any()).DoAndReturn(func(saved []*Link) error {
+		for _, link := range saved {
+			c := *link
+			links[link.Short] = &c
+		}
+		return nil
+	}).AnyTimes()
+	m.EXPECT().Delete(gomock.Any()).DoAndReturn(func(short string) error {
+		delete(links, short)
+		return nil
+	}).AnyTimes()
+	m.EXPECT().LoadAliases(gomock.Any()).DoAndReturn(func(short string) ([]*Link, error) {
+		var aliases []*Link
+		for _, link := range links {
+			if link.AliasOf != "" && linkID(link.AliasOf) == linkID(short) {
+				c := *link
+				aliases = append(aliases, &c)
+			}
+		}
+		return aliases, nil
+	}).AnyTimes()
+	m.EXPECT().LoadPatterns().Return(nil, nil).AnyTimes()
+	m.EXPECT().SaveStats(gomock.Any()).Return(nil).AnyTimes()
+	m.EXPECT().DeleteStats(gomock.Any()).Return(nil).AnyTimes()
+
+	var audit []*AuditEntry
+	m.EXPECT().AppendAudit(gomock.Any()).DoAndReturn(func(entry *AuditEntry) error {
+		entry.ID = uint(len(audit) + 1)
+		audit = append(audit, entry)
+		return nil
+	}).AnyTimes()
+	m.EXPECT().LoadAudit(gomock.Any()).DoAndReturn(func(q AuditQuery) ([]*AuditEntry, error) {
+		var entries []*AuditEntry
+		for i := range audit {
+			entry := audit[i]
+			if q.Desc {
+				entry = audit[len(audit)-1-i]
+			}
+			after := q.After == 0 || (!q.Desc && entry.ID > q.After) || (q.Desc && entry.ID < q.After)
+			if after && (q.Actor == "" || entry.Actor == q.Actor) && (q.Action == "" || entry.Action == q.Action) && (q.Target == "" || entry.Target == q.Target) && len(entries) < q.Limit {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	}).AnyTimes()
+	m.EXPECT().TransferLinks(gomock.Any()).DoAndReturn(func(q LinkTransfer) ([]*Link, error) {
+		selected := make(map[string]bool)
+		for _, short := range q.Shorts {
+			selected[linkID(short)] = true
+		}
+		var transferred []*Link
+		for _, link := range links {
+			if link.Owner == q.From && !strings.HasPrefix(link.Short, personalMarker) && (q.Shorts == nil || selected[linkID(link.Short)]) {
+				transferred = append(transferred, link)
+			}
+		}
+		if q.Shorts != nil && len(transferred) != len(q.Shorts) {
+			return nil, fmt.Errorf("expected to transfer %d links, found %d", len(q.Shorts), len(transferred))
+		}
+		sort.Slice(transferred, func(i, j int) bool { return linkID(transferred[i].Short) < linkID(transferred[j].Short) })
+		for i, link := range transferred {
+			before := *link
+			link.Owner, link.LastEdit = q.To, q.Time
+			entry := q.Audit(&before, link)
+			entry.ID = uint(len(audit) + 1)
+			audit = append(audit, entry)
+			c := *link
+			transferred[i] = &c
+		}
+		return transferred, nil
+	}).AnyTimes()
+	m.EXPECT().DeleteLinks(gomock.Any()).DoAndReturn(func(q LinkDeletion) ([]*Link, error) {
+		var deleted []*Link
+		for _, short := range q.Shorts {
+			link, ok := links[short]
+			if !ok || link.Owner != q.Owner {
+				return nil, fmt.Errorf("expected to delete %s owned by %s", short, q.Owner)
+			}
+			deleted = append(deleted, link)
+		}
+		sort.Slice(deleted, func(i, j int) bool { return linkID(deleted[i].Short) < linkID(deleted[j].Short) })
+		for _, link := range deleted {
+			delete(links, link.Short)
+			entry := q.Audit(link)
+			entry.ID = uint(len(audit) + 1)
+			audit = append(audit, entry)
+		}
+		return deleted, nil
+	}).AnyTimes()
+	db = m
+	return &audit
+}
+
+// setAPITokens sets the API tokens and admins for the duration of the test.
+func setAPITokens(t *testing.T, tokens map[string]string, admin string) {
+	oldTokens, oldAdmins, oldLocalAdmin := apiTokens, *admins, localAdmin
+	t.Cleanup(func() {
+		apiTokens, *admins, localAdmin = oldTokens, oldAdmins, oldLocalAdmin
+	})
+	apiTokens, *admins = tokens, admin
+}
+
+func TestCommandsRemote(t *testing.T) {
+	links := map[string]*Link{
+		"docs":  {Short: "docs", Long: "http://docs/", Owner: "bob@example.com", Tags: Tags{"eng"}},
+		"wiki":  {Short: "wiki", Long: "http://wiki/", Owner: "amelie@example.com"},
+		"plans": {Short: "plans", Long: "http://plans/", Owner: "amelie@example.com", Visibility: visibilityRestricted, AllowedUsers: Principals{"amelie@example.com"}},
+	}
+	fakeLinks(t, links)
+	setAPITokens(t, map[string]string{"bob-token": "bob@example.com", "admin-token": "admin@example.com"}, "admin@example.com")
+
+	s := httptest.NewServer(newHandler())
+	defer s.Close()
+	client := func(token string) *apiClient {
+		*server, *apiToken = s.URL, token
+		t.Cleanup(func() { *server, *apiToken = "", "" })
+		return remoteClient()
+	}
+	bob, admin := client("bob-token"), client("admin-token")
+
+	run := func(c *apiClient, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runCommand(c, &out, args)
+		return out.String(), err
+	}
+
+	out, err := run(bob, "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "docs  ") || !strings.Contains(out, "http://wiki/") || strings.Contains(out, "plans") {
+		t.Errorf("list = %q; want docs and wiki, without the restricted link", out)
+	}
+
+	out, err = run(bob, "get", "-json", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var link Link
+	if err := json.Unmarshal([]byte(out), &link); err != nil || link.Long != "http://docs/" {
+		t.Errorf("get -json docs = %q, %v", out, err)
+	}
+
+	if out, err = run(bob, "docs/setup"); err != nil || out != "http://docs/setup\n" {
+		t.Errorf("resolving docs/setup = %q, %v; want http://docs/setup", out, err)
+	}
+
+	if _, err := run(bob, "create", "-tags", "team", "-description", "our team", "team", "http://team/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := links["team"]; got == nil || got.Owner != "bob@example.com" || got.Description != "our team" || !got.Tags.Has("team") {
+		t.Errorf("created link = %+v", got)
+	}
+	if _, err := run(bob, "create", "docs", "http://other/"); err == nil {
+		t.Error("creating existing link succeeded; want error")
+	}
+
+	// editing only changes the given fields
+	if _, err := run(bob, "edit", "-description", "the docs", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	if got := links["docs"]; got.Long != "http://docs/" || got.Description != "the docs" || got.Owner != "bob@example.com" || !got.Tags.Has("eng") {
+		t.Errorf("edited link = %+v", got)
+	}
+	if _, err := run(bob, "edit", "-status", "301", "-disabled", "true", "-disabled-reason", "moved to the wiki", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	if got := links["docs"]; got.Status != 301 || !got.Disabled || got.DisabledReason != "moved to the wiki" || got.Description != "the docs" {
+		t.Errorf("link edited with state flags = %+v", got)
+	}
+	if _, err := run(bob, "edit", "-long", "http://wiki2/", "wiki"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("editing another user's link = %v; want 403", err)
+	}
+	if _, err := run(admin, "edit", "-long", "http://wiki2/", "wiki"); err != nil {
+		t.Fatal(err)
+	}
+	if got := links["wiki"]; got.Long != "http://wiki2/" || got.Owner != "amelie@example.com" {
+		t.Errorf("link edited by admin = %+v", got)
+	}
+
+	if _, err := run(bob, "delete", "team"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := links["team"]; ok {
+		t.Error("deleted link still exists")
+	}
+
+	out, err = run(admin, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, "\n"); n != 3 {
+		t.Errorf("export = %q; want 3 links", out)
+	}
+
+	snapshot := filepath.Join(t.TempDir(), "links.json")
+	os.WriteFile(snapshot, []byte(`{"Short":"docs","Long":"http://ignored/"}
+{"Short":"new","Long":"http://new/","Owner":"amelie@example.com"}
+`), 0o600)
+	if _, err := run(bob, "import", snapshot); err == nil {
+		t.Error("import by non-admin succeeded; want error")
+	}
+	if out, err = run(admin, "import", snapshot); err != nil || out != "Imported 1 links.\n" {
+		t.Errorf("import = %q, %v; want 1 link imported", out, err)
+	}
+	if got := links["new"]; got == nil || got.Owner != "amelie@example.com" {
+		t.Errorf("imported link = %+v", got)
+	}
+
+	if _, err := run(client("wrong-token"), "list"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("list with unknown token = %v; want 401", err)
+	}
+}
+
+func TestCommandsLocal(t *testing.T) {
+	links := map[string]*Link{
+		"docs": {Short: "docs", Long: "http://docs/", Owner: "bob@example.com"},
+		"help": {Short: "help", Long: "http://go/docs/help"},
+	}
+	fakeLinks(t, links)
+	setAPITokens(t, nil, "")
+	oldUser := *cliUser
+	*cliUser = "ops"
+	t.Cleanup(func() { *cliUser = oldUser })
+
+	c := localClient(newHandler())
+
+	// commands run against the database act as an admin
+	var out bytes.Buffer
+	if err := runCommand(c, &out, []string{"edit", "-long", "http://docs2/", "docs"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := links["docs"]; got.Long != "http://docs2/" || got.Owner != "bob@example.com" {
+		t.Errorf("edited link = %+v", got)
+	}
+
+	out.Reset()
+	if err := runCommand(c, &out, []string{"stats", "-json"}); err != nil {
+		t.Fatal(err)
+	}
+	var visits []visitData
+	if err := json.Unmarshal(out.Bytes(), &visits); err != nil || len(visits) != 2 {
+		t.Errorf("stats -json = %s, %v; want 2 links", out.Bytes(), err)
+	}
+
+	out.Reset()
+	if err := runCommand(c, &out, []string{"transfer", "-dry-run", "bob@example.com", "amelie@example.com"}); err != nil || out.String() != "docs\nWould transfer 1 links from bob@example.com to amelie@example.com.\n" {
+		t.Errorf("transfer -dry-run = %q, %v", out.String(), err)
+	}
+	if got := links["docs"]; got.Owner != "bob@example.com" {
+		t.Errorf("dry run transferred link: %+v", got)
+	}
+	out.Reset()
+	if err := runCommand(c, &out, []string{"transfer", "bob@example.com", "amelie@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := links["docs"]; got.Owner != "amelie@example.com" {
+		t.Errorf("transferred link = %+v", got)
+	}
+
+	// links resolve through other go links
+	out.Reset()
+	if err := runCommand(c, &out, []string{"help"}); err != nil || out.String() != "http://docs2/help\n" {
+		t.Errorf("resolving help = %q, %v; want http://docs2/help", out.String(), err)
+	}
+}
@@ -4,28 +4,241 @@
 package golink
 
 import (
+	"database/sql/driver"
 	_ "embed"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Link is the structure stored for each go short link.
 type Link struct {
 	gorm.Model
-	ID       string `gorm:"primaryKey"`
-	Short    string // the "foo" part of http://go/foo
-	Long     string // the target URL or text/template pattern to run
-	Created  time.Time
-	LastEdit time.Time // when the link was last edited
-	Owner    string    // user@domain
+	ID        string `gorm:"primaryKey"`
+	Short     string // the "foo" part of http://go/foo
+	Long      string // the target URL or text/template pattern to run
+	AliasOf   string // if set, the short name of the canonical link this link resolves to
+	QueryMode string // what to do with unused query parameters: "" or "pass", "merge", or "drop"
+	Status    int    // HTTP status used to redirect; zero means 302 Found
+	Preview   bool   // whether to always show a preview page instead of redirecting
+	Locked    bool   // if set, the link can only be changed by an admin
+	Created   time.Time
+	LastEdit  time.Time // when the link was last edited
+	Owner     string    // user@domain
+
+	Description string // free-text description of the link
+	Tags        Tags   // labels used to group and find links
+
+	// ActiveFrom and ExpiresAt optionally limit when the link resolves.
+	// A zero value means no limit.
+	ActiveFrom time.Time
+	ExpiresAt  time.Time `gorm:"index"`
+
+	// ExpiryNotified is the ExpiresAt the owner was last notified of, so
+	// owners are notified once per expiry time, even across restarts.
+	ExpiryNotified time.Time `json:"-"`
+
+	// Disabled links show DisabledReason instead of redirecting.
+	Disabled       bool
+	DisabledReason string
+
+	// Visibility is who can resolve and list the link: "" (public),
+	// "unlisted", or "restricted" to its owner and AllowedUsers.
+	Visibility   string
+	AllowedUsers Principals // users and groups who can see a restricted link
+}
+
+// Tags is a set of lowercase labels attached to a link.
+// It is stored in the database as a single comma-separated column.
+type Tags []string
+
+// parseTags parses a comma or space separated list of tags. Tags are
+// lowercased, de-duplicated, and sorted. A leading "#" is ignored.
+func parseTags(s string) (Tags, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	seen := make(map[string]bool)
+	var tags Tags
+	for _, f := range fields {
+		tag := strings.ToLower(strings.TrimPrefix(f, "#"))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !reTag.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q: tags may only contain letters, numbers, dash, underscore, and period", f)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+var reTag = regexp.MustCompile(`^[\w\-\.]+$`)
+
+// Has reports whether t contains tag.
+func (t Tags) Has(tag string) bool {
+	for _, v := range t {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the tags as a comma-separated list.
+func (t Tags) String() string {
+	return strings.Join(t, ", ")
+}
+
+// Value implements driver.Valuer.
+func (t Tags) Value() (driver.Value, error) {
+	return strings.Join(t, ","), nil
+}
+
+// Scan implements sql.Scanner.
+func (t *Tags) Scan(src any) error {
+	list, err := scanList(src)
+	if err != nil {
+		return fmt.Errorf("cannot scan %T into Tags", src)
+	}
+	*t = list
+	return nil
+}
+
+// scanList scans a comma-separated database column into a list of strings.
+func scanList(src any) ([]string, error) {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return nil, fmt.Errorf("cannot scan %T", src)
+	}
+	if s == "" {
+		return nil, nil
+	}
+	return strings.Split(s, ","), nil
+}
+
+// GormDataType returns the column type used to store Tags.
+func (Tags) GormDataType() string {
+	return "text"
+}
+
+// Principals is a set of users, and groups prefixed with "group:".
+// It is stored in the database as a single comma-separated column.
+type Principals []string
+
+// parsePrincipals parses a comma or space separated list of users and
+// groups. Principals are de-duplicated and sorted.
+func parsePrincipals(s string) Principals {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	seen := make(map[string]bool)
+	var ps Principals
+	for _, f := range fields {
+		if !seen[f] {
+			seen[f] = true
+			ps = append(ps, f)
+		}
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+// String returns the principals as a comma-separated list.
+func (p Principals) String() string {
+	return strings.Join(p, ", ")
+}
+
+// Value implements driver.Valuer.
+func (p Principals) Value() (driver.Value, error) {
+	return strings.Join(p, ","), nil
+}
+
+// Scan implements sql.Scanner.
+func (p *Principals) Scan(src any) error {
+	list, err := scanList(src)
+	if err != nil {
+		return fmt.Errorf("cannot scan %T into Principals", src)
+	}
+	*p = list
+	return nil
+}
+
+// GormDataType returns the column type used to store Principals.
+func (Principals) GormDataType() string {
+	return "text"
+}
+
+// redirectStatuses are the HTTP statuses a link may redirect with.
+var redirectStatuses = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// validRedirectStatus reports whether a link may redirect with status.
+func validRedirectStatus(status int) bool {
+	for _, s := range redirectStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectStatus returns the HTTP status used to redirect to the link.
+func (l *Link) redirectStatus() int {
+	if l.Status == 0 {
+		return http.StatusFound
+	}
+	return l.Status
+}
+
+// activeAt reports whether the link resolves at time t.
+func (l *Link) activeAt(t time.Time) bool {
+	if !l.ActiveFrom.IsZero() && t.Before(l.ActiveFrom) {
+		return false
+	}
+	if !l.ExpiresAt.IsZero() && !t.Before(l.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+// Pattern is a rule that resolves short names matching a regular expression,
+// such as go/PROJ-123, when no link with that name exists.
+type Pattern struct {
+	gorm.Model
+	Regexp      string // matched against the whole requested path
+	Long        string // the target text/template pattern; named captures are available as .Match
+	Priority    int    // patterns with higher priority are tried first
+	Owner       string // user@domain
+	Description string // free-text description of the pattern
+	LastEdit    time.Time
+	Tenant      string `json:"-"` // the tenant the pattern belongs to; empty for the default tenant
 }
 
 type Config struct {
@@ -42,17 +255,264 @@ type Stats struct {
 	Clicks  int
 }
 
+// A Checkpoint records the time up to which a background task has run, so
+// that it carries on from there when golink restarts.
+type Checkpoint struct {
+	Name string `gorm:"primaryKey"`
+	Time time.Time
+}
+
 // ClickStats is the number of clicks a set of links have received in a given
 // time period. It is keyed by link short name, with values of total clicks.
 type ClickStats map[string]int
 
+// AuditEntry records a change made to links or settings, in the append-only
+// audit log.
+type AuditEntry struct {
+	ID     uint      `gorm:"primaryKey"`
+	Time   time.Time `gorm:"index"`
+	Tenant string    `json:",omitempty"`
+
+	// Actor is the login of the user who made the change, and IP and
+	// UserAgent describe the request it was made by.
+	Actor     string
+	IP        string
+	UserAgent string
+
+	// Action is what was done, such as "link.update", to Target, such as the
+	// short name of a link.
+	Action string `gorm:"index"`
+	Target string
+
+	// Before and After are the JSON encoded values of Target before and after
+	// the change, if any.
+	Before json.RawMessage `json:",omitempty"`
+	After  json.RawMessage `json:",omitempty"`
+}
+
+// An AuditQuery selects entries of the audit log to load with LoadAudit.
+type AuditQuery struct {
+	// Tenant is the name of the tenant whose entries are loaded.
+	Tenant string
+
+	// Actor, Action, and Target, if set, only select entries with those
+	// values.
+	Actor  string
+	Action string
+	Target string
+
+	// Since and Until, if set, only select entries made at or after Since,
+	// and before Until.
+	Since time.Time
+	Until time.Time
+
+	// Desc loads the newest entries first.
+	Desc bool
+
+	// After, if set, only selects entries after the one with that ID, in the
+	// order they are loaded.
+	After uint
+
+	// Limit, if positive, is the maximum number of entries loaded.
+	Limit int
+}
+
+// Statuses of webhook deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// A WebhookDelivery is a webhook event queued for delivery to one
+// subscriber, and the outcome of delivering it. Pending deliveries are the
+// persistent retry queue; the rest are the delivery log.
+type WebhookDelivery struct {
+	ID      uint   `gorm:"primaryKey"`
+	Tenant  string `json:",omitempty"`
+	Created time.Time
+
+	// URL is the subscriber the delivery is sent to, and Event and Payload
+	// are the event sent.
+	URL     string
+	Event   string
+	Payload json.RawMessage
+
+	// Status is DeliveryPending until the subscriber accepts the delivery,
+	// or it has been attempted too many times. Pending deliveries are next
+	// attempted at NextAttempt.
+	Status      string `gorm:"index"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"index" json:",omitempty"`
+
+	// ResponseCode and Error describe the result of the last attempt.
+	ResponseCode int    `json:",omitempty"`
+	Error        string `json:",omitempty"`
+}
+
+// A DueDeliveryQuery selects pending webhook deliveries of all tenants to
+// attempt with LoadDueDeliveries.
+type DueDeliveryQuery struct {
+	// URL, if set, only selects deliveries to that webhook.
+	URL string
+
+	// Except, if set, only selects deliveries to other webhooks than these.
+	Except []string
+
+	// By, if set, only selects deliveries due to be attempted by then.
+	By time.Time
+
+	// Limit is the maximum number of deliveries loaded.
+	Limit int
+}
+
+// A DeliveryQuery selects webhook deliveries to load with LoadDeliveries.
+type DeliveryQuery struct {
+	// Tenant is the name of the tenant whose deliveries are loaded.
+	Tenant string
+
+	// Status, if set, only selects deliveries with that status.
+	Status string
+
+	// Before, if set, only selects deliveries older than the one with that
+	// ID.
+	Before uint
+
+	// Limit, if positive, is the maximum number of deliveries loaded.
+	Limit int
+}
+
+// A LinkSearch selects links to return from Search.
+type LinkSearch struct {
+	// Query is the text searched for. Every whitespace-separated term in it
+	// must match.
+	Query string
+
+	// Tenant is the name of the tenant whose links are searched. Links of
+	// the default tenant, whose name is empty, are stored as-is, and those
+	// of other tenants with their short names prefixed by "{tenant}:".
+	Tenant string
+
+	// Limit is the maximum number of links returned.
+	Limit int
+}
+
+// A LinkExpiry selects the links of a tenant to return from LoadExpired.
+type LinkExpiry struct {
+	// Tenant is the name of the tenant whose links are loaded, as in
+	// LinkSearch.
+	Tenant string
+
+	// Links are selected if they expire after Since, and by Until. Both
+	// may be in the past or the future.
+	Since, Until time.Time
+}
+
+// A LinkTransfer moves the shared links of one owner to another with
+// TransferLinks.
+type LinkTransfer struct {
+	// Tenant is the name of the tenant whose links are transferred.
+	Tenant string
+
+	// From is the current owner, and To the new owner, of the links.
+	From, To string
+
+	// Shorts, if set, are the short names of the links to transfer, all of
+	// which must be owned by From. Otherwise all of From's links are
+	// transferred.
+	Shorts []string
+
+	// Time is when the links are transferred, which becomes their
+	// LastEdit time.
+	Time time.Time
+
+	// Audit returns the audit log entry recording the transfer of a link,
+	// given the link before and after it. The entries are appended in the
+	// same transaction as the transfer.
+	Audit func(before, after *Link) *AuditEntry
+}
+
+// A LinkDeletion deletes several links of one owner with DeleteLinks.
+type LinkDeletion struct {
+	// Shorts are the short names of the links to delete.
+	Shorts []string
+
+	// Owner is the owner of the links, which all of them must still be
+	// when they are deleted.
+	Owner string
+
+	// Audit returns the audit log entry recording the deletion of a link.
+	// The entries are appended in the same transaction as the deletion.
+	Audit func(link *Link) *AuditEntry
+}
+
+// A LinkPage selects a page of links to load with LoadPage.
+type LinkPage struct {
+	// Sort is the field links are sorted by: empty to sort by ID, which is
+	// the normalized short name, or one of "owner", "last_edit", or
+	// "clicks". Links with the same value are sorted by ID.
+	Sort string
+
+	// Desc sorts links in descending order.
+	Desc bool
+
+	// After is the cursor returned by LoadPage for the previous page, or
+	// empty for the first page.
+	After string
+
+	// Tenant is the name of the tenant whose links are loaded, as in
+	// LinkSearch.
+	Tenant string
+
+	// Prefix, if set, only selects links whose IDs start with it, after
+	// the tenant's prefix.
+	Prefix string
+
+	// Tag, if set, only selects links with the tag.
+	Tag string
+
+	// Owner, if set, only selects links owned by it.
+	Owner string
+
+	// Limit is the maximum number of links loaded.
+	Limit int
+}
+
+// linkSorts are the SQL expressions of the fields links can be sorted by in
+// LoadPage, other than ID.
+var linkSorts = map[string]string{
+	"owner":     "links.owner",
+	"last_edit": "links.last_edit",
+	"clicks":    "COALESCE(link_clicks.clicks, 0)",
+}
+
 // Database defines the contract to interact with the links DB
 type Database interface {
 	LoadAll() ([]*Link, error)
+	SaveExpiryNotice(short string, expiresAt time.Time) error
+	LoadPage(LinkPage) (links []*Link, next string, err error)
 	Load(string) (*Link, error)
 	Save(*Link) error
+	SaveLinks([]*Link) error
+	TransferLinks(LinkTransfer) ([]*Link, error)
 	Delete(string) error
+	DeleteLinks(LinkDeletion) ([]*Link, error)
+	Search(LinkSearch) ([]*Link, error)
+	LoadExpired(LinkExpiry) ([]*Link, error)
+	LoadAliases(short string) ([]*Link, error)
+	LoadPatterns() ([]*Pattern, error)
+	LoadPattern(id uint) (*Pattern, error)
+	SavePattern(*Pattern) error
+	DeletePattern(id uint) error
 	LoadStats() (ClickStats, error)
+	LoadLastClicks() (map[string]time.Time, error)
+	AppendAudit(*AuditEntry) error
+	LoadAudit(AuditQuery) ([]*AuditEntry, error)
+	SaveDelivery(*WebhookDelivery) error
+	LoadDueDeliveries(DueDeliveryQuery) ([]*WebhookDelivery, error)
+	LoadDeliveries(DeliveryQuery) ([]*WebhookDelivery, error)
+	LoadCheckpoint(name string) (time.Time, error)
+	SaveCheckpoint(name string, t time.Time) error
 	SaveStats(ClickStats) error
 	DeleteStats(string) error
 }
@@ -78,7 +538,10 @@ func NewDB(config Config) (*DB, error) {
 		return nil, err
 	}
 
-	db.AutoMigrate(&Link{})
+	db.AutoMigrate(&Link{}, &Pattern{}, &AuditEntry{}, &WebhookDelivery{}, &Checkpoint{})
+	if err := createSearchIndexes(db); err != nil {
+		return nil, fmt.Errorf("creating search indexes: %w", err)
+	}
 
 	return newDB(db)
 }
@@ -104,6 +567,116 @@ func (s *DB) LoadAll() ([]*Link, error) {
 	return links, err
 }
 
+// LoadPage returns a page of links selected by p, and the cursor of the
+// next page, which is empty if this is the last page. Pages are selected by
+// a keyset on the sorted field and ID, so they stay consistent as links are
+// added and deleted.
+func (s *DB) LoadPage(p LinkPage) ([]*Link, string, error) {
+	key, ok := "links.id", true
+	if p.Sort != "" {
+		key, ok = linkSorts[p.Sort]
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("unknown sort %q", p.Sort)
+	}
+	op, dir := ">", "ASC"
+	if p.Desc {
+		op, dir = "<", "DESC"
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := s.db.Model(&Link{}).Select("links.*")
+	if p.Sort == "clicks" {
+		tx = tx.Joins("LEFT JOIN (SELECT id, SUM(clicks) AS clicks FROM stats WHERE deleted_at IS NULL GROUP BY id) AS link_clicks ON link_clicks.id = links.id")
+	}
+	tx = tenantLinks(tx, "links.id", p.Tenant)
+	if p.Prefix != "" {
+		prefix := p.Prefix
+		if p.Tenant != "" {
+			prefix = linkID(p.Tenant+":") + prefix
+		}
+		tx = tx.Where("SUBSTR(links.id, 1, ?) = ?", len(prefix), prefix)
+	}
+	if p.Tag != "" {
+		// tags are stored comma-separated, and can contain the LIKE wildcard _
+		tx = tx.Where("CONCAT(',', links.tags, ',') LIKE ?", "%,"+strings.ReplaceAll(p.Tag, "_", `\_`)+",%")
+	}
+	if p.Owner != "" {
+		tx = tx.Where("links.owner = ?", p.Owner)
+	}
+	if p.After != "" {
+		value, id, err := parseCursor(p.Sort, p.After)
+		if err != nil {
+			return nil, "", err
+		}
+		if p.Sort == "" {
+			tx = tx.Where("links.id "+op+" ?", id)
+		} else {
+			tx = tx.Where(fmt.Sprintf("%s %s ? OR (%s = ? AND links.id %s ?)", key, op, key, op), value, value, id)
+		}
+	}
+	if p.Sort != "" {
+		tx = tx.Order(key + " " + dir)
+	}
+
+	var links []*Link
+	if err := tx.Order("links.id " + dir).Limit(p.Limit + 1).Find(&links).Error; err != nil {
+		return nil, "", err
+	}
+	if len(links) <= p.Limit {
+		return links, "", nil
+	}
+	links = links[:p.Limit]
+
+	last := links[len(links)-1]
+	var value string
+	switch p.Sort {
+	case "":
+		return links, last.ID, nil
+	case "owner":
+		value = last.Owner
+	case "last_edit":
+		value = last.LastEdit.Format(time.RFC3339Nano)
+	case "clicks":
+		var clicks int
+		if err := s.db.Model(&Stats{}).Select("COALESCE(SUM(clicks), 0)").Where("id = ?", last.ID).Scan(&clicks).Error; err != nil {
+			return nil, "", err
+		}
+		value = strconv.Itoa(clicks)
+	}
+	return links, base64.RawURLEncoding.EncodeToString([]byte(value + "\x00" + last.ID)), nil
+}
+
+// parseCursor returns the sorted value and ID of the link a LoadPage cursor
+// points at. Cursors of pages sorted by ID are the ID itself.
+func parseCursor(sort, cursor string) (value any, id string, err error) {
+	if sort == "" {
+		return nil, cursor, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", errors.New("invalid cursor")
+	}
+	v, id, ok := strings.Cut(string(b), "\x00")
+	if !ok {
+		return nil, "", errors.New("invalid cursor")
+	}
+	switch sort {
+	case "last_edit":
+		value, err = time.Parse(time.RFC3339Nano, v)
+	case "clicks":
+		value, err = strconv.Atoi(v)
+	default:
+		value = v
+	}
+	if err != nil {
+		return nil, "", errors.New("invalid cursor")
+	}
+	return value, id, nil
+}
+
 // Load returns a Link by its short name.
 //
 // It returns fs.ErrNotExist if the link does not exist.
@@ -141,6 +714,106 @@ func (s *DB) Save(link *Link) error {
 	return nil
 }
 
+// SaveExpiryNotice records that the owner of the link short was notified of
+// its expiry at expiresAt, without changing the rest of the link.
+func (s *DB) SaveExpiryNotice(short string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Model(&Link{}).Where("id = ?", linkID(short)).Update("expiry_notified", expiresAt).Error
+}
+
+// SaveLinks saves several Links in one transaction, so either all of them
+// are saved or none are.
+func (s *DB) SaveLinks(links []*Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, link := range links {
+			link.ID = linkID(link.Short)
+			result := tx.Save(link)
+			if err := result.Error; err != nil {
+				return err
+			}
+			if rows := result.RowsAffected; rows != 1 {
+				return fmt.Errorf("saving %q: expected to affect 1 row, affected %d", link.Short, rows)
+			}
+		}
+		return nil
+	})
+}
+
+// TransferLinks changes the owner of q.Tenant's shared links owned by q.From,
+// or those of them named by q.Shorts, to q.To, and appends an audit log entry
+// for each, in one transaction. Only the owner and LastEdit time are updated,
+// and only if the link is still owned by q.From, so concurrent edits to other
+// fields are kept. It returns the transferred links, sorted by ID.
+//
+// The caller owns the returned values.
+func (s *DB) TransferLinks(q LinkTransfer) ([]*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := ""
+	if q.Tenant != "" {
+		prefix = q.Tenant + ":"
+	}
+	var links []*Link
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		sel := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("owner = ? AND short NOT LIKE ? ESCAPE '!'", q.From, likeEscaper.Replace(prefix+personalMarker)+"%")
+		if q.Tenant != "" {
+			sel = sel.Where("short LIKE ? ESCAPE '!'", likeEscaper.Replace(prefix)+"%")
+		} else {
+			// short names can't contain colons, so only tenant prefixes do
+			sel = sel.Where("short NOT LIKE ?", "%:%")
+		}
+		if q.Shorts != nil {
+			sel = sel.Where("id IN ?", linkIDs(q.Shorts))
+		}
+		if err := sel.Order("id").Find(&links).Error; err != nil {
+			return err
+		}
+		if q.Shorts != nil && len(links) != len(q.Shorts) {
+			return fmt.Errorf("expected to transfer %d links owned by %s, found %d", len(q.Shorts), q.From, len(links))
+		}
+		if len(links) == 0 {
+			return nil
+		}
+
+		ids := make([]string, len(links))
+		for i, link := range links {
+			ids[i] = link.ID
+		}
+		result := tx.Model(&Link{}).
+			Where("id IN ? AND owner = ?", ids, q.From).
+			Updates(map[string]any{"owner": q.To, "last_edit": q.Time})
+		if err := result.Error; err != nil {
+			return err
+		}
+		if rows := int(result.RowsAffected); rows != len(links) {
+			return fmt.Errorf("expected to transfer %d links, transferred %d", len(links), rows)
+		}
+
+		for _, link := range links {
+			before := *link
+			link.Owner, link.LastEdit = q.To, q.Time
+			if q.Audit == nil {
+				continue
+			}
+			if err := tx.Create(q.Audit(&before, link)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
 // Delete removes a Link using its short name.
 func (s *DB) Delete(short string) error {
 	s.mu.Lock()
@@ -157,6 +830,255 @@ func (s *DB) Delete(short string) error {
 	return nil
 }
 
+// DeleteLinks removes the links named by q.Shorts, and appends an audit log
+// entry for each, in one transaction. Nothing is deleted unless every link
+// exists and is still owned by q.Owner. It returns the deleted links, sorted
+// by ID.
+//
+// The caller owns the returned values.
+func (s *DB) DeleteLinks(q LinkDeletion) ([]*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := linkIDs(q.Shorts)
+	var links []*Link
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ? AND owner = ?", ids, q.Owner).
+			Order("id").Find(&links).Error
+		if err != nil {
+			return err
+		}
+		if len(links) != len(ids) {
+			return fmt.Errorf("expected to delete %d links owned by %s, found %d", len(ids), q.Owner, len(links))
+		}
+
+		result := tx.Where("id IN ? AND owner = ?", ids, q.Owner).Delete(&Link{})
+		if err := result.Error; err != nil {
+			return err
+		}
+		if rows := int(result.RowsAffected); rows != len(links) {
+			return fmt.Errorf("expected to delete %d links, deleted %d", len(links), rows)
+		}
+
+		if q.Audit == nil {
+			return nil
+		}
+		for _, link := range links {
+			if err := tx.Create(q.Audit(link)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// linkIDs returns the IDs of the links with the given short names.
+func linkIDs(shorts []string) []string {
+	ids := make([]string, len(shorts))
+	for i, short := range shorts {
+		ids[i] = linkID(short)
+	}
+	return ids
+}
+
+// searchDocument is the text of a link searched on Postgres. The full-text
+// and trigram indexes created by createSearchIndexes are on this expression,
+// so queries must use it exactly for the indexes to be used.
+const searchDocument = "LOWER(COALESCE(short, '') || ' ' || COALESCE(long, '') || ' ' || COALESCE(owner, '') || ' ' || COALESCE(description, '') || ' ' || COALESCE(tags, ''))"
+
+// createSearchIndexes creates the Postgres indexes used by Search: a GIN
+// full-text index, and a pg_trgm index for substring and similarity matches.
+func createSearchIndexes(db *gorm.DB) error {
+	for _, stmt := range []string{
+		"CREATE EXTENSION IF NOT EXISTS pg_trgm",
+		"CREATE INDEX IF NOT EXISTS idx_links_search_fts ON links USING GIN (to_tsvector('simple', " + searchDocument + "))",
+		"CREATE INDEX IF NOT EXISTS idx_links_search_trgm ON links USING GIN ((" + searchDocument + ") gin_trgm_ops)",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// likeEscaper escapes the LIKE wildcards in search terms, with the escape
+// character set by "ESCAPE '!'", which works the same on every database.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// Search returns up to q.Limit links of q.Tenant whose short name, long URL,
+// owner, description, or tags match q.Query, ordered by relevance.
+//
+// On Postgres, links are also matched by full-text search, and by trigram
+// similarity to catch misspellings, and ranked by both. Other databases fall
+// back to substring matching ranked by searchScore.
+//
+// The caller owns the returned values.
+func (s *DB) Search(q LinkSearch) ([]*Link, error) {
+	query, limit := q.Query, q.Limit
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := tenantLinks(s.db, "id", q.Tenant)
+	var links []*Link
+	if s.db.Dialector.Name() == "postgres" {
+		var (
+			conds []string
+			args  = []any{query, strings.ToLower(query)}
+		)
+		for _, term := range terms {
+			conds = append(conds, searchDocument+" LIKE ? ESCAPE '!'")
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+		result := tx.
+			Where("to_tsvector('simple', "+searchDocument+") @@ plainto_tsquery('simple', ?) OR ? <% "+searchDocument+" OR ("+strings.Join(conds, " AND ")+")", args...).
+			Clauses(clause.OrderBy{Expression: clause.Expr{
+				SQL:  "CASE WHEN id = ? THEN 0 ELSE 1 END, ts_rank(to_tsvector('simple', " + searchDocument + "), plainto_tsquery('simple', ?)) + word_similarity(?, " + searchDocument + ") DESC, short",
+				Vars: []any{linkID(query), query, strings.ToLower(query)},
+			}}).
+			Limit(limit).
+			Find(&links)
+		return links, result.Error
+	}
+
+	const fields = "LOWER(short) LIKE ? ESCAPE '!' OR LOWER(long) LIKE ? ESCAPE '!' OR LOWER(owner) LIKE ? ESCAPE '!' OR LOWER(description) LIKE ? ESCAPE '!' OR LOWER(tags) LIKE ? ESCAPE '!'"
+	var (
+		conds []string
+		args  []any
+	)
+	for _, term := range terms {
+		like := "%" + likeEscaper.Replace(term) + "%"
+		conds = append(conds, "("+fields+")")
+		args = append(args, like, like, like, like, like)
+	}
+	if err := tx.Where(strings.Join(conds, " AND "), args...).Find(&links).Error; err != nil {
+		return nil, err
+	}
+	rankLinks(links, terms)
+	if len(links) > limit {
+		links = links[:limit]
+	}
+	return links, nil
+}
+
+// LoadExpired returns the links of q.Tenant that expire after q.Since, and by
+// q.Until. The expires_at column is indexed for these queries.
+//
+// The caller owns the returned values.
+func (s *DB) LoadExpired(q LinkExpiry) ([]*Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var links []*Link
+	result := tenantLinks(s.db, "id", q.Tenant).
+		Where("expires_at > ? AND expires_at <= ?", q.Since, q.Until).
+		Find(&links)
+	return links, result.Error
+}
+
+// tenantLinks adds a condition to tx selecting only the links of the named
+// tenant, whose IDs are in the column id.
+func tenantLinks(tx *gorm.DB, id, tenant string) *gorm.DB {
+	if tenant == "" {
+		// short names can't contain colons, so only tenant prefixes do
+		return tx.Where(id+" NOT LIKE ?", "%:%")
+	}
+	prefix := linkID(tenant + ":")
+	return tx.Where("SUBSTR("+id+", 1, ?) = ?", len(prefix), prefix)
+}
+
+// LoadAliases returns all links that are aliases of the link with the
+// provided short name.
+//
+// The caller owns the returned values.
+func (s *DB) LoadAliases(short string) ([]*Link, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var candidates []*Link
+	if err := s.db.Where("alias_of <> ''").Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	// AliasOf is stored as entered, so compare normalized IDs.
+	id := linkID(short)
+	var aliases []*Link
+	for _, link := range candidates {
+		if linkID(link.AliasOf) == id {
+			aliases = append(aliases, link)
+		}
+	}
+	return aliases, nil
+}
+
+// LoadPatterns returns all patterns in the order they are tried: highest
+// priority first, then oldest first.
+//
+// The caller owns the returned values.
+func (s *DB) LoadPatterns() ([]*Pattern, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var patterns []*Pattern
+	if err := s.db.Order("priority DESC, id").Find(&patterns).Error; err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// LoadPattern returns a Pattern by its ID.
+//
+// It returns fs.ErrNotExist if the pattern does not exist.
+//
+// The caller owns the returned value.
+func (s *DB) LoadPattern(id uint) (*Pattern, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pattern := new(Pattern)
+	if err := s.db.First(pattern, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return pattern, nil
+}
+
+// SavePattern saves a Pattern. Patterns with a zero ID are created, and
+// their ID is set.
+func (s *DB) SavePattern(pattern *Pattern) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Save(pattern).Error
+}
+
+// DeletePattern removes a Pattern using its ID.
+func (s *DB) DeletePattern(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := s.db.Delete(&Pattern{}, id)
+	if err := result.Error; err != nil {
+		return err
+	}
+	rows := result.RowsAffected
+	if rows != 1 {
+		return fmt.Errorf("expected to affect 1 row, affected %d", rows)
+	}
+	return nil
+}
+
 // LoadStats returns click stats for links.
 func (s *DB) LoadStats() (ClickStats, error) {
 	stats := make(ClickStats)
@@ -177,6 +1099,27 @@ func (s *DB) LoadStats() (ClickStats, error) {
 	return stats, nil
 }
 
+// LoadLastClicks returns the time each link was last clicked, as of the last
+// time its stats were saved, keyed by link ID.
+func (s *DB) LoadLastClicks() (map[string]time.Time, error) {
+	last := make(map[string]time.Time)
+	var clickStats []*Stats
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := s.db.Model(&Stats{}).Select("ID, MAX(updated_at) as updated_at").Group("id").Scan(&clickStats)
+	if err := result.Error; err != nil {
+		return nil, err
+	}
+
+	for _, s := range clickStats {
+		last[s.ID] = s.UpdatedAt
+	}
+
+	return last, nil
+}
+
 // SaveStats records click stats for links.  The provided map includes
 // incremental clicks that have occurred since the last time SaveStats
 // was called.
@@ -218,3 +1161,129 @@ func (s *DB) DeleteStats(short string) error {
 	}
 	return nil
 }
+
+// AppendAudit adds entry to the audit log. Entries are never changed or
+// deleted.
+func (s *DB) AppendAudit(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Create(entry).Error
+}
+
+// LoadAudit returns the entries of the audit log selected by q, ordered by
+// ID.
+func (s *DB) LoadAudit(q AuditQuery) ([]*AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := s.db.Where("tenant = ?", q.Tenant)
+	if q.Actor != "" {
+		tx = tx.Where("actor = ?", q.Actor)
+	}
+	if q.Action != "" {
+		tx = tx.Where("action = ?", q.Action)
+	}
+	if q.Target != "" {
+		tx = tx.Where("target = ?", q.Target)
+	}
+	if !q.Since.IsZero() {
+		tx = tx.Where("time >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		tx = tx.Where("time < ?", q.Until)
+	}
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+	if q.After != 0 {
+		tx = tx.Where("id "+op+" ?", q.After)
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+
+	var entries []*AuditEntry
+	if err := tx.Order("id " + dir).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SaveDelivery adds d to the webhook deliveries if it is new, or updates it
+// with the result of an attempt to deliver it.
+func (s *DB) SaveDelivery(d *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Save(d).Error
+}
+
+// LoadDueDeliveries returns the pending webhook deliveries selected by q,
+// oldest first.
+func (s *DB) LoadDueDeliveries(q DueDeliveryQuery) ([]*WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := s.db.Where("status = ?", DeliveryPending)
+	if q.URL != "" {
+		tx = tx.Where("url = ?", q.URL)
+	}
+	if len(q.Except) > 0 {
+		tx = tx.Where("url NOT IN ?", q.Except)
+	}
+	if !q.By.IsZero() {
+		tx = tx.Where("next_attempt <= ?", q.By)
+	}
+	var deliveries []*WebhookDelivery
+	err := tx.Order("next_attempt, id").
+		Limit(q.Limit).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// LoadDeliveries returns the webhook deliveries selected by q, newest first.
+func (s *DB) LoadDeliveries(q DeliveryQuery) ([]*WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := s.db.Where("tenant = ?", q.Tenant)
+	if q.Status != "" {
+		tx = tx.Where("status = ?", q.Status)
+	}
+	if q.Before != 0 {
+		tx = tx.Where("id < ?", q.Before)
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+
+	var deliveries []*WebhookDelivery
+	if err := tx.Order("id DESC").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// LoadCheckpoint returns the time saved for the checkpoint name, or the zero
+// time if there is none.
+func (s *DB) LoadCheckpoint(name string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var c Checkpoint
+	err := s.db.Where("name = ?", name).Limit(1).Find(&c).Error
+	return c.Time, err
+}
+
+// SaveCheckpoint saves t as the time of the checkpoint name.
+func (s *DB) SaveCheckpoint(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Save(&Checkpoint{Name: name, Time: t}).Error
+}
@@ -6,6 +6,7 @@ package golink
 
 import (
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -33,6 +34,20 @@ func (m *MockDatabase) EXPECT() *MockDatabaseMockRecorder {
 	return m.recorder
 }
 
+// AppendAudit mocks base method.
+func (m *MockDatabase) AppendAudit(arg0 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AppendAudit", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AppendAudit indicates an expected call of AppendAudit.
+func (mr *MockDatabaseMockRecorder) AppendAudit(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendAudit", reflect.TypeOf((*MockDatabase)(nil).AppendAudit), arg0)
+}
+
 // Delete mocks base method.
 func (m *MockDatabase) Delete(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -47,6 +62,35 @@ func (mr *MockDatabaseMockRecorder) Delete(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockDatabase)(nil).Delete), arg0)
 }
 
+// DeleteLinks mocks base method.
+func (m *MockDatabase) DeleteLinks(arg0 LinkDeletion) ([]*Link, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteLinks", arg0)
+	ret0, _ := ret[0].([]*Link)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteLinks indicates an expected call of DeleteLinks.
+func (mr *MockDatabaseMockRecorder) DeleteLinks(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteLinks", reflect.TypeOf((*MockDatabase)(nil).DeleteLinks), arg0)
+}
+
+// DeletePattern mocks base method.
+func (m *MockDatabase) DeletePattern(id uint) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeletePattern", id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeletePattern indicates an expected call of DeletePattern.
+func (mr *MockDatabaseMockRecorder) DeletePattern(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePattern", reflect.TypeOf((*MockDatabase)(nil).DeletePattern), id)
+}
+
 // DeleteStats mocks base method.
 func (m *MockDatabase) DeleteStats(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -76,6 +120,21 @@ func (mr *MockDatabaseMockRecorder) Load(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Load", reflect.TypeOf((*MockDatabase)(nil).Load), arg0)
 }
 
+// LoadAliases mocks base method.
+func (m *MockDatabase) LoadAliases(short string) ([]*Link, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadAliases", short)
+	ret0, _ := ret[0].([]*Link)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadAliases indicates an expected call of LoadAliases.
+func (mr *MockDatabaseMockRecorder) LoadAliases(short interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadAliases", reflect.TypeOf((*MockDatabase)(nil).LoadAliases), short)
+}
+
 // LoadAll mocks base method.
 func (m *MockDatabase) LoadAll() ([]*Link, error) {
 	m.ctrl.T.Helper()
@@ -91,6 +150,142 @@ func (mr *MockDatabaseMockRecorder) LoadAll() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadAll", reflect.TypeOf((*MockDatabase)(nil).LoadAll))
 }
 
+// LoadAudit mocks base method.
+func (m *MockDatabase) LoadAudit(arg0 AuditQuery) ([]*AuditEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadAudit", arg0)
+	ret0, _ := ret[0].([]*AuditEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadAudit indicates an expected call of LoadAudit.
+func (mr *MockDatabaseMockRecorder) LoadAudit(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadAudit", reflect.TypeOf((*MockDatabase)(nil).LoadAudit), arg0)
+}
+
+// LoadCheckpoint mocks base method.
+func (m *MockDatabase) LoadCheckpoint(name string) (time.Time, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadCheckpoint", name)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadCheckpoint indicates an expected call of LoadCheckpoint.
+func (mr *MockDatabaseMockRecorder) LoadCheckpoint(name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadCheckpoint", reflect.TypeOf((*MockDatabase)(nil).LoadCheckpoint), name)
+}
+
+// LoadDeliveries mocks base method.
+func (m *MockDatabase) LoadDeliveries(arg0 DeliveryQuery) ([]*WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadDeliveries", arg0)
+	ret0, _ := ret[0].([]*WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadDeliveries indicates an expected call of LoadDeliveries.
+func (mr *MockDatabaseMockRecorder) LoadDeliveries(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadDeliveries", reflect.TypeOf((*MockDatabase)(nil).LoadDeliveries), arg0)
+}
+
+// LoadDueDeliveries mocks base method.
+func (m *MockDatabase) LoadDueDeliveries(arg0 DueDeliveryQuery) ([]*WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadDueDeliveries", arg0)
+	ret0, _ := ret[0].([]*WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadDueDeliveries indicates an expected call of LoadDueDeliveries.
+func (mr *MockDatabaseMockRecorder) LoadDueDeliveries(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadDueDeliveries", reflect.TypeOf((*MockDatabase)(nil).LoadDueDeliveries), arg0)
+}
+
+// LoadExpired mocks base method.
+func (m *MockDatabase) LoadExpired(arg0 LinkExpiry) ([]*Link, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadExpired", arg0)
+	ret0, _ := ret[0].([]*Link)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadExpired indicates an expected call of LoadExpired.
+func (mr *MockDatabaseMockRecorder) LoadExpired(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadExpired", reflect.TypeOf((*MockDatabase)(nil).LoadExpired), arg0)
+}
+
+// LoadLastClicks mocks base method.
+func (m *MockDatabase) LoadLastClicks() (map[string]time.Time, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadLastClicks")
+	ret0, _ := ret[0].(map[string]time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadLastClicks indicates an expected call of LoadLastClicks.
+func (mr *MockDatabaseMockRecorder) LoadLastClicks() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadLastClicks", reflect.TypeOf((*MockDatabase)(nil).LoadLastClicks))
+}
+
+// LoadPage mocks base method.
+func (m *MockDatabase) LoadPage(arg0 LinkPage) ([]*Link, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadPage", arg0)
+	ret0, _ := ret[0].([]*Link)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// LoadPage indicates an expected call of LoadPage.
+func (mr *MockDatabaseMockRecorder) LoadPage(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadPage", reflect.TypeOf((*MockDatabase)(nil).LoadPage), arg0)
+}
+
+// LoadPattern mocks base method.
+func (m *MockDatabase) LoadPattern(id uint) (*Pattern, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadPattern", id)
+	ret0, _ := ret[0].(*Pattern)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadPattern indicates an expected call of LoadPattern.
+func (mr *MockDatabaseMockRecorder) LoadPattern(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadPattern", reflect.TypeOf((*MockDatabase)(nil).LoadPattern), id)
+}
+
+// LoadPatterns mocks base method.
+func (m *MockDatabase) LoadPatterns() ([]*Pattern, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadPatterns")
+	ret0, _ := ret[0].([]*Pattern)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadPatterns indicates an expected call of LoadPatterns.
+func (mr *MockDatabaseMockRecorder) LoadPatterns() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadPatterns", reflect.TypeOf((*MockDatabase)(nil).LoadPatterns))
+}
+
 // LoadStats mocks base method.
 func (m *MockDatabase) LoadStats() (ClickStats, error) {
 	m.ctrl.T.Helper()
@@ -120,6 +315,76 @@ func (mr *MockDatabaseMockRecorder) Save(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockDatabase)(nil).Save), arg0)
 }
 
+// SaveCheckpoint mocks base method.
+func (m *MockDatabase) SaveCheckpoint(name string, t time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveCheckpoint", name, t)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveCheckpoint indicates an expected call of SaveCheckpoint.
+func (mr *MockDatabaseMockRecorder) SaveCheckpoint(name, t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveCheckpoint", reflect.TypeOf((*MockDatabase)(nil).SaveCheckpoint), name, t)
+}
+
+// SaveDelivery mocks base method.
+func (m *MockDatabase) SaveDelivery(arg0 *WebhookDelivery) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveDelivery", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveDelivery indicates an expected call of SaveDelivery.
+func (mr *MockDatabaseMockRecorder) SaveDelivery(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveDelivery", reflect.TypeOf((*MockDatabase)(nil).SaveDelivery), arg0)
+}
+
+// SaveExpiryNotice mocks base method.
+func (m *MockDatabase) SaveExpiryNotice(short string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveExpiryNotice", short, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveExpiryNotice indicates an expected call of SaveExpiryNotice.
+func (mr *MockDatabaseMockRecorder) SaveExpiryNotice(short, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveExpiryNotice", reflect.TypeOf((*MockDatabase)(nil).SaveExpiryNotice), short, expiresAt)
+}
+
+// SaveLinks mocks base method.
+func (m *MockDatabase) SaveLinks(arg0 []*Link) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveLinks", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveLinks indicates an expected call of SaveLinks.
+func (mr *MockDatabaseMockRecorder) SaveLinks(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveLinks", reflect.TypeOf((*MockDatabase)(nil).SaveLinks), arg0)
+}
+
+// SavePattern mocks base method.
+func (m *MockDatabase) SavePattern(arg0 *Pattern) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SavePattern", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SavePattern indicates an expected call of SavePattern.
+func (mr *MockDatabaseMockRecorder) SavePattern(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SavePattern", reflect.TypeOf((*MockDatabase)(nil).SavePattern), arg0)
+}
+
 // SaveStats mocks base method.
 func (m *MockDatabase) SaveStats(arg0 ClickStats) error {
 	m.ctrl.T.Helper()
@@ -133,3 +398,33 @@ func (mr *MockDatabaseMockRecorder) SaveStats(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveStats", reflect.TypeOf((*MockDatabase)(nil).SaveStats), arg0)
 }
+
+// Search mocks base method.
+func (m *MockDatabase) Search(arg0 LinkSearch) ([]*Link, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Search", arg0)
+	ret0, _ := ret[0].([]*Link)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Search indicates an expected call of Search.
+func (mr *MockDatabaseMockRecorder) Search(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockDatabase)(nil).Search), arg0)
+}
+
+// TransferLinks mocks base method.
+func (m *MockDatabase) TransferLinks(arg0 LinkTransfer) ([]*Link, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferLinks", arg0)
+	ret0, _ := ret[0].([]*Link)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransferLinks indicates an expected call of TransferLinks.
+func (mr *MockDatabaseMockRecorder) TransferLinks(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferLinks", reflect.TypeOf((*MockDatabase)(nil).TransferLinks), arg0)
+}
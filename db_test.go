@@ -5,13 +5,17 @@ package golink
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/go-cmp/cmp"
 	cmpopts "github.com/google/go-cmp/cmp/cmpopts"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
@@ -44,7 +48,7 @@ func Test_DB_SaveLoadDeleteLinks(t *testing.T) {
 	}
 
 	links := []*Link{
-		{Short: "short", Long: "long", ID: linkID("short")},
+		{Short: "short", Long: "long", ID: linkID("short"), Tags: Tags{"docs", "team"}},
 		{Short: "Foo.Bar", Long: "long", ID: linkID("Foo.Bar")},
 	}
 
@@ -52,15 +56,15 @@ func Test_DB_SaveLoadDeleteLinks(t *testing.T) {
 	for _, link := range links {
 		time := sqlmock.AnyArg()
 		mock.ExpectExec(regexp.QuoteMeta(
-			"UPDATE `links` SET `created_at`=?,`updated_at`=?,`deleted_at`=?,`short`=?,`long`=?,`created`=?,`last_edit`=?,`owner`=? WHERE `links`.`deleted_at` IS NULL AND `id` = ?")).
-			WithArgs(time, sqlmock.AnyArg(), nil, link.Short, link.Long, time, time, "", linkID(link.Short)).
+			"UPDATE `links` SET `created_at`=?,`updated_at`=?,`deleted_at`=?,`short`=?,`long`=?,`alias_of`=?,`query_mode`=?,`status`=?,`preview`=?,`locked`=?,`created`=?,`last_edit`=?,`owner`=?,`description`=?,`tags`=?,`active_from`=?,`expires_at`=?,`expiry_notified`=?,`disabled`=?,`disabled_reason`=?,`visibility`=?,`allowed_users`=? WHERE `links`.`deleted_at` IS NULL AND `id` = ?")).
+			WithArgs(time, sqlmock.AnyArg(), nil, link.Short, link.Long, "", "", 0, false, false, time, time, "", "", strings.Join(link.Tags, ","), time, time, time, false, "", "", "", linkID(link.Short)).
 			WillReturnResult(sqlmock.NewResult(0, 1))
 
 		mock.ExpectQuery(regexp.QuoteMeta(
 			"SELECT * FROM `links` WHERE id = ? AND `links`.`deleted_at` IS NULL ORDER BY `links`.`id` LIMIT 1")).
 			WithArgs(linkID(link.Short)).
-			WillReturnRows(sqlmock.NewRows([]string{"id", "short", "long", "created_at", "last_edit"}).
-				AddRow(linkID(link.Short), link.Short, link.Long, link.CreatedAt, link.LastEdit))
+			WillReturnRows(sqlmock.NewRows([]string{"id", "short", "long", "created_at", "last_edit", "tags"}).
+				AddRow(linkID(link.Short), link.Short, link.Long, link.CreatedAt, link.LastEdit, strings.Join(link.Tags, ",")))
 
 		if err := SUT.Save(link); err != nil {
 			t.Error(err)
@@ -76,9 +80,9 @@ func Test_DB_SaveLoadDeleteLinks(t *testing.T) {
 		}
 	}
 
-	selected_rows := sqlmock.NewRows([]string{"id", "short", "long", "created_at", "last_edit"})
+	selected_rows := sqlmock.NewRows([]string{"id", "short", "long", "created_at", "last_edit", "tags"})
 	for _, link := range links {
-		selected_rows.AddRow(linkID(link.Short), link.Short, link.Long, link.CreatedAt, link.LastEdit)
+		selected_rows.AddRow(linkID(link.Short), link.Short, link.Long, link.CreatedAt, link.LastEdit, strings.Join(link.Tags, ","))
 	}
 
 	mock.ExpectQuery(regexp.QuoteMeta(
@@ -167,8 +171,8 @@ func Test_DB_SaveLoadDeleteStats(t *testing.T) {
 	time := sqlmock.AnyArg()
 	for _, link := range links {
 		mock.ExpectExec(regexp.QuoteMeta(
-			"UPDATE `links` SET `created_at`=?,`updated_at`=?,`deleted_at`=?,`short`=?,`long`=?,`created`=?,`last_edit`=?,`owner`=? WHERE `links`.`deleted_at` IS NULL AND `id` = ?")).
-			WithArgs(time, time, nil, link.Short, link.Long, time, time, "", linkID(link.Short)).
+			"UPDATE `links` SET `created_at`=?,`updated_at`=?,`deleted_at`=?,`short`=?,`long`=?,`alias_of`=?,`query_mode`=?,`status`=?,`preview`=?,`locked`=?,`created`=?,`last_edit`=?,`owner`=?,`description`=?,`tags`=?,`active_from`=?,`expires_at`=?,`expiry_notified`=?,`disabled`=?,`disabled_reason`=?,`visibility`=?,`allowed_users`=? WHERE `links`.`deleted_at` IS NULL AND `id` = ?")).
+			WithArgs(time, time, nil, link.Short, link.Long, "", "", 0, false, false, time, time, "", "", "", time, time, time, false, "", "", "", linkID(link.Short)).
 			WillReturnResult(sqlmock.NewResult(0, 1))
 		if err := SUT.Save(link); err != nil {
 			t.Error(err)
@@ -243,3 +247,785 @@ func Test_DB_SaveLoadDeleteStats(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Test searching links for DB using the generic substring fallback.
+func Test_DB_Search(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rows := sqlmock.NewRows([]string{"id", "short", "long", "owner", "description"}).
+		AddRow("standup", "standup", "https://meet/standup", "foo@example.com", "daily docs sync").
+		AddRow("docs", "docs", "https://docs/", "foo@example.com", "").
+		AddRow("apidocs", "api-docs", "https://docs/api", "foo@example.com", "")
+	like := "%docs%"
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `links` WHERE id NOT LIKE ? AND ((LOWER(short) LIKE ? ESCAPE '!' OR LOWER(long) LIKE ? ESCAPE '!' OR LOWER(owner) LIKE ? ESCAPE '!' OR LOWER(description) LIKE ? ESCAPE '!' OR LOWER(tags) LIKE ? ESCAPE '!')) AND `links`.`deleted_at` IS NULL")).
+		WithArgs("%:%", like, like, like, like, like).
+		WillReturnRows(rows)
+
+	got, err := SUT.Search(LinkSearch{Query: "Docs", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shorts []string
+	for _, link := range got {
+		shorts = append(shorts, link.Short)
+	}
+	if want := []string{"docs", "api-docs"}; !cmp.Equal(shorts, want) {
+		t.Errorf("db.Search got %q, want %q", shorts, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test searching links for DB on Postgres, with full-text, trigram, and
+// escaped substring matches.
+func Test_DB_SearchPostgres(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqldb}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "links" WHERE SUBSTR(id, 1, $1) = $2 AND (to_tsvector('simple', `+searchDocument+`) @@ plainto_tsquery('simple', $3) OR $4 <% `+searchDocument+` OR (`+searchDocument+` LIKE $5 ESCAPE '!' AND `+searchDocument+` LIKE $6 ESCAPE '!')) AND "links"."deleted_at" IS NULL ORDER BY CASE WHEN id = $7 THEN 0 ELSE 1 END`)).
+		WithArgs(6, "sales:", "50%_Off sale!", "50%_off sale!", "%50!%!_off%", "%sale!!%", sqlmock.AnyArg(), "50%_Off sale!", "50%_off sale!").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short"}).AddRow("sale", "sale"))
+
+	got, err := SUT.Search(LinkSearch{Query: "50%_Off sale!", Tenant: "sales", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Short != "sale" {
+		t.Errorf("db.Search got %v, want sale", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test loading the links of a tenant that expired in a time range for DB.
+func Test_DB_LoadExpired(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	now := time.Date(2022, 6, 2, 12, 0, 0, 0, time.UTC)
+	since := now.Add(-10 * time.Minute)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `links` WHERE SUBSTR(id, 1, ?) = ? AND (expires_at > ? AND expires_at <= ?) AND `links`.`deleted_at` IS NULL")).
+		WithArgs(6, "sales:", since, now).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short"}).AddRow("sales:gone", "sales:gone"))
+
+	got, err := SUT.LoadExpired(LinkExpiry{Tenant: "sales", Since: since, Until: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Short != "sales:gone" {
+		t.Errorf("db.LoadExpired got %v, want sales:gone", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test loading the aliases of a link for DB.
+func Test_DB_LoadAliases(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `links` WHERE alias_of <> '' AND `links`.`deleted_at` IS NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short", "alias_of"}).
+			AddRow("k8s", "k8s", "Kuber-netes").
+			AddRow("kube", "kube", "kubernetes").
+			AddRow("m", "m", "meet"))
+
+	got, err := SUT.LoadAliases("kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shorts []string
+	for _, link := range got {
+		shorts = append(shorts, link.Short)
+	}
+	if want := []string{"k8s", "kube"}; !cmp.Equal(shorts, want) {
+		t.Errorf("db.LoadAliases got %q, want %q", shorts, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test loading patterns in priority order for DB.
+func Test_DB_LoadPatterns(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `patterns` WHERE `patterns`.`deleted_at` IS NULL ORDER BY priority DESC, id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "regexp", "priority"}).
+			AddRow(2, "pr[0-9]+", 10).
+			AddRow(1, "[A-Z]+-[0-9]+", 0))
+
+	got, err := SUT.LoadPatterns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exprs []string
+	for _, p := range got {
+		exprs = append(exprs, p.Regexp)
+	}
+	if want := []string{"pr[0-9]+", "[A-Z]+-[0-9]+"}; !cmp.Equal(exprs, want) {
+		t.Errorf("db.LoadPatterns got %q, want %q", exprs, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test loading pages of links sorted by ID and by clicks for DB.
+func Test_DB_LoadPage(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT links.* FROM `links` WHERE SUBSTR(links.id, 1, ?) = ? AND links.owner = ? AND links.id > ? AND `links`.`deleted_at` IS NULL ORDER BY links.id ASC LIMIT 3")).
+		WithArgs(4, "eng:", "foo@example.com", "eng:a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short"}).
+			AddRow("eng:b", "eng:b").
+			AddRow("eng:c", "eng:c").
+			AddRow("eng:d", "eng:d"))
+
+	got, next, err := SUT.LoadPage(LinkPage{Tenant: "eng", Owner: "foo@example.com", After: "eng:a", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || next != "eng:c" {
+		t.Errorf("db.LoadPage got %d links and cursor %q, want 2 links and cursor eng:c", len(got), next)
+	}
+
+	after := base64.RawURLEncoding.EncodeToString([]byte("7\x00b"))
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT links.* FROM `links` LEFT JOIN (SELECT id, SUM(clicks) AS clicks FROM stats WHERE deleted_at IS NULL GROUP BY id) AS link_clicks ON link_clicks.id = links.id WHERE links.id NOT LIKE ? AND CONCAT(',', links.tags, ',') LIKE ? AND (COALESCE(link_clicks.clicks, 0) < ? OR (COALESCE(link_clicks.clicks, 0) = ? AND links.id < ?)) AND `links`.`deleted_at` IS NULL ORDER BY COALESCE(link_clicks.clicks, 0) DESC,links.id DESC LIMIT 2")).
+		WithArgs("%:%", `%,on\_call,%`, 7, 7, "b").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short"}).
+			AddRow("a", "a").
+			AddRow("c", "c"))
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT COALESCE(SUM(clicks), 0) FROM `stats` WHERE id = ? AND `stats`.`deleted_at` IS NULL")).
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"clicks"}).AddRow(5))
+
+	got, next, err = SUT.LoadPage(LinkPage{Sort: "clicks", Desc: true, Tag: "on_call", After: after, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Short != "a" {
+		t.Errorf("db.LoadPage got %+v, want link a", got)
+	}
+	if value, id, err := parseCursor("clicks", next); err != nil || value != 5 || id != "a" {
+		t.Errorf("next cursor = %v, %q, %v; want 5 clicks of a", value, id, err)
+	}
+
+	if _, _, err := SUT.LoadPage(LinkPage{Sort: "color", Limit: 1}); err == nil {
+		t.Error("db.LoadPage with unknown sort succeeded, want error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test loading when links were last clicked for DB.
+func Test_DB_LoadLastClicks(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	clicked := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT ID, MAX(updated_at) as updated_at FROM `stats` WHERE `stats`.`deleted_at` IS NULL GROUP BY `id`")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "updated_at"}).AddRow("docs", clicked))
+
+	got, err := SUT.LoadLastClicks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]time.Time{"docs": clicked}; !cmp.Equal(got, want) {
+		t.Errorf("db.LoadLastClicks got %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test saving several links in one transaction for DB.
+func Test_DB_SaveLinks(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	const update = "UPDATE `links` SET"
+	links := []*Link{
+		{Short: "docs", Long: "http://docs/", Owner: "group:eng"},
+		{Short: "Wiki", Long: "http://wiki/", Owner: "group:eng"},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(update)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(update)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := SUT.SaveLinks(links); err != nil {
+		t.Fatal(err)
+	}
+	if links[1].ID != "wiki" {
+		t.Errorf("saved link ID = %q, want wiki", links[1].ID)
+	}
+
+	// a failed save rolls back the others
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(update)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(update)).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	if err := SUT.SaveLinks(links); err == nil {
+		t.Error("db.SaveLinks with a failed save succeeded, want error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test transferring links and recording them in the audit log in one
+// transaction for DB.
+func Test_DB_TransferLinks(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	now := time.Now().UTC()
+	q := LinkTransfer{
+		Tenant: "sales",
+		From:   "bob@example.com",
+		To:     "group:eng",
+		Time:   now,
+		Audit: func(before, after *Link) *AuditEntry {
+			return &AuditEntry{Time: now, Actor: "foo@example.com", Action: auditLinkTransfer, Target: after.Short}
+		},
+	}
+	selectLinks := regexp.QuoteMeta("SELECT * FROM `links` WHERE (owner = ? AND short NOT LIKE ? ESCAPE '!') AND short LIKE ? ESCAPE '!' AND `links`.`deleted_at` IS NULL ORDER BY id FOR UPDATE")
+	update := regexp.QuoteMeta("UPDATE `links` SET `last_edit`=?,`owner`=?,`updated_at`=? WHERE (id IN (?,?) AND owner = ?) AND `links`.`deleted_at` IS NULL")
+	insertAudit := regexp.QuoteMeta("INSERT INTO `audit_entries`")
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "short", "owner"}).
+			AddRow("sales:docs", "sales:docs", "bob@example.com").
+			AddRow("sales:wiki", "sales:wiki", "bob@example.com")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectLinks).
+		WithArgs("bob@example.com", "sales:~%", "sales:%").
+		WillReturnRows(rows())
+	mock.ExpectExec(update).
+		WithArgs(now, "group:eng", sqlmock.AnyArg(), "sales:docs", "sales:wiki", "bob@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(insertAudit).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertAudit).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+	links, err := SUT.TransferLinks(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0].Owner != "group:eng" || !links[1].LastEdit.Equal(now) {
+		t.Errorf("db.TransferLinks got %+v, want both links owned by group:eng", links)
+	}
+
+	// a link changed during the transfer rolls it back
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectLinks).WillReturnRows(rows())
+	mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	if _, err := SUT.TransferLinks(q); err == nil {
+		t.Error("db.TransferLinks with a changed link succeeded, want error")
+	}
+
+	// so does failing to record the transfer
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectLinks).WillReturnRows(rows())
+	mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(insertAudit).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	if _, err := SUT.TransferLinks(q); err == nil {
+		t.Error("db.TransferLinks with a failed audit entry succeeded, want error")
+	}
+
+	// transferring links by name fails if any of them is no longer owned
+	// by q.From
+	q.Shorts = []string{"sales:docs", "sales:wiki", "sales:plans"}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `links` WHERE (owner = ? AND short NOT LIKE ? ESCAPE '!') AND short LIKE ? ESCAPE '!' AND id IN (?,?,?) AND `links`.`deleted_at` IS NULL ORDER BY id FOR UPDATE")).
+		WithArgs("bob@example.com", "sales:~%", "sales:%", "sales:docs", "sales:wiki", "sales:plans").
+		WillReturnRows(rows())
+	mock.ExpectRollback()
+	if _, err := SUT.TransferLinks(q); err == nil {
+		t.Error("db.TransferLinks with a link owned by someone else succeeded, want error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test deleting links and recording them in the audit log in one transaction
+// for DB.
+func Test_DB_DeleteLinks(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	q := LinkDeletion{
+		Shorts: []string{"docs", "wiki"},
+		Owner:  "bob@example.com",
+		Audit: func(link *Link) *AuditEntry {
+			return &AuditEntry{Actor: "bob@example.com", Action: auditLinkDelete, Target: link.Short}
+		},
+	}
+	selectLinks := regexp.QuoteMeta("SELECT * FROM `links` WHERE (id IN (?,?) AND owner = ?) AND `links`.`deleted_at` IS NULL ORDER BY id FOR UPDATE")
+	deleteLinks := regexp.QuoteMeta("UPDATE `links` SET `deleted_at`=? WHERE (id IN (?,?) AND owner = ?) AND `links`.`deleted_at` IS NULL")
+	insertAudit := regexp.QuoteMeta("INSERT INTO `audit_entries`")
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "short", "owner"}).
+			AddRow("docs", "docs", "bob@example.com").
+			AddRow("wiki", "wiki", "bob@example.com")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectLinks).
+		WithArgs("docs", "wiki", "bob@example.com").
+		WillReturnRows(rows())
+	mock.ExpectExec(deleteLinks).
+		WithArgs(sqlmock.AnyArg(), "docs", "wiki", "bob@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(insertAudit).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertAudit).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+	links, err := SUT.DeleteLinks(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0].Short != "docs" || links[1].Short != "wiki" {
+		t.Errorf("db.DeleteLinks got %+v, want docs and wiki", links)
+	}
+
+	// a link that was transferred in the meantime deletes nothing
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectLinks).WillReturnRows(sqlmock.NewRows([]string{"id", "short", "owner"}).AddRow("docs", "docs", "bob@example.com"))
+	mock.ExpectRollback()
+	if _, err := SUT.DeleteLinks(q); err == nil {
+		t.Error("db.DeleteLinks with a transferred link succeeded, want error")
+	}
+
+	// nor does failing to record the deletion
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectLinks).WillReturnRows(rows())
+	mock.ExpectExec(deleteLinks).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(insertAudit).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	if _, err := SUT.DeleteLinks(q); err == nil {
+		t.Error("db.DeleteLinks with a failed audit entry succeeded, want error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test appending to and loading the audit log for DB.
+func Test_DB_AppendLoadAudit(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	when := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	entry := &AuditEntry{
+		Time:   when,
+		Actor:  "foo@example.com",
+		IP:     "192.0.2.1",
+		Action: auditLinkDelete,
+		Target: "docs",
+		Before: []byte(`{"Short":"docs"}`),
+	}
+	mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `audit_entries` (`time`,`tenant`,`actor`,`ip`,`user_agent`,`action`,`target`,`before`,`after`) VALUES (?,?,?,?,?,?,?,?,(NULL))")).
+		WithArgs(when, "", "foo@example.com", "192.0.2.1", "", auditLinkDelete, "docs", entry.Before).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	if err := SUT.AppendAudit(entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != 7 {
+		t.Errorf("db.AppendAudit set ID %d, want 7", entry.ID)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `audit_entries` WHERE tenant = ? AND actor = ? AND action = ? AND time >= ? AND id < ? ORDER BY id DESC LIMIT 10")).
+		WithArgs("", "foo@example.com", auditLinkDelete, when, 9).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "time", "actor", "ip", "action", "target", "before"}).
+			AddRow(7, when, "foo@example.com", "192.0.2.1", auditLinkDelete, "docs", []byte(`{"Short":"docs"}`)))
+	got, err := SUT.LoadAudit(AuditQuery{
+		Actor:  "foo@example.com",
+		Action: auditLinkDelete,
+		Since:  when,
+		Desc:   true,
+		After:  9,
+		Limit:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*AuditEntry{entry}; !cmp.Equal(got, want) {
+		t.Errorf("db.LoadAudit got %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test queueing and loading webhook deliveries for DB.
+func Test_DB_Deliveries(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	now := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	d := &WebhookDelivery{
+		Created:     now,
+		URL:         "http://bot/",
+		Event:       webhookLinkCreate,
+		Payload:     []byte(`{"event":"link.create"}`),
+		Status:      DeliveryPending,
+		NextAttempt: now,
+	}
+	mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `webhook_deliveries` (`tenant`,`created`,`url`,`event`,`payload`,`status`,`attempts`,`next_attempt`,`response_code`,`error`) VALUES (?,?,?,?,?,?,?,?,?,?)")).
+		WithArgs("", now, "http://bot/", webhookLinkCreate, d.Payload, DeliveryPending, 0, now, 0, "").
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	if err := SUT.SaveDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != 3 {
+		t.Errorf("db.SaveDelivery set ID %d, want 3", d.ID)
+	}
+
+	d.Status, d.Attempts, d.ResponseCode = DeliveryDelivered, 1, 204
+	mock.ExpectExec(regexp.QuoteMeta(
+		"UPDATE `webhook_deliveries` SET `tenant`=?,`created`=?,`url`=?,`event`=?,`payload`=?,`status`=?,`attempts`=?,`next_attempt`=?,`response_code`=?,`error`=? WHERE `id` = ?")).
+		WithArgs("", now, "http://bot/", webhookLinkCreate, d.Payload, DeliveryDelivered, 1, now, 204, "", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := SUT.SaveDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []string{"id", "created", "url", "event", "payload", "status", "attempts", "next_attempt"}
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `webhook_deliveries` WHERE status = ? AND url = ? AND next_attempt <= ? ORDER BY next_attempt, id LIMIT 100")).
+		WithArgs(DeliveryPending, "http://bot/", now).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(4, now, "http://bot/", webhookLinkDelete, []byte(`{}`), DeliveryPending, 0, now))
+	due, err := SUT.LoadDueDeliveries(DueDeliveryQuery{URL: "http://bot/", By: now, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].ID != 4 || due[0].Event != webhookLinkDelete {
+		t.Errorf("db.LoadDueDeliveries got %+v, want delivery 4", due)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `webhook_deliveries` WHERE status = ? AND url NOT IN (?,?) ORDER BY next_attempt, id LIMIT 100")).
+		WithArgs(DeliveryPending, "http://bot/", "http://other/").
+		WillReturnRows(sqlmock.NewRows(columns))
+	if _, err := SUT.LoadDueDeliveries(DueDeliveryQuery{Except: []string{"http://bot/", "http://other/"}, Limit: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT * FROM `webhook_deliveries` WHERE tenant = ? AND status = ? AND id < ? ORDER BY id DESC LIMIT 10")).
+		WithArgs("wiki", DeliveryFailed, 9).
+		WillReturnRows(sqlmock.NewRows(columns))
+	if _, err := SUT.LoadDeliveries(DeliveryQuery{Tenant: "wiki", Status: DeliveryFailed, Before: 9, Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test recording expiry notices for DB.
+func Test_DB_SaveExpiryNotice(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expires := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	mock.ExpectExec(regexp.QuoteMeta(
+		"UPDATE `links` SET `expiry_notified`=?,`updated_at`=? WHERE id = ? AND `links`.`deleted_at` IS NULL")).
+		WithArgs(expires, sqlmock.AnyArg(), "foobar").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := SUT.SaveExpiryNotice("Foo-Bar", expires); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test saving and loading checkpoints for DB.
+func Test_DB_Checkpoint(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Errorf("Unable to mock DB connection. %e", err)
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DriverName:                "mysql",
+		Conn:                      sqldb,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	SUT, err := newDB(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	selectCheckpoint := regexp.QuoteMeta("SELECT * FROM `checkpoints` WHERE name = ? LIMIT 1")
+	mock.ExpectQuery(selectCheckpoint).
+		WithArgs(expiryCheckpoint).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "time"}))
+	if got, err := SUT.LoadCheckpoint(expiryCheckpoint); err != nil || !got.IsZero() {
+		t.Errorf("db.LoadCheckpoint with no checkpoint = %v, %v; want zero time", got, err)
+	}
+
+	now := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `checkpoints` SET `time`=? WHERE `name` = ?")).
+		WithArgs(now, expiryCheckpoint).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := SUT.SaveCheckpoint(expiryCheckpoint, now); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(selectCheckpoint).
+		WithArgs(expiryCheckpoint).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "time"}).AddRow(expiryCheckpoint, now))
+	if got, err := SUT.LoadCheckpoint(expiryCheckpoint); err != nil || !got.Equal(now) {
+		t.Errorf("db.LoadCheckpoint = %v, %v; want %v", got, err, now)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,644 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Formats links can be exported and imported in. The default format is JSON
+// Lines, which is the only one to include every field of a link.
+const (
+	formatJSONL     = ""
+	formatCSV       = "csv"
+	formatYAML      = "yaml"
+	formatBookmarks = "html"
+)
+
+// exportFormats are the content types and file extensions of the export
+// formats.
+var exportFormats = map[string]struct{ contentType, ext string }{
+	formatJSONL:     {"application/jsonl", "json"},
+	formatCSV:       {"text/csv; charset=utf-8", "csv"},
+	formatYAML:      {"application/yaml; charset=utf-8", "yaml"},
+	formatBookmarks: {"text/html; charset=utf-8", "html"},
+}
+
+// parseFormat returns the export format named by v, which may also be
+// "jsonl" or "json" for the default format.
+func parseFormat(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case "jsonl", "json":
+		return formatJSONL, nil
+	case "yml":
+		return formatYAML, nil
+	case "htm", "bookmarks":
+		return formatBookmarks, nil
+	}
+	if _, ok := exportFormats[v]; !ok {
+		return "", fmt.Errorf("unknown format %q; must be jsonl, csv, yaml, or html", v)
+	}
+	return v, nil
+}
+
+// formatOfFile returns the format of a file named name, based on its
+// extension. Unknown extensions are assumed to be JSON Lines.
+func formatOfFile(name string) string {
+	format, err := parseFormat(strings.TrimPrefix(path.Ext(name), "."))
+	if err != nil {
+		return formatJSONL
+	}
+	return format
+}
+
+// A linkColumn is a field of a link in the CSV and YAML formats.
+type linkColumn struct {
+	name string
+	get  func(*Link) string
+	set  func(*Link, string) error
+}
+
+// linkColumns are the fields of links in the CSV and YAML formats, which are
+// those meant to be edited by hand.
+var linkColumns = []linkColumn{
+	{
+		name: "short",
+		get:  func(l *Link) string { return l.Short },
+		set:  func(l *Link, v string) error { l.Short = v; return nil },
+	},
+	{
+		name: "long",
+		get:  func(l *Link) string { return l.Long },
+		set:  func(l *Link, v string) error { l.Long = v; return nil },
+	},
+	{
+		name: "alias_of",
+		get:  func(l *Link) string { return l.AliasOf },
+		set:  func(l *Link, v string) error { l.AliasOf = v; return nil },
+	},
+	{
+		name: "description",
+		get:  func(l *Link) string { return l.Description },
+		set:  func(l *Link, v string) error { l.Description = v; return nil },
+	},
+	{
+		name: "tags",
+		get:  func(l *Link) string { return l.Tags.String() },
+		set: func(l *Link, v string) (err error) {
+			l.Tags, err = parseTags(v)
+			return err
+		},
+	},
+	{
+		name: "owner",
+		get:  func(l *Link) string { return l.Owner },
+		set:  func(l *Link, v string) error { l.Owner = v; return nil },
+	},
+	{
+		name: "visibility",
+		get:  func(l *Link) string { return l.Visibility },
+		set: func(l *Link, v string) error {
+			if !validVisibility(v) {
+				return fmt.Errorf("invalid visibility %q", v)
+			}
+			l.Visibility = v
+			return nil
+		},
+	},
+	{
+		name: "allowed_users",
+		get:  func(l *Link) string { return l.AllowedUsers.String() },
+		set:  func(l *Link, v string) error { l.AllowedUsers = parsePrincipals(v); return nil },
+	},
+	{
+		name: "created",
+		get:  func(l *Link) string { return formatTime(l.Created) },
+		set: func(l *Link, v string) (err error) {
+			l.Created, err = parseFormTime(v)
+			return err
+		},
+	},
+	{
+		name: "last_edit",
+		get:  func(l *Link) string { return formatTime(l.LastEdit) },
+		set: func(l *Link, v string) (err error) {
+			l.LastEdit, err = parseFormTime(v)
+			return err
+		},
+	},
+}
+
+// columnByName returns the link column called name.
+func columnByName(name string) (linkColumn, bool) {
+	for _, c := range linkColumns {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return linkColumn{}, false
+}
+
+// formatTime formats t as RFC 3339, or as an empty string if t is zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeLinks writes links to w in format.
+func writeLinks(w io.Writer, format, host string, links []*Link) error {
+	done := false
+	return streamLinks(w, format, host, func() ([]*Link, error) {
+		if done {
+			return nil, nil
+		}
+		done = true
+		return links, nil
+	})
+}
+
+// streamLinks writes links to w in format, in the batches returned by next
+// until it returns none. Bookmarks of aliases and links with templates point
+// at the go link on host, since their destinations aren't URLs a browser can
+// open.
+//
+// Bookmarks are grouped by tag, so they are written once all links are read.
+// Other formats are written as each batch is read.
+func streamLinks(w io.Writer, format, host string, next func() ([]*Link, error)) error {
+	var (
+		write func([]*Link) error
+		done  func() error
+	)
+	switch format {
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		row := make([]string, len(linkColumns))
+		for i, c := range linkColumns {
+			row[i] = c.name
+		}
+		cw.Write(row)
+		write = func(links []*Link) error {
+			for _, link := range links {
+				for i, c := range linkColumns {
+					row[i] = escapeCSVFormula(c.get(link))
+				}
+				cw.Write(row)
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+	case formatYAML:
+		bw := bufio.NewWriter(w)
+		write = func(links []*Link) error {
+			for _, link := range links {
+				prefix := "- "
+				for _, c := range linkColumns {
+					v := c.get(link)
+					if v == "" && c.name != "short" {
+						continue
+					}
+					fmt.Fprintf(bw, "%s%s: %s\n", prefix, c.name, strconv.Quote(v))
+					prefix = "  "
+				}
+			}
+			return bw.Flush()
+		}
+	case formatBookmarks:
+		var all []*Link
+		write = func(links []*Link) error {
+			all = append(all, links...)
+			return nil
+		}
+		done = func() error {
+			return bookmarksTmpl.Execute(w, newBookmarksData(host, all))
+		}
+	default:
+		encoder := json.NewEncoder(w)
+		write = func(links []*Link) error {
+			for _, link := range links {
+				if err := encoder.Encode(link); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	for {
+		links, err := next()
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			break
+		}
+		if err := write(links); err != nil {
+			return err
+		}
+	}
+	if done != nil {
+		return done()
+	}
+	return nil
+}
+
+// importedLink is a link read for importing, along with the columns it
+// sets. If columns is nil, every field of the link is set.
+type importedLink struct {
+	link    *Link
+	columns []string
+}
+
+// readLinks reads links in format from r.
+func readLinks(r io.Reader, format string) ([]importedLink, error) {
+	switch format {
+	case formatCSV:
+		return readCSV(r)
+	case formatYAML:
+		return readYAML(r)
+	case formatBookmarks:
+		return readBookmarks(r)
+	}
+	var links []importedLink
+	bs := bufio.NewScanner(r)
+	bs.Buffer(nil, 1<<20)
+	for bs.Scan() {
+		link := new(Link)
+		if err := json.Unmarshal(bs.Bytes(), link); err != nil {
+			return links, err
+		}
+		if link.Short != "" {
+			links = append(links, importedLink{link: link})
+		}
+	}
+	return links, bs.Err()
+}
+
+// newImportedLink returns a link with the given values of columns.
+func newImportedLink(columns, values []string) (importedLink, error) {
+	l := importedLink{link: new(Link)}
+	for i, name := range columns {
+		c, ok := columnByName(name)
+		if !ok {
+			return l, fmt.Errorf("unknown field %q", name)
+		}
+		if err := c.set(l.link, strings.TrimSpace(values[i])); err != nil {
+			return l, err
+		}
+		l.columns = append(l.columns, name)
+	}
+	if l.link.Short == "" {
+		return l, errors.New("short required")
+	}
+	return l, nil
+}
+
+// readCSV reads links from a CSV file whose first row names the columns.
+func readCSV(r io.Reader) ([]importedLink, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 0
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	var links []importedLink
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return links, nil
+		}
+		if err != nil {
+			return links, err
+		}
+		line, _ := cr.FieldPos(0)
+		for i, v := range row {
+			row[i] = unescapeCSVFormula(v)
+		}
+		l, err := newImportedLink(header, row)
+		if err != nil {
+			return links, fmt.Errorf("line %d: %w", line, err)
+		}
+		links = append(links, l)
+	}
+}
+
+// csvFormulaChars are the characters that make spreadsheets evaluate a cell
+// as a formula when it starts with one of them.
+const csvFormulaChars = "=+-@\t\r"
+
+// isCSVFormula reports whether a spreadsheet would evaluate v as a formula
+// once any leading single quotes are removed.
+func isCSVFormula(v string) bool {
+	v = strings.TrimLeft(v, "'")
+	return v != "" && strings.ContainsRune(csvFormulaChars, rune(v[0]))
+}
+
+// escapeCSVFormula prefixes v with a single quote if a spreadsheet would
+// otherwise evaluate it as a formula, so that exported links can't run
+// formulas when opened. Values that already start with quotes get one more,
+// so that unescapeCSVFormula restores them exactly.
+func escapeCSVFormula(v string) string {
+	if isCSVFormula(v) {
+		return "'" + v
+	}
+	return v
+}
+
+// unescapeCSVFormula reverses escapeCSVFormula.
+func unescapeCSVFormula(v string) string {
+	if strings.HasPrefix(v, "'") && isCSVFormula(v) {
+		return v[1:]
+	}
+	return v
+}
+
+// readYAML reads links from a YAML list of mappings from column names to
+// values, as written by writeLinks. Values may be plain, single-quoted, or
+// double-quoted scalars, and tags and allowed users may also be flow
+// sequences such as "[docs, eng]". No other YAML is supported.
+func readYAML(r io.Reader) ([]importedLink, error) {
+	var links []importedLink
+	var columns, values []string
+	var start int // line of the current item
+	flush := func() error {
+		if columns == nil {
+			return nil
+		}
+		l, err := newImportedLink(columns, values)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", start, err)
+		}
+		links = append(links, l)
+		columns, values = nil, nil
+		return nil
+	}
+
+	bs := bufio.NewScanner(r)
+	for n := 1; bs.Scan(); n++ {
+		line := strings.TrimRight(bs.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "-"); ok {
+			if err := flush(); err != nil {
+				return links, err
+			}
+			start = n
+			columns = []string{}
+			if line = strings.TrimSpace(rest); line == "" {
+				continue
+			}
+		} else if columns == nil || line == trimmed {
+			return links, fmt.Errorf("line %d: expected a list of links", n)
+		}
+		key, v, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			return links, fmt.Errorf("line %d: expected \"field: value\"", n)
+		}
+		v, err := yamlScalar(strings.TrimSpace(v))
+		if err != nil {
+			return links, fmt.Errorf("line %d: %w", n, err)
+		}
+		columns = append(columns, strings.TrimSpace(key))
+		values = append(values, v)
+	}
+	if err := bs.Err(); err != nil {
+		return links, err
+	}
+	return links, flush()
+}
+
+// yamlScalar returns the value of the YAML scalar v.
+func yamlScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted value %s", v)
+		}
+		return s, nil
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("invalid single-quoted value %s", v)
+		}
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+	case strings.HasPrefix(v, "["):
+		if !strings.HasSuffix(v, "]") {
+			return "", fmt.Errorf("invalid sequence %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// bookmarksData is the data used by the bookmarksTmpl template.
+type bookmarksData struct {
+	// Folders has a folder for each tag, with the links that have it.
+	Folders []bookmarkFolder
+
+	// Links are the links without tags.
+	Links []bookmark
+}
+
+type bookmarkFolder struct {
+	Name  string
+	Links []bookmark
+}
+
+type bookmark struct {
+	Href         string
+	Title        string
+	Description  string
+	AddDate      int64
+	LastModified int64
+}
+
+// newBookmarksData returns the bookmarks of links, whose templates and
+// aliases point at host.
+func newBookmarksData(host string, links []*Link) bookmarksData {
+	var data bookmarksData
+	folders := make(map[string]int)
+	for _, link := range links {
+		b := bookmark{
+			Href:        link.Long,
+			Title:       link.Short,
+			Description: link.Description,
+		}
+		if link.AliasOf != "" || strings.Contains(link.Long, "{{") {
+			b.Href = "http://" + host + "/" + link.Short
+		}
+		if !link.Created.IsZero() {
+			b.AddDate = link.Created.Unix()
+		}
+		if !link.LastEdit.IsZero() {
+			b.LastModified = link.LastEdit.Unix()
+		}
+		if len(link.Tags) == 0 {
+			data.Links = append(data.Links, b)
+		}
+		for _, tag := range link.Tags {
+			i, ok := folders[tag]
+			if !ok {
+				i = len(data.Folders)
+				folders[tag] = i
+				data.Folders = append(data.Folders, bookmarkFolder{Name: tag})
+			}
+			data.Folders[i].Links = append(data.Folders[i].Links, b)
+		}
+	}
+	sort.Slice(data.Folders, func(i, j int) bool {
+		return data.Folders[i].Name < data.Folders[j].Name
+	})
+	return data
+}
+
+// reNotNameChars matches characters that can't be part of short names and
+// tags.
+var reNotNameChars = regexp.MustCompile(`[^\w\-\.]+`)
+
+// nameFromTitle returns a short name or tag made from the bookmark or
+// folder title s, such as "team-wiki" for "Team Wiki".
+func nameFromTitle(s string) string {
+	s = reNotNameChars.ReplaceAllString(strings.ToLower(strings.TrimSpace(s)), "-")
+	return strings.Trim(s, "-.")
+}
+
+// readBookmarks reads links from a Netscape bookmark file, as exported by
+// browsers. Bookmarks are named by their titles, or short names made from
+// them, and tagged with the folders they are in, other than the browser's
+// toolbar folder. Bookmarks with the same name are merged, with the tags of
+// each.
+func readBookmarks(r io.Reader) ([]importedLink, error) {
+	var links []importedLink
+	byShort := make(map[string]*Link)
+	columns := []string{"short", "long", "description", "tags", "created", "last_edit"}
+
+	var (
+		folders []string // the folder of each open list, or "" if none
+		folder  string   // the folder whose list is next
+		last    *Link    // the last bookmark, which a description follows
+
+		capture string // the element whose text is being read, if any
+		text    strings.Builder
+		attrs   []html.Attribute // of the element being read
+	)
+	addBookmark := func() {
+		link := new(Link)
+		title := strings.TrimSpace(text.String())
+		if link.Short = title; !validShortName(title) {
+			link.Short = nameFromTitle(title)
+		}
+		for _, a := range attrs {
+			switch a.Key {
+			case "href":
+				link.Long = a.Val
+			case "add_date":
+				link.Created = unixTime(a.Val)
+			case "last_modified":
+				link.LastEdit = unixTime(a.Val)
+			}
+		}
+		last = nil
+		// skip bookmarks that can't be links, such as bookmarklets, rather
+		// than failing the whole import
+		if link.Short == "" || link.Long == "" || validateLink(link.Short, link.Long) != nil {
+			return
+		}
+		if prev, ok := byShort[link.Short]; ok {
+			link = prev
+		} else {
+			byShort[link.Short] = link
+			links = append(links, importedLink{link: link, columns: columns})
+		}
+		for _, f := range folders {
+			if f != "" && !link.Tags.Has(f) {
+				link.Tags = append(link.Tags, f)
+			}
+		}
+		sort.Strings(link.Tags)
+		last = link
+	}
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return links, z.Err()
+			}
+			tt = html.EndTagToken // ends a description at the end of the file
+		}
+		if tt == html.TextToken {
+			if capture != "" {
+				text.Write(z.Text())
+			}
+			continue
+		}
+		if capture == "dd" && (tt == html.StartTagToken || tt == html.EndTagToken) {
+			// descriptions end at the next tag
+			if last != nil && last.Description == "" {
+				last.Description = strings.TrimSpace(text.String())
+			}
+			capture = ""
+		}
+		if z.Err() == io.EOF {
+			return links, nil
+		}
+
+		tok := z.Token()
+		switch {
+		case tt == html.StartTagToken && (tok.Data == "h3" || tok.Data == "a" || tok.Data == "dd"):
+			capture, attrs = tok.Data, tok.Attr
+			text.Reset()
+		case tt == html.EndTagToken && tok.Data == "h3" && capture == "h3":
+			folder = nameFromTitle(text.String())
+			for _, a := range attrs {
+				if a.Key == "personal_toolbar_folder" && a.Val == "true" {
+					folder = ""
+				}
+			}
+			capture = ""
+		case tt == html.EndTagToken && tok.Data == "a" && capture == "a":
+			addBookmark()
+			capture = ""
+		case tt == html.StartTagToken && tok.Data == "dl":
+			folders = append(folders, folder)
+			folder = ""
+		case tt == html.EndTagToken && tok.Data == "dl" && len(folders) > 0:
+			folders = folders[:len(folders)-1]
+		}
+	}
+}
+
+// unixTime returns the time of the Unix timestamp in seconds v, or the zero
+// time if v isn't one.
+func unixTime(v string) time.Time {
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
@@ -0,0 +1,332 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestExportFormatsRoundTrip(t *testing.T) {
+	created := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	links := []*Link{
+		{Short: "docs", Long: "http://docs/", Description: `the "docs", with commas`, Tags: Tags{"eng", "team"}, Owner: "foo@example.com", Created: created, LastEdit: created},
+		{Short: "who", Long: "http://people/{{with .Path}}{{.}}{{end}}", Owner: "foo@example.com", Created: created, LastEdit: created},
+		{Short: "plans", Long: "http://plans/", Visibility: visibilityRestricted, AllowedUsers: Principals{"bar@example.com", "group:eng"}, Created: created, LastEdit: created},
+	}
+
+	for _, format := range []string{formatJSONL, formatCSV, formatYAML} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeLinks(&buf, format, "go", links); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readLinks(&buf, format)
+			if err != nil {
+				t.Fatalf("readLinks(%s):\n%s", err, buf.Bytes())
+			}
+			if len(got) != len(links) {
+				t.Fatalf("read %d links; want %d", len(got), len(links))
+			}
+			for i, l := range got {
+				if diff := cmp.Diff(links[i], l.link); diff != "" {
+					t.Errorf("link %d mismatch (-want +got):\n%s", i, diff)
+				}
+			}
+		})
+	}
+
+	t.Run("bookmarks", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeLinks(&buf, formatBookmarks, "go", links); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readLinks(&buf, formatBookmarks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []*Link{
+			{Short: "docs", Long: "http://docs/", Description: `the "docs", with commas`, Tags: Tags{"eng", "team"}, Created: created, LastEdit: created},
+			{Short: "who", Long: "http://go/who", Created: created, LastEdit: created},
+			{Short: "plans", Long: "http://plans/", Created: created, LastEdit: created},
+		}
+		var gotLinks []*Link
+		for _, l := range got {
+			gotLinks = append(gotLinks, l.link)
+		}
+		if diff := cmp.Diff(want, gotLinks); diff != "" {
+			t.Errorf("bookmarks mismatch (-want +got):\n%s\n%s", diff, buf.Bytes())
+		}
+	})
+}
+
+func TestCSVFormulaEscaping(t *testing.T) {
+	links := []*Link{
+		{Short: "sum", Long: "http://sheets/", Description: "=SUM(A1:A2)", Owner: "@team"},
+		{Short: "quoted", Long: "http://sheets/", Description: "'=already quoted"},
+		{Short: "minus", Long: "http://sheets/", Description: "-1", Tags: Tags{"plain"}},
+	}
+	var buf bytes.Buffer
+	if err := writeLinks(&buf, formatCSV, "go", links); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"'=SUM(A1:A2)", "'@team", "''=already quoted", "'-1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("CSV export does not contain %q:\n%s", want, buf.Bytes())
+		}
+	}
+
+	got, err := readLinks(&buf, formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range got {
+		if diff := cmp.Diff(links[i], l.link); diff != "" {
+			t.Errorf("link %d mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestReadBookmarks(t *testing.T) {
+	// as exported by Chrome
+	const bookmarks = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1680000000" PERSONAL_TOOLBAR_FOLDER="true">Bookmarks bar</H3>
+    <DL><p>
+        <DT><A HREF="https://wiki.example.com/" ADD_DATE="1680000000">Team Wiki</A>
+        <DD>Where everything is written down
+        <DT><H3>Oncall Tools</H3>
+        <DL><p>
+            <DT><A HREF="https://pager.example.com/">pager</A>
+            <DT><A HREF="https://wiki.example.com/">Team Wiki</A>
+        </DL><p>
+    </DL><p>
+    <DT><A HREF="https://news.example.com/">news</A>
+    <DT><A HREF="">empty</A>
+</DL><p>
+`
+	got, err := readBookmarks(strings.NewReader(bookmarks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Link{
+		{Short: "team-wiki", Long: "https://wiki.example.com/", Description: "Where everything is written down", Tags: Tags{"oncall-tools"}, Created: time.Unix(1680000000, 0).UTC()},
+		{Short: "pager", Long: "https://pager.example.com/", Tags: Tags{"oncall-tools"}},
+		{Short: "news", Long: "https://news.example.com/"},
+	}
+	var gotLinks []*Link
+	for _, l := range got {
+		gotLinks = append(gotLinks, l.link)
+	}
+	if diff := cmp.Diff(want, gotLinks); diff != "" {
+		t.Errorf("readBookmarks() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadYAML(t *testing.T) {
+	const yaml = `# links for the team
+---
+- short: docs
+  long: 'http://docs/it''s'
+  tags: [eng, team]
+-
+  short: "wiki"
+  long: http://wiki/ # the wiki
+  description: "line\none"
+`
+	got, err := readYAML(strings.NewReader(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []importedLink{
+		{link: &Link{Short: "docs", Long: "http://docs/it's", Tags: Tags{"eng", "team"}}, columns: []string{"short", "long", "tags"}},
+		{link: &Link{Short: "wiki", Long: "http://wiki/", Description: "line\none"}, columns: []string{"short", "long", "description"}},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(importedLink{})); diff != "" {
+		t.Errorf("readYAML() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, bad := range []string{
+		"short: docs\n",
+		"- short: docs\n  owner\n",
+		"- short: docs\n  color: blue\n",
+		"- long: http://docs/\n",
+		"- short: \"docs\n",
+	} {
+		if _, err := readYAML(strings.NewReader(bad)); err == nil {
+			t.Errorf("readYAML(%q) = nil; want error", bad)
+		}
+	}
+}
+
+func TestImportLinksUpdate(t *testing.T) {
+	created := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	links := map[string]*Link{
+		"docs": {Short: "docs", Long: "http://docs/", Owner: "foo@example.com", Tags: Tags{"eng"}, Created: created, LastEdit: created},
+		"wiki": {Short: "wiki", Long: "http://wiki/", Owner: "foo@example.com", Created: created, LastEdit: created},
+	}
+	fakeLinks(t, links)
+
+	const sheet = `short,description,tags
+docs,The docs,"eng, team"
+wiki,,
+new,,
+`
+	if _, err := importLinks(defaultTenant(), strings.NewReader(sheet), formatCSV, false, systemActor); err == nil {
+		t.Error("importing a new link without long succeeded; want error")
+	}
+
+	const sheet2 = `Short,Long,Description,Tags
+docs,http://docs/,The docs,"eng, team"
+wiki,http://wiki/,,
+new,http://new/,A new link,
+`
+	n, err := importLinks(defaultTenant(), strings.NewReader(sheet2), formatCSV, false, systemActor)
+	if err != nil || n != 1 {
+		t.Fatalf("importLinks() = %d, %v; want 1 new link", n, err)
+	}
+	if got := links["docs"]; got.Description != "" {
+		t.Errorf("existing link changed without update: %+v", got)
+	}
+	if got := links["new"]; got == nil || got.Description != "A new link" || got.Created.IsZero() {
+		t.Errorf("imported link = %+v", got)
+	}
+
+	n, err = importLinks(defaultTenant(), strings.NewReader(sheet2), formatCSV, true, systemActor)
+	if err != nil || n != 1 {
+		t.Fatalf("importLinks(update) = %d, %v; want 1 changed link", n, err)
+	}
+	got := links["docs"]
+	if got.Description != "The docs" || !got.Tags.Has("team") || got.Owner != "foo@example.com" || !got.Created.Equal(created) || got.LastEdit.Equal(created) {
+		t.Errorf("updated link = %+v", got)
+	}
+	if got := links["wiki"]; !got.LastEdit.Equal(created) {
+		t.Errorf("unchanged link was saved: %+v", got)
+	}
+}
+
+func TestImportLinksValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+	}{
+		{"jsonl bad name", formatJSONL, `{"Short":"bad name","Long":"http://docs/"}`},
+		{"jsonl script", formatJSONL, `{"Short":"docs","Long":"javascript:alert(1)"}`},
+		{"jsonl template", formatJSONL, `{"Short":"docs","Long":"http://docs/{{"}`},
+		{"jsonl segments", formatJSONL, `{"Short":"a/b/c/d/e","Long":"http://docs/"}`},
+		{"csv script", formatCSV, "short,long\ndocs,\" JavaScript:alert(1)\"\n"},
+		{"csv other user", formatCSV, "short,long,owner\n~bar@example.com/docs,http://docs/,foo@example.com\n"},
+		{"csv personal without owner", formatCSV, "short,long\n~foo@example.com/docs,http://docs/\n"},
+		{"yaml bad name", formatYAML, "- short: bad name\n  long: http://docs/\n"},
+		{"yaml data", formatYAML, "- short: docs\n  long: data:text/html,hi\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links := map[string]*Link{}
+			fakeLinks(t, links)
+			if n, err := importLinks(defaultTenant(), strings.NewReader(tt.input), tt.format, true, systemActor); err == nil {
+				t.Errorf("importLinks() = %d, nil; want error", n)
+			}
+			if len(links) != 0 {
+				t.Errorf("saved %d links; want none", len(links))
+			}
+		})
+	}
+
+	t.Run("personal", func(t *testing.T) {
+		links := map[string]*Link{}
+		fakeLinks(t, links)
+		const sheet = "short,long,owner\n~foo@example.com/docs,http://docs/,foo@example.com\n"
+		if n, err := importLinks(defaultTenant(), strings.NewReader(sheet), formatCSV, false, systemActor); err != nil || n != 1 {
+			t.Errorf("importLinks() = %d, %v; want 1 link", n, err)
+		}
+	})
+
+	t.Run("bookmarklets", func(t *testing.T) {
+		links := map[string]*Link{}
+		fakeLinks(t, links)
+		const bookmarks = `<DL><p>
+    <DT><A HREF="javascript:alert(1)">alert</A>
+    <DT><A HREF="https://news.example.com/">news</A>
+</DL><p>
+`
+		if n, err := importLinks(defaultTenant(), strings.NewReader(bookmarks), formatBookmarks, false, systemActor); err != nil || n != 1 {
+			t.Errorf("importLinks() = %d, %v; want 1 link", n, err)
+		}
+		if links["alert"] != nil {
+			t.Errorf("imported bookmarklet: %+v", links["alert"])
+		}
+	})
+}
+
+func TestServeExportFormats(t *testing.T) {
+	fakeLinks(t, map[string]*Link{
+		"docs": {Short: "docs", Long: "http://docs/", Tags: Tags{"eng"}},
+	})
+
+	tests := []struct {
+		format      string
+		wantStatus  int
+		contentType string
+		wantBody    string
+	}{
+		{format: "", wantStatus: http.StatusOK, wantBody: `"Short":"docs"`},
+		{format: "csv", wantStatus: http.StatusOK, contentType: "text/csv; charset=utf-8", wantBody: "docs,http://docs/,,,eng,"},
+		{format: "yaml", wantStatus: http.StatusOK, contentType: "application/yaml; charset=utf-8", wantBody: `- short: "docs"`},
+		{format: "html", wantStatus: http.StatusOK, contentType: "text/html; charset=utf-8", wantBody: `<DT><H3>eng</H3>`},
+		{format: "xml", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serveExport(w, httptest.NewRequest("GET", "/.export?format="+tt.format, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("serveExport() = %d; want %d", w.Code, tt.wantStatus)
+			}
+			if tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type = %q; want %q", w.Header().Get("Content-Type"), tt.contentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q; want to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServeImportUpload(t *testing.T) {
+	links := map[string]*Link{}
+	fakeLinks(t, links)
+	setAPITokens(t, nil, "foo@example.com")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("xsrf", xsrftoken.Generate(xsrfKey, "foo@example.com", importXSRFAction))
+	fw, _ := mw.CreateFormFile("file", "links.csv")
+	fw.Write([]byte("short,long\ndocs,http://docs/\n"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/.import", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	serveImport(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/.all?imported=1" {
+		t.Errorf("serveImport() = %d, %q; want redirect to /.all?imported=1: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if got := links["docs"]; got == nil || got.Long != "http://docs/" {
+		t.Errorf("imported link = %+v", got)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fallback = flag.String("fallback", "", "comma-separated chain of fallbacks for unknown links: golink URLs that are checked for the link in order, or destination templates that are always used")
+
+// fallbackHeader is set on redirects to a fallback, naming the fallback used.
+// It is also set on requests checking whether another golink has a link,
+// naming this golink, so that golinks that fall back to each other don't
+// loop.
+const fallbackHeader = "X-Golink-Fallback"
+
+// fallbackClient is used to check whether a fallback golink has a link. It
+// doesn't follow redirects, since a redirect means that the link exists.
+// Checks are HEAD requests, which golinks don't count as clicks.
+var fallbackClient = &http.Client{
+	Timeout: 2 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// fallbackChain returns the fallbacks set by the -fallback flag, in order.
+func fallbackChain() []string {
+	var chain []string
+	for _, f := range strings.Split(*fallback, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			chain = append(chain, f)
+		}
+	}
+	return chain
+}
+
+// isFallbackTemplate reports whether fallback f is a destination template,
+// rather than the URL of another golink.
+func isFallbackTemplate(f string) bool {
+	return strings.Contains(f, "{{")
+}
+
+// fallbackTarget returns the destination for the unknown link path from the
+// first fallback in the chain that can resolve it, along with that fallback.
+// Templates are expanded with the whole path as .Path and always resolve.
+// Other golinks resolve if they don't respond to path with a 404.
+//
+// It returns empty strings if no fallback resolves path. Checks are sent from
+// the golink at hostname from.
+func fallbackTarget(ctx context.Context, from, path string, env expandEnv) (target, used string) {
+	for _, f := range fallbackChain() {
+		if isFallbackTemplate(f) {
+			env.Path = path
+			target, err := expandLink(f, env)
+			if err != nil {
+				log.Printf("expanding fallback %q: %v", f, err)
+				continue
+			}
+			return target, f
+		}
+
+		target := strings.TrimSuffix(f, "/") + "/" + path
+		ok, err := fallbackHasLink(ctx, target, from)
+		if err != nil {
+			log.Printf("checking fallback %q: %v", f, err)
+			continue
+		}
+		if ok {
+			if len(env.Query.Values) > 0 {
+				target += "?" + env.Query.Encode()
+			}
+			return target, f
+		}
+	}
+	return "", ""
+}
+
+// fallbackMissTTL is how long a fallback golink is remembered not to have a
+// link, or to be unreachable, before it is checked again.
+const fallbackMissTTL = time.Minute
+
+// maxFallbackMisses is the number of fallback misses remembered.
+const maxFallbackMisses = 1024
+
+// fallbackMisses holds the targets that fallback golinks recently had no
+// link for, or failed to respond to, and when each was checked. This keeps
+// unknown links from waiting on the same check for every request.
+var fallbackMisses struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+// fallbackHasLink reports whether the golink at target has a link for it.
+// The check is sent from the golink at hostname from.
+func fallbackHasLink(ctx context.Context, target, from string) (bool, error) {
+	now := time.Now()
+	fallbackMisses.mu.Lock()
+	checked, missed := fallbackMisses.m[target]
+	fallbackMisses.mu.Unlock()
+	if missed && now.Sub(checked) < fallbackMissTTL {
+		return false, nil
+	}
+
+	ok, err := checkFallback(ctx, target, from)
+	if ok {
+		return true, nil
+	}
+	fallbackMisses.mu.Lock()
+	if fallbackMisses.m == nil || len(fallbackMisses.m) >= maxFallbackMisses {
+		fallbackMisses.m = make(map[string]time.Time)
+	}
+	fallbackMisses.m[target] = now
+	fallbackMisses.mu.Unlock()
+	return false, err
+}
+
+// checkFallback sends a HEAD request for target, reporting whether the
+// golink responded with anything other than a 404.
+func checkFallback(ctx context.Context, target, from string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", target, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(fallbackHeader, from)
+	resp, err := fallbackClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+// serveFallback redirects a request for the unknown link path to the first
+// fallback that resolves it. It reports whether the request was served.
+//
+// Requests that are themselves checks from another golink are never
+// forwarded.
+func serveFallback(w http.ResponseWriter, r *http.Request, path string, query url.Values) bool {
+	if r.Header.Get(fallbackHeader) != "" || *fallback == "" {
+		return false
+	}
+	login, _ := currentUser(r)
+	env := expandEnv{Now: time.Now().UTC(), Query: newTemplateQuery(query), user: login}
+	target, f := fallbackTarget(r.Context(), tenantFor(r).Hostname, path, env)
+	if target == "" {
+		return false
+	}
+	w.Header().Set(fallbackHeader, f)
+	http.Redirect(w, r, target, http.StatusFound)
+	return true
+}
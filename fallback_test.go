@@ -0,0 +1,188 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestServeFallback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).Return(nil, fs.ErrNotExist).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return(nil, nil).AnyTimes()
+	db.(*MockDatabase).EXPECT().Search(gomock.Any()).Return(nil, nil).AnyTimes()
+
+	// parent is a golink that only has go/parent-link
+	var parentChecks int
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentChecks++
+		if r.Method != "HEAD" {
+			t.Errorf("fallback check for %q used %s; want HEAD", r.URL, r.Method)
+		}
+		if r.Header.Get(fallbackHeader) == "" {
+			t.Errorf("fallback check for %q missing %s header", r.URL, fallbackHeader)
+		}
+		if r.URL.Path == "/parent-link/foo" {
+			http.Redirect(w, r, "http://example.com/", http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer parent.Close()
+
+	const search = "https://search.example/?q={{QueryEscape .Path}}"
+	tests := []struct {
+		name         string
+		fallback     string
+		link         string
+		header       string
+		wantStatus   int
+		wantLink     string
+		wantFallback string
+		wantChecks   int
+	}{
+		{
+			name:       "no fallback",
+			link:       "/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:         "parent golink has link",
+			fallback:     parent.URL + "/, " + search,
+			link:         "/parent-link/foo?a=b",
+			wantStatus:   http.StatusFound,
+			wantLink:     parent.URL + "/parent-link/foo?a=b",
+			wantFallback: parent.URL + "/",
+			wantChecks:   1,
+		},
+		{
+			name:         "parent golink missing link falls back to search",
+			fallback:     parent.URL + "/, " + search,
+			link:         "/unknown/foo",
+			wantStatus:   http.StatusFound,
+			wantLink:     "https://search.example/?q=unknown%2Ffoo",
+			wantFallback: search,
+			wantChecks:   1,
+		},
+		{
+			name:       "parent golink missing link",
+			fallback:   parent.URL,
+			link:       "/unknown",
+			wantStatus: http.StatusNotFound,
+			wantChecks: 1,
+		},
+		{
+			name:         "unreachable golink is skipped",
+			fallback:     "http://127.0.0.1:1/," + search,
+			link:         "/unknown",
+			wantStatus:   http.StatusFound,
+			wantLink:     "https://search.example/?q=unknown",
+			wantFallback: search,
+		},
+		{
+			name:       "checks from other golinks are not forwarded",
+			fallback:   search,
+			link:       "/unknown",
+			header:     "go.other",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldFallback := *fallback
+			*fallback = tt.fallback
+			t.Cleanup(func() {
+				*fallback = oldFallback
+				fallbackMisses.m = nil
+			})
+			parentChecks = 0
+
+			r := httptest.NewRequest("GET", tt.link, nil)
+			if tt.header != "" {
+				r.Header.Set(fallbackHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			serveGo(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("serveGo(%q) = %d; want %d", tt.link, w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLink {
+				t.Errorf("serveGo(%q) = %q; want %q", tt.link, got, tt.wantLink)
+			}
+			if got := w.Header().Get(fallbackHeader); got != tt.wantFallback {
+				t.Errorf("serveGo(%q) %s = %q; want %q", tt.link, fallbackHeader, got, tt.wantFallback)
+			}
+			if parentChecks != tt.wantChecks {
+				t.Errorf("serveGo(%q) checked parent %d times; want %d", tt.link, parentChecks, tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestFallbackMissCached(t *testing.T) {
+	var checks int
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks++
+		http.NotFound(w, r)
+	}))
+	defer parent.Close()
+	t.Cleanup(func() { fallbackMisses.m = nil })
+
+	for i := 0; i < 2; i++ {
+		ok, err := fallbackHasLink(context.Background(), parent.URL+"/unknown", "go")
+		if ok || err != nil {
+			t.Errorf("fallbackHasLink() = %v, %v; want false, nil", ok, err)
+		}
+	}
+	if checks != 1 {
+		t.Errorf("fallbackHasLink() checked parent %d times; want 1", checks)
+	}
+
+	fallbackMisses.m[parent.URL+"/unknown"] = time.Now().Add(-fallbackMissTTL)
+	fallbackHasLink(context.Background(), parent.URL+"/unknown", "go")
+	if checks != 2 {
+		t.Errorf("fallbackHasLink() checked parent %d times after the miss expired; want 2", checks)
+	}
+}
+
+func TestFallbackCheckNotCounted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().Load("who").Return(&Link{Short: "who", Long: "http://who/"}, nil).AnyTimes()
+
+	stats.mu.Lock()
+	oldClicks, oldDirty := stats.clicks, stats.dirty
+	stats.clicks, stats.dirty = nil, nil
+	stats.mu.Unlock()
+	t.Cleanup(func() {
+		stats.mu.Lock()
+		stats.clicks, stats.dirty = oldClicks, oldDirty
+		stats.mu.Unlock()
+	})
+
+	r := httptest.NewRequest("HEAD", "/who", nil)
+	r.Header.Set(fallbackHeader, "go.other")
+	w := httptest.NewRecorder()
+	serveGo(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Errorf("serveGo(HEAD /who) = %d; want %d", w.Code, http.StatusFound)
+	}
+	if n := stats.clicks["who"]; n != 0 {
+		t.Errorf("serveGo(HEAD /who) counted %d clicks; want 0", n)
+	}
+}
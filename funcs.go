@@ -0,0 +1,323 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Link templates are run for every request to a link, so they are limited in
+// size and in how long they may take. The functions available to templates
+// only transform their arguments and can't reach the filesystem or network.
+const (
+	maxTemplateSize = 4 << 10  // maximum size of a link template, in bytes
+	maxExpandedSize = 16 << 10 // maximum size of an expanded link, in bytes
+	maxExpandTime   = 100 * time.Millisecond
+
+	// maxSplitParts is the maximum number of parts returned by Split, which
+	// bounds the work done by templates that range over the result.
+	maxSplitParts = 64
+
+	// maxRegexpSize is the maximum size of a regular expression passed to
+	// RegexReplace or RegexMatch.
+	maxRegexpSize = 256
+)
+
+var (
+	errTemplateTooLarge = fmt.Errorf("link template is longer than %d bytes", maxTemplateSize)
+	errExpandedTooLarge = fmt.Errorf("expanded link is longer than %d bytes", maxExpandedSize)
+	errExpandTimeout    = fmt.Errorf("link template took longer than %v to run", maxExpandTime)
+
+	errNestedRange    = errors.New("link templates can't nest range actions")
+	errRangeSource    = errors.New("link templates can only range over Split, .Query, or .Match")
+	errTemplateAction = errors.New("link templates can't call other templates")
+)
+
+var expandFuncMap = texttemplate.FuncMap{
+	"PathEscape":  url.PathEscape,
+	"QueryEscape": url.QueryEscape,
+	"TrimSuffix":  strings.TrimSuffix,
+
+	"TrimPrefix": strings.TrimPrefix,
+	"ToLower":    strings.ToLower,
+	"ToUpper":    strings.ToUpper,
+	"Split":      split,
+	"Join":       strings.Join,
+	"Default":    defaultValue,
+
+	"RegexMatch":   regexMatch,
+	"RegexReplace": regexReplace,
+	"JiraKey":      jiraKey,
+
+	"Base64Encode": base64Encode,
+	"Base64Decode": base64Decode,
+
+	"Duration":  time.ParseDuration,
+	"ParseTime": time.Parse,
+}
+
+// split slices s into the substrings separated by sep. The final substring
+// holds the unsplit remainder if s has more than maxSplitParts parts.
+func split(s, sep string) []string {
+	return strings.SplitN(s, sep, maxSplitParts)
+}
+
+// defaultValue returns v, or def if v is empty. The default comes first so
+// that the function can be used at the end of a pipeline, as in
+// {{.Path | Default "main"}}.
+func defaultValue(def, v string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// maxCachedRegexps is the number of compiled regular expressions kept
+// between requests.
+const maxCachedRegexps = 256
+
+// regexpCache holds compiled regular expressions used by link templates,
+// keyed by pattern.
+var regexpCache struct {
+	mu sync.Mutex
+	m  map[string]*regexp.Regexp
+}
+
+// compileRegexp returns the compiled regular expression for pattern.
+// Go regular expressions run in time linear in their input, so only the
+// size of the pattern needs to be limited.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.mu.Lock()
+	defer regexpCache.mu.Unlock()
+	if re, ok := regexpCache.m[pattern]; ok {
+		return re, nil
+	}
+	if len(pattern) > maxRegexpSize {
+		return nil, fmt.Errorf("regular expression is longer than %d bytes", maxRegexpSize)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if regexpCache.m == nil || len(regexpCache.m) >= maxCachedRegexps {
+		regexpCache.m = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.m[pattern] = re
+	return re, nil
+}
+
+// regexMatch reports whether s contains a match of pattern.
+func regexMatch(pattern, s string) (bool, error) {
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+// regexReplace replaces matches of pattern in s with repl, which may refer to
+// submatches as in regexp.Regexp.ReplaceAllString.
+func regexReplace(s, pattern, repl string) (string, error) {
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+var reJiraKey = regexp.MustCompile(`(?i)\b([a-z][a-z0-9_]+)-([0-9]+)\b`)
+
+// jiraKey returns the first JIRA-style issue key in s, such as "PROJ-123",
+// in upper case. It returns the empty string if s contains no key.
+func jiraKey(s string) string {
+	return strings.ToUpper(reJiraKey.FindString(s))
+}
+
+func base64Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func base64Decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// parseLinkTemplate parses long as a link template.
+func parseLinkTemplate(long string) (*texttemplate.Template, error) {
+	if len(long) > maxTemplateSize {
+		return nil, errTemplateTooLarge
+	}
+	tmpl, err := texttemplate.New("").Funcs(expandFuncMap).Parse(long)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.Tree != nil {
+		c := &templateChecker{ranged: make(map[string]bool)}
+		if err := c.walk(tmpl.Tree.Root, false); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// templateChecker checks that a parsed link template runs in bounded time.
+// Timed out templates can't be stopped, so rather than relying on
+// maxExpandTime alone, templates may only range once at a time and only over
+// values of bounded size: the parts returned by Split, or the query and
+// pattern captures of the request. Ranging over an integer, or calling
+// templates that could recurse, is rejected.
+type templateChecker struct {
+	// ranged records whether each variable declared so far holds a value
+	// that may be ranged over.
+	ranged map[string]bool
+}
+
+func (c *templateChecker) walk(node parse.Node, inRange bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, n := range n.Nodes {
+			if err := c.walk(n, inRange); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		c.declare(n.Pipe, c.rangeable(n.Pipe))
+	case *parse.IfNode:
+		return c.walkBranch(&n.BranchNode, inRange, false)
+	case *parse.WithNode:
+		return c.walkBranch(&n.BranchNode, inRange, false)
+	case *parse.RangeNode:
+		if inRange {
+			return errNestedRange
+		}
+		if !c.rangeable(n.Pipe) {
+			return errRangeSource
+		}
+		return c.walkBranch(&n.BranchNode, inRange, true)
+	case *parse.TemplateNode:
+		return errTemplateAction
+	}
+	return nil
+}
+
+func (c *templateChecker) walkBranch(n *parse.BranchNode, inRange, isRange bool) error {
+	// Variables declared by range hold the index and element, which are
+	// not themselves safe to range over.
+	c.declare(n.Pipe, !isRange && c.rangeable(n.Pipe))
+	if err := c.walk(n.List, inRange || isRange); err != nil {
+		return err
+	}
+	return c.walk(n.ElseList, inRange)
+}
+
+// declare records whether the variables declared or assigned by pipe may be
+// ranged over.
+func (c *templateChecker) declare(pipe *parse.PipeNode, ok bool) {
+	if pipe == nil {
+		return
+	}
+	for _, v := range pipe.Decl {
+		c.ranged[v.Ident[0]] = ok
+	}
+}
+
+// rangeable reports whether the value of pipe is known to be of bounded size.
+func (c *templateChecker) rangeable(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Cmds) == 0 {
+		return false
+	}
+	cmd := pipe.Cmds[len(pipe.Cmds)-1]
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	switch n := cmd.Args[0].(type) {
+	case *parse.IdentifierNode:
+		return n.Ident == "Split"
+	case *parse.FieldNode:
+		return isRequestField(n.Ident)
+	case *parse.VariableNode:
+		if len(n.Ident) == 1 {
+			return c.ranged[n.Ident[0]]
+		}
+		return n.Ident[0] == "$" && isRequestField(n.Ident[1:])
+	case *parse.PipeNode:
+		return len(cmd.Args) == 1 && c.rangeable(n)
+	}
+	return false
+}
+
+// isRequestField reports whether the field chain ident refers to the query
+// or pattern captures of the request, such as .Query.Values.
+func isRequestField(ident []string) bool {
+	return len(ident) > 0 && (ident[0] == "Query" || ident[0] == "Match")
+}
+
+// limitedBuffer is a bytes.Buffer that fails writes beyond maxExpandedSize
+// or after it has been stopped.
+type limitedBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return 0, errExpandTimeout
+	}
+	if b.buf.Len()+len(p) > maxExpandedSize {
+		return 0, errExpandedTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+}
+
+// executeLinkTemplate runs tmpl with data, returning an error if the output
+// exceeds maxExpandedSize or takes longer than maxExpandTime.
+//
+// Templates can't be interrupted, so a template that runs out of time keeps
+// running in the background until its next write fails. parseLinkTemplate
+// rejects templates whose loops could keep it running for long.
+func executeLinkTemplate(tmpl *texttemplate.Template, data any) (string, error) {
+	buf := new(limitedBuffer)
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.Execute(buf, data)
+	}()
+
+	timer := time.NewTimer(maxExpandTime)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", err
+		}
+		return buf.buf.String(), nil
+	case <-timer.C:
+		buf.stop()
+		return "", errExpandTimeout
+	}
+}
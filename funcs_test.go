@@ -0,0 +1,250 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+	"time"
+)
+
+func TestExpandFuncs(t *testing.T) {
+	now := time.Date(2022, 06, 02, 1, 2, 3, 4, time.UTC)
+	tests := []struct {
+		name    string
+		long    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "split",
+			long: `http://host.com/{{index (Split .Path "/") 1}}`,
+			path: "a/b/c",
+			want: "http://host.com/b",
+		},
+		{
+			name: "split-join",
+			long: `http://host.com/?q={{Join (Split .Path "/") "+"}}`,
+			path: "a/b/c",
+			want: "http://host.com/?q=a+b+c",
+		},
+		{
+			name: "default-empty",
+			long: `http://host.com/{{.Path | Default "main"}}`,
+			want: "http://host.com/main",
+		},
+		{
+			name: "default-set",
+			long: `http://host.com/{{.Path | Default "main"}}`,
+			path: "dev",
+			want: "http://host.com/dev",
+		},
+		{
+			name: "lower",
+			long: `http://host.com/{{ToLower .Path}}`,
+			path: "MiXeD",
+			want: "http://host.com/mixed",
+		},
+		{
+			name: "trimprefix",
+			long: `http://host.com/{{TrimPrefix .Path "v"}}`,
+			path: "v1.2",
+			want: "http://host.com/1.2",
+		},
+		{
+			name: "regex-replace",
+			long: `http://host.com/{{RegexReplace .Path "^pr([0-9]+)$" "pull/$1"}}`,
+			path: "pr123",
+			want: "http://host.com/pull/123",
+		},
+		{
+			name: "regex-match",
+			long: `http://host.com/{{if RegexMatch "^[0-9]+$" .Path}}id/{{end}}{{.Path}}`,
+			path: "123",
+			want: "http://host.com/id/123",
+		},
+		{
+			name:    "regex-invalid",
+			long:    `http://host.com/{{RegexReplace .Path "(" ""}}`,
+			path:    "x",
+			wantErr: true,
+		},
+		{
+			name: "jira-key",
+			long: `https://jira.example/browse/{{JiraKey .Path}}`,
+			path: "proj-123/comments",
+			want: "https://jira.example/browse/PROJ-123",
+		},
+		{
+			name: "jira-key-missing",
+			long: `https://jira.example/{{with JiraKey .Path}}browse/{{.}}{{end}}`,
+			path: "nothing",
+			want: "https://jira.example/",
+		},
+		{
+			name: "base64",
+			long: `http://host.com/{{Base64Encode .Path}}`,
+			path: "a:b",
+			want: "http://host.com/YTpi",
+		},
+		{
+			name: "base64-decode",
+			long: `http://host.com/{{Base64Decode .Path}}`,
+			path: "YTpi",
+			want: "http://host.com/a:b",
+		},
+		{
+			name:    "base64-decode-invalid",
+			long:    `http://host.com/{{Base64Decode .Path}}`,
+			path:    "!!",
+			wantErr: true,
+		},
+		{
+			name: "date-duration",
+			long: `http://wiki/{{(.Now.Add (Duration "-24h")).Format "2006-01-02"}}`,
+			want: "http://wiki/2022-06-01",
+		},
+		{
+			name: "date-adddate",
+			long: `http://wiki/{{(.Now.AddDate 0 1 0).Format "2006-01-02"}}`,
+			want: "http://wiki/2022-07-02",
+		},
+		{
+			name: "parse-time",
+			long: `http://wiki/{{((ParseTime "2006-01-02" .Path).AddDate 0 0 7).Format "2006-01-02"}}`,
+			path: "2022-12-28",
+			want: "http://wiki/2023-01-04",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandLink(tt.long, expandEnv{Now: now, Path: tt.path})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandLink(%q) returned error %v; want %v", tt.long, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expandLink(%q) = %q; want %q", tt.long, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		long    string
+		path    string
+		wantErr error
+	}{
+		{
+			name:    "template too large",
+			long:    "http://host.com/" + strings.Repeat("x", maxTemplateSize),
+			wantErr: errTemplateTooLarge,
+		},
+		{
+			name:    "output too large",
+			long:    `{{range Split .Path ""}}{{$.Path}}{{end}}`,
+			path:    strings.Repeat("x", 300),
+			wantErr: errExpandedTooLarge,
+		},
+		{
+			name:    "nested range",
+			long:    `{{range Split .Path ""}}{{range Split $.Path ""}}x{{end}}{{end}}`,
+			wantErr: errNestedRange,
+		},
+		{
+			name:    "range over int",
+			long:    `{{range 1000000000}}{{end}}`,
+			wantErr: errRangeSource,
+		},
+		{
+			name:    "range over computed int",
+			long:    `{{$n := Duration "1000h"}}{{range $n}}{{end}}`,
+			wantErr: errRangeSource,
+		},
+		{
+			name:    "range over reassigned variable",
+			long:    `{{$parts := Split .Path "/"}}{{$parts = len .Path}}{{range $parts}}{{end}}`,
+			wantErr: errRangeSource,
+		},
+		{
+			name:    "recursive template",
+			long:    `{{define "loop"}}{{template "loop"}}{{end}}{{template "loop"}}`,
+			wantErr: errTemplateAction,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := expandLink(tt.long, expandEnv{Path: tt.path})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expandLink() returned error %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRangeAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		long string
+		path string
+		want string
+	}{
+		{
+			name: "split",
+			long: `http://host.com/{{range Split .Path "/"}}{{.}}+{{end}}`,
+			path: "a/b",
+			want: "http://host.com/a+b+",
+		},
+		{
+			name: "split variable",
+			long: `{{$parts := Split .Path "/"}}http://host.com/{{range $i, $p := $parts}}{{$i}}{{$p}}{{end}}`,
+			path: "a/b",
+			want: "http://host.com/0a1b",
+		},
+		{
+			name: "query",
+			long: `http://host.com/{{range $k, $v := .Query.Values}}{{$k}}{{end}}`,
+			want: "http://host.com/",
+		},
+		{
+			name: "sequential ranges",
+			long: `http://host.com/{{range Split .Path "/"}}{{.}}{{end}}/{{range (Split $.Path "/")}}{{.}}{{end}}`,
+			path: "a/b",
+			want: "http://host.com/ab/ab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandLink(tt.long, expandEnv{Path: tt.path})
+			if err != nil {
+				t.Fatalf("expandLink() returned error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expandLink() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	// Templates that parseLinkTemplate accepts finish quickly, so parse
+	// one directly to check that slow templates are still cut off.
+	tmpl := texttemplate.Must(texttemplate.New("").Funcs(expandFuncMap).Parse(
+		`{{range Split .Path ""}}{{range Split $.Path ""}}{{range Split $.Path ""}}{{range Split $.Path ""}}{{range Split $.Path ""}}{{""}}{{end}}{{end}}{{end}}{{end}}{{end}}`))
+	_, err := executeLinkTemplate(tmpl, expandEnv{Path: strings.Repeat("x", maxSplitParts)})
+	if !errors.Is(err, errExpandTimeout) {
+		t.Errorf("executeLinkTemplate() returned error %v; want %v", err, errExpandTimeout)
+	}
+}
+
+func TestSplitLimit(t *testing.T) {
+	parts := split(strings.Repeat("a/", 100), "/")
+	if len(parts) != maxSplitParts {
+		t.Errorf("split returned %d parts; want %d", len(parts), maxSplitParts)
+	}
+}
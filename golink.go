@@ -5,7 +5,6 @@
 package golink
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"embed"
@@ -15,18 +14,19 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	texttemplate "text/template"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -42,21 +42,38 @@ var (
 	verbose           = flag.Bool("verbose", false, "be verbose")
 	controlURL        = flag.String("control-url", ipn.DefaultControlURL, "the URL base of the control plane (i.e. coordination server)")
 	dev               = flag.String("dev-listen", "", "if non-empty, listen on this addr and run in dev mode")
-	hostname          = flag.String("hostname", defaultHostname, "service name")
+	hostname          = flag.String("hostname", defaultHostname, "service name, or a comma-separated list of names that each serve their own links")
 	allowUnknownUsers = flag.Bool("allow-unknown-users", false, "allow unknown users to save links")
+	admins            = flag.String("admins", "", "comma-separated list of users who can change any link, including locked links")
 )
 
+// isAdmin reports whether login is one of the users set by the -admins flag,
+// or the user running a command against the database.
+func isAdmin(login string) bool {
+	if login == "" {
+		return false
+	}
+	if login == localAdmin {
+		return true
+	}
+	for _, a := range strings.Split(*admins, ",") {
+		if strings.TrimSpace(a) == login {
+			return true
+		}
+	}
+	return false
+}
+
 var stats struct {
 	mu     sync.Mutex
 	clicks ClickStats // short link -> number of times visited
 
 	// dirty identifies short link clicks that have not yet been stored.
 	dirty ClickStats
-}
 
-// LastSnapshot is the data snapshot (as returned by the /.export handler)
-// that will be loaded on startup.
-var LastSnapshot []byte
+	// lastClick is when each short link was last visited.
+	lastClick map[string]time.Time
+}
 
 //go:embed static tmpl/*.html tmpl/*.xml
 var embeddedFS embed.FS
@@ -69,6 +86,16 @@ func Run() error {
 
 	hostinfo.SetApp("golink")
 
+	// commands other than serve are sent to the -server API, if set, without
+	// needing a database
+	command := "serve"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	if command != "serve" && *server != "" {
+		return runCommand(remoteClient(), os.Stdout, flag.Args())
+	}
+
 	var err error
 	config, err := loadDBConfig()
 	if err != nil {
@@ -79,73 +106,98 @@ func Run() error {
 		return fmt.Errorf("NewDB(%s): %w", config.Host, err)
 	}
 
+	if err := loadGroups(); err != nil {
+		return fmt.Errorf("loading groups: %w", err)
+	}
+	if err := loadAPITokens(); err != nil {
+		return fmt.Errorf("loading API tokens: %w", err)
+	}
+
+	// override default hostname for dev mode
+	if *dev != "" && *hostname == defaultHostname {
+		if h, p, err := net.SplitHostPort(*dev); err == nil {
+			if h == "" {
+				h = "localhost"
+			}
+			*hostname = fmt.Sprintf("%s:%s", h, p)
+		}
+	}
+	if err := loadTenants(); err != nil {
+		return fmt.Errorf("loading tenants: %w", err)
+	}
+	if err := loadWebhooks(); err != nil {
+		return fmt.Errorf("loading webhooks: %w", err)
+	}
+
 	if err := initStats(); err != nil {
 		log.Printf("initializing stats: %v", err)
 	}
 
-	// if link specified on command line, resolve and exit
-	if flag.NArg() > 0 {
-		destination, err := resolveLink(flag.Arg(0))
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Println(destination)
-		os.Exit(0)
+	handler := newHandler()
+
+	// other commands run against the database, through the same handlers
+	// that serve the API
+	if command != "serve" {
+		return runCommand(localClient(handler), os.Stdout, flag.Args())
+	}
+
+	if len(apiTokens) > 0 {
+		systemActor.record(defaultTenant(), auditTokensLoad, *apiTokensFile, nil, tokenUsers())
 	}
 
 	// flush stats periodically
 	go flushStatsLoop()
 
-	http.HandleFunc("/", serveGo)
-	http.HandleFunc("/.detail/", serveDetail)
-	http.HandleFunc("/.export", serveExport)
-	http.HandleFunc("/.help", serveHelp)
-	http.HandleFunc("/.opensearch", serveOpenSearch)
-	http.HandleFunc("/.all", serveAll)
-	http.HandleFunc("/.delete/", serveDelete)
-	http.Handle("/.static/", http.StripPrefix("/.", http.FileServer(http.FS(embeddedFS))))
+	// tell owners about links that are about to expire
+	go notifyExpiringLoop()
 
-	if *dev != "" {
-		// override default hostname for dev mode
-		if *hostname == defaultHostname {
-			if h, p, err := net.SplitHostPort(*dev); err == nil {
-				if h == "" {
-					h = "localhost"
-				}
-				*hostname = fmt.Sprintf("%s:%s", h, p)
-			}
-		}
+	// send queued webhook deliveries, retrying failed ones
+	startWebhooks()
 
+	if *dev != "" {
 		log.Printf("Running in dev mode on %s ...", *dev)
-		log.Fatal(http.ListenAndServe(*dev, nil))
+		log.Fatal(http.ListenAndServe(*dev, defaultTenant().serve(handler)))
 	}
 
-	if *hostname == "" {
+	if len(tenants) == 0 {
 		return errors.New("--hostname, if specified, cannot be empty")
 	}
 
-	srv := &tsnet.Server{
-		ControlURL: *controlURL,
-		Hostname:   *hostname,
-		Logf:       func(format string, args ...any) {},
-	}
-	if *verbose {
-		srv.Logf = log.Printf
-	}
-	if err := srv.Start(); err != nil {
-		return err
-	}
+	// each hostname is a separate tailnet node, serving its own tenant
+	errc := make(chan error, len(tenants))
+	for i, t := range tenants {
+		srv := &tsnet.Server{
+			ControlURL: *controlURL,
+			Hostname:   t.Hostname,
+			Logf:       func(format string, args ...any) {},
+		}
+		if i > 0 {
+			// nodes after the first need their own state directory
+			dir, err := os.UserConfigDir()
+			if err != nil {
+				return err
+			}
+			srv.Dir = filepath.Join(dir, "tsnet-golink-"+t.Hostname)
+		}
+		if *verbose {
+			srv.Logf = log.Printf
+		}
+		if err := srv.Start(); err != nil {
+			return err
+		}
 
-	l80, err := srv.Listen("tcp", ":80")
-	if err != nil {
-		return err
-	}
+		l80, err := srv.Listen("tcp", ":80")
+		if err != nil {
+			return err
+		}
 
-	log.Printf("Serving http://%s/ ...", *hostname)
-	if err := http.Serve(l80, nil); err != nil {
-		return err
+		log.Printf("Serving http://%s/ ...", t.Hostname)
+		h := t.serve(handler)
+		go func() {
+			errc <- http.Serve(l80, h)
+		}()
 	}
-	return nil
+	return <-errc
 }
 
 var (
@@ -170,6 +222,40 @@ var (
 
 	// opensearchTmpl is the template used by the http://go/.opensearch page
 	opensearchTmpl *template.Template
+
+	// unavailableTmpl is the template used when a link exists but cannot be resolved.
+	unavailableTmpl *template.Template
+
+	// searchTmpl is the template used by the http://go/.search page
+	searchTmpl *template.Template
+
+	// patternsTmpl is the template used by the http://go/.patterns page
+	patternsTmpl *template.Template
+
+	// previewTmpl is the template used to show where a link goes before
+	// following it.
+	previewTmpl *template.Template
+
+	// tryTmpl is the template used by the http://go/.try page
+	tryTmpl *template.Template
+
+	// personalTmpl is the template used by the http://go/.me page
+	personalTmpl *template.Template
+
+	// mineTmpl is the template used by the http://go/.mine page
+	mineTmpl *template.Template
+
+	// transferTmpl is the template used by the http://go/.transfer page
+	transferTmpl *template.Template
+
+	// auditTmpl is the template used by the http://go/.audit page
+	auditTmpl *template.Template
+
+	// webhooksTmpl is the template used by the http://go/.webhooks page
+	webhooksTmpl *template.Template
+
+	// bookmarksTmpl is the template used by http://go/.export?format=html
+	bookmarksTmpl *template.Template
 )
 
 type visitData struct {
@@ -181,6 +267,15 @@ type visitData struct {
 type homeData struct {
 	Short  string
 	Clicks []visitData
+
+	// Path is the remaining path after an unknown short name.
+	Path string
+
+	// Suggestions are existing links with names close to an unknown Short.
+	Suggestions []*Link
+
+	// DidYouMean is set when a single suggestion is a strong match for Short.
+	DidYouMean *Link
 }
 
 var xsrfKey string
@@ -193,12 +288,49 @@ func init() {
 	allTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/all.html"))
 	deleteTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/delete.html"))
 	opensearchTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/opensearch.xml"))
+	unavailableTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/unavailable.html"))
+	searchTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/search.html"))
+	patternsTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/patterns.html"))
+	previewTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/preview.html"))
+	tryTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/try.html"))
+	personalTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/personal.html"))
+	mineTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/mine.html"))
+	transferTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/transfer.html"))
+	auditTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/audit.html"))
+	webhooksTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/base.html", "tmpl/webhooks.html"))
+	bookmarksTmpl = template.Must(template.ParseFS(embeddedFS, "tmpl/bookmarks.html"))
 
 	b := make([]byte, 24)
 	rand.Read(b)
 	xsrfKey = base64.StdEncoding.EncodeToString(b)
 }
 
+// newHandler returns the handler serving golink's pages and API.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveGo)
+	mux.HandleFunc("/.detail/", serveDetail)
+	mux.HandleFunc("/.export", serveExport)
+	mux.HandleFunc("/.import", serveImport)
+	mux.HandleFunc("/.stats", serveStats)
+	mux.HandleFunc("/.help", serveHelp)
+	mux.HandleFunc("/.opensearch", serveOpenSearch)
+	mux.HandleFunc("/.suggest", serveSuggest)
+	mux.HandleFunc("/.all", serveAll)
+	mux.HandleFunc("/.search", serveSearch)
+	mux.HandleFunc("/.try", serveTry)
+	mux.HandleFunc("/.me", servePersonal)
+	mux.HandleFunc("/.me/export", servePersonalExport)
+	mux.HandleFunc("/.mine", serveMine)
+	mux.HandleFunc("/.transfer", serveTransfer)
+	mux.HandleFunc("/.audit", serveAudit)
+	mux.HandleFunc("/.webhooks", serveWebhooks)
+	mux.HandleFunc("/.delete/", serveDelete)
+	mux.HandleFunc("/.patterns", servePatterns)
+	mux.Handle("/.static/", http.StripPrefix("/.", http.FileServer(http.FS(embeddedFS))))
+	return checkAPIToken(mux)
+}
+
 // initStats initializes the in-memory stats counter with counts from db.
 func initStats() error {
 	stats.mu.Lock()
@@ -209,8 +341,14 @@ func initStats() error {
 		return err
 	}
 
+	lastClick, err := db.LoadLastClicks()
+	if err != nil {
+		return err
+	}
+
 	stats.clicks = clicks
 	stats.dirty = make(ClickStats)
+	stats.lastClick = lastClick
 
 	return nil
 }
@@ -242,22 +380,27 @@ func flushStatsLoop() {
 }
 
 // deleteLinkStats removes the link stats from memory.
-func deleteLinkStats(link *Link) {
+func deleteLinkStats(t *tenant, link *Link) {
+	key := t.statsKey(link.Short)
 	stats.mu.Lock()
-	delete(stats.clicks, link.Short)
-	delete(stats.dirty, link.Short)
+	delete(stats.clicks, key)
+	delete(stats.dirty, key)
+	delete(stats.lastClick, key)
 	stats.mu.Unlock()
 
-	db.DeleteStats(link.Short)
+	t.db().DeleteStats(link.Short)
 }
 
-func serveHome(w http.ResponseWriter, short string) {
+func serveHome(w http.ResponseWriter, t *tenant, data homeData) {
 	var clicks []visitData
 
 	stats.mu.Lock()
-	for short, numClicks := range stats.clicks {
+	for key, numClicks := range stats.clicks {
+		if !t.owns(key) {
+			continue
+		}
 		clicks = append(clicks, visitData{
-			Short:     short,
+			Short:     strings.TrimPrefix(key, t.prefix()),
 			NumClicks: numClicks,
 		})
 	}
@@ -273,66 +416,349 @@ func serveHome(w http.ResponseWriter, short string) {
 		clicks = clicks[:200]
 	}
 
-	homeTmpl.Execute(w, homeData{
-		Short:  short,
-		Clicks: clicks,
-	})
+	data.Clicks = clicks
+	homeTmpl.Execute(w, data)
+}
+
+// serveNotFound renders the home page for an unknown short name, with
+// suggestions for existing links listed for login that have similar names.
+// Candidates are found with Search, so on Postgres names are matched by
+// trigram similarity, and on other databases only by substring.
+func serveNotFound(w http.ResponseWriter, t *tenant, short, remainder, login string) {
+	data := homeData{Short: short, Path: remainder}
+	links, err := t.db().Search(LinkSearch{Query: short, Limit: maxSuggestionCandidates})
+	if err != nil {
+		log.Printf("loading suggestions for %q: %v", short, err)
+	}
+	links = listedLinks(t, links, login)
+	data.Suggestions, data.DidYouMean = closeMatches(short, links, maxSuggestions)
+
+	w.WriteHeader(http.StatusNotFound)
+	serveHome(w, t, data)
+}
+
+// allData is the data used by the allTmpl template.
+type allData struct {
+	Links []*Link
+
+	// Clicks are the number of visits of each link, by short name.
+	Clicks map[string]int
+
+	// Tag is the tag links are filtered by, if any.
+	Tag string
+
+	// Tags are the tags of the links shown, for filtering.
+	Tags []string
+
+	// Sort is the field links are sorted by: "name", "clicks", "owner", or
+	// "last_edit".
+	Sort string
+	Desc bool
+
+	// SortURLs are the URLs sorting links by each field. The current field's
+	// URL reverses the order.
+	SortURLs map[string]string
+
+	// NextURL is the URL of the next page of links, if any.
+	NextURL string
+
+	// FirstURL is the URL of the first page of links, if this isn't it.
+	FirstURL string
+
+	// Admin indicates whether the current user is an admin, who can import
+	// links.
+	Admin bool
+	XSRF  string
+
+	// Imported is the number of links just imported, if any.
+	Imported string
+}
+
+// allPageSize is the number of links on each page of /.all.
+const allPageSize = 100
+
+// allURL returns the URL of a page of /.all.
+func allURL(sort string, desc bool, tag, after string) string {
+	q := make(url.Values)
+	if sort != "name" {
+		q.Set("sort", sort)
+	}
+	if desc {
+		q.Set("order", "desc")
+	}
+	if tag != "" {
+		q.Set("tag", tag)
+	}
+	if after != "" {
+		q.Set("after", after)
+	}
+	if len(q) == 0 {
+		return "/.all"
+	}
+	return "/.all?" + q.Encode()
+}
+
+// loadPage loads a page of t's links selected by p, skipping links that keep
+// returns false for, if keep is non-nil. Pages are filled to p.Limit links,
+// unless they are the last.
+func loadPage(t *tenant, p LinkPage, keep func(*Link) bool) ([]*Link, string, error) {
+	var links []*Link
+	limit := p.Limit
+	for {
+		p.Limit = limit - len(links)
+		page, next, err := t.db().LoadPage(p)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, link := range page {
+			if keep == nil || keep(link) {
+				links = append(links, link)
+			}
+		}
+		if next == "" || len(links) >= limit {
+			return links, next, nil
+		}
+		p.After = next
+	}
 }
 
-func serveAll(w http.ResponseWriter, _ *http.Request) {
+// serveAll lists a page of the links listed for the current user. The "sort"
+// request value sorts them by "name" (the default), "clicks", "owner", or
+// "last_edit", and "order" reverses the order if "desc". The "after" value is
+// the cursor of the page, which JSON responses link to in a Link header.
+func serveAll(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
 	if err := flushStats(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	links, err := db.LoadAll()
+	data := allData{
+		Sort:     r.FormValue("sort"),
+		Desc:     r.FormValue("order") == "desc",
+		Tag:      strings.ToLower(r.FormValue("tag")),
+		Imported: r.FormValue("imported"),
+	}
+	if data.Sort == "" {
+		data.Sort = "name"
+	}
+	page := LinkPage{Sort: data.Sort, Desc: data.Desc, Tag: data.Tag, After: r.FormValue("after"), Limit: allPageSize}
+	if page.Sort == "name" {
+		page.Sort = ""
+	} else if _, ok := linkSorts[page.Sort]; !ok {
+		http.Error(w, "sort must be name, clicks, owner, or last_edit", http.StatusBadRequest)
+		return
+	}
+
+	login, _ := currentUser(r)
+	links, next, err := loadPage(t, page, func(link *Link) bool {
+		return isListed(t, link, login)
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	sort.Slice(links, func(i, j int) bool {
-		return links[i].Short < links[j].Short
-	})
+	data.Links = links
+
+	if next != "" {
+		data.NextURL = allURL(data.Sort, data.Desc, data.Tag, next)
+	}
+	if !acceptHTML(r) {
+		if data.NextURL != "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, data.NextURL))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data.Links)
+		return
+	}
+
+	if page.After != "" {
+		data.FirstURL = allURL(data.Sort, data.Desc, data.Tag, "")
+	}
+	data.SortURLs = make(map[string]string)
+	for _, s := range []string{"name", "clicks", "owner", "last_edit"} {
+		data.SortURLs[s] = allURL(s, s == data.Sort && !data.Desc, data.Tag, "")
+	}
+	data.Admin = t.isAdmin(login)
+	if data.Admin {
+		data.XSRF = xsrftoken.Generate(xsrfKey, login, importXSRFAction)
+	}
+
+	data.Clicks = make(map[string]int)
+	seen := make(map[string]bool)
+	stats.mu.Lock()
+	for _, link := range links {
+		data.Clicks[link.Short] = stats.clicks[t.statsKey(link.Short)]
+		for _, tag := range link.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				data.Tags = append(data.Tags, tag)
+			}
+		}
+	}
+	stats.mu.Unlock()
+	sort.Strings(data.Tags)
+
+	allTmpl.Execute(w, data)
+}
+
+// maxSearchResults is the maximum number of links returned by a search.
+const maxSearchResults = 50
+
+// searchData is the data used by the searchTmpl template.
+type searchData struct {
+	Query string
+	Links []*Link
+}
+
+// serveSearch returns links matching the "q" query parameter, ranked by
+// relevance.
+func serveSearch(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	data := searchData{Query: strings.TrimSpace(r.FormValue("q"))}
+	if data.Query != "" {
+		links, err := t.db().Search(LinkSearch{Query: data.Query, Limit: maxSearchResults})
+		if err != nil {
+			log.Printf("searching %q: %v", data.Query, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		login, _ := currentUser(r)
+		data.Links = listedLinks(t, links, login)
+	}
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data.Links)
+		return
+	}
 
-	allTmpl.Execute(w, links)
+	searchTmpl.Execute(w, data)
 }
 
 func serveHelp(w http.ResponseWriter, _ *http.Request) {
 	helpTmpl.Execute(w, nil)
 }
 
-func serveOpenSearch(w http.ResponseWriter, _ *http.Request) {
+// serveOpenSearch serves the OpenSearch description of the tenant for the
+// requested host.
+func serveOpenSearch(w http.ResponseWriter, r *http.Request) {
 	type opensearchData struct {
-		Hostname string
+		Hostname    string
+		Description string
 	}
 
+	t := tenantFor(r)
 	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
-	opensearchTmpl.Execute(w, opensearchData{Hostname: *hostname})
+	opensearchTmpl.Execute(w, opensearchData{Hostname: t.Hostname, Description: t.Description})
+}
+
+// maxSuggestResults is the maximum number of completions returned by the
+// /.suggest handler.
+const maxSuggestResults = 10
+
+// serveSuggest returns completions for the "q" query parameter in the
+// OpenSearch suggestions format: the query, followed by arrays of matching
+// short names, their descriptions, and their URLs. Matches are ranked by
+// click count.
+func serveSuggest(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	q := strings.TrimSpace(r.FormValue("q"))
+	names, descriptions, urls := []string{}, []string{}, []string{}
+
+	if q != "" {
+		links, err := t.db().Search(LinkSearch{Query: q, Limit: maxSearchResults})
+		if err != nil {
+			log.Printf("suggesting %q: %v", q, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		login, _ := currentUser(r)
+		links = listedLinks(t, links, login)
+
+		stats.mu.Lock()
+		clicks := make(map[*Link]int, len(links))
+		for _, link := range links {
+			clicks[link] = stats.clicks[t.statsKey(link.Short)]
+		}
+		stats.mu.Unlock()
+
+		sort.SliceStable(links, func(i, j int) bool {
+			if clicks[links[i]] != clicks[links[j]] {
+				return clicks[links[i]] > clicks[links[j]]
+			}
+			return links[i].Short < links[j].Short
+		})
+		if len(links) > maxSuggestResults {
+			links = links[:maxSuggestResults]
+		}
+		for _, link := range links {
+			names = append(names, link.Short)
+			descriptions = append(descriptions, link.Description)
+			urls = append(urls, fmt.Sprintf("http://%s/%s", t.Hostname, link.Short))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-suggestions+json")
+	json.NewEncoder(w).Encode([]any{q, names, descriptions, urls})
 }
 
 func serveGo(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
 	if r.RequestURI == "/" {
 		switch r.Method {
 		case "GET":
-			serveHome(w, "")
+			serveHome(w, t, homeData{})
 		case "POST":
 			serveSave(w, r)
 		}
 		return
 	}
 
-	short, remainder, _ := strings.Cut(strings.TrimPrefix(r.RequestURI, "/"), "/")
+	path, rawQuery, _ := strings.Cut(strings.TrimPrefix(r.RequestURI, "/"), "?")
 
-	// redirect {name}+ links to /.detail/{name}
-	if strings.HasSuffix(short, "+") {
-		http.Redirect(w, r, "/.detail/"+strings.TrimSuffix(short, "+"), http.StatusFound)
-		return
+	// {name}+ links show a preview page in browsers, and redirect other
+	// clients to /.detail/{name}
+	preview := false
+	if short, trimmed, ok := cutPreview(path); ok {
+		if !acceptHTML(r) {
+			http.Redirect(w, r, "/.detail/"+short, http.StatusFound)
+			return
+		}
+		path, preview = trimmed, true
 	}
 
-	link, err := db.Load(short)
+	login, _ := currentUser(r)
+	link, short, remainder, err := loadUserLink(t, path, login)
+
+	// try pattern rules for names that aren't links
+	var match map[string]string
 	if errors.Is(err, fs.ErrNotExist) {
-		w.WriteHeader(http.StatusNotFound)
-		serveHome(w, short)
+		if l, m, perr := loadPatternLink(t, path); perr == nil {
+			link, remainder, match, err = l, "", m, nil
+		} else if !errors.Is(perr, fs.ErrNotExist) {
+			err = perr
+		}
+	}
+	requested := link
+	if err == nil {
+		link, err = canonicalLink(t, link)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		query, _ := url.ParseQuery(rawQuery)
+		if !serveFallback(w, r, path, query) {
+			serveNotFound(w, t, short, remainder, login)
+		}
+		return
+	}
+	var chainErr *linkChainError
+	if errors.As(err, &chainErr) {
+		log.Printf("serving %q: %v", short, err)
+		http.Error(w, err.Error(), http.StatusLoopDetected)
 		return
 	}
 	if err != nil {
@@ -341,19 +767,46 @@ func serveGo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats.mu.Lock()
-	if stats.clicks == nil {
-		stats.clicks = make(ClickStats)
+	// both an alias and the link it points to must be visible to the user
+	if !canView(t, requested, login) || !canView(t, link, login) {
+		http.Error(w, "link is restricted", http.StatusForbidden)
+		return
 	}
-	stats.clicks[link.Short]++
-	if stats.dirty == nil {
-		stats.dirty = make(ClickStats)
+
+	now := time.Now().UTC()
+	if link.Disabled {
+		w.WriteHeader(http.StatusGone)
+		unavailableTmpl.Execute(w, unavailableData{Link: link, Reason: disabledReason(link)})
+		return
+	}
+	if !link.activeAt(now) {
+		w.WriteHeader(http.StatusNotFound)
+		unavailableTmpl.Execute(w, unavailableData{Link: link, Reason: inactiveReason(link, now)})
+		return
 	}
-	stats.dirty[link.Short]++
-	stats.mu.Unlock()
 
-	login, _ := currentUser(r)
-	target, err := expandLink(link.Long, expandEnv{Now: time.Now().UTC(), Path: remainder, user: login})
+	// clicks are only counted for stored links, not pattern matches,
+	// previews requested with {name}+, or HEAD requests such as fallback
+	// checks from other golinks
+	if match == nil && !preview && r.Method != "HEAD" {
+		stats.mu.Lock()
+		if stats.clicks == nil {
+			stats.clicks = make(ClickStats)
+		}
+		stats.clicks[t.statsKey(link.Short)]++
+		if stats.dirty == nil {
+			stats.dirty = make(ClickStats)
+		}
+		stats.dirty[t.statsKey(link.Short)]++
+		if stats.lastClick == nil {
+			stats.lastClick = make(map[string]time.Time)
+		}
+		stats.lastClick[t.statsKey(link.Short)] = now
+		stats.mu.Unlock()
+	}
+
+	query, _ := url.ParseQuery(rawQuery)
+	target, err := expandLink(link.Long, expandEnv{Now: now, Path: remainder, Query: newTemplateQuery(query), Match: match, user: login, queryMode: link.QueryMode})
 	if err != nil {
 		log.Printf("expanding %q: %v", link.Long, err)
 		if errors.Is(err, errNoUser) {
@@ -363,7 +816,98 @@ func serveGo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, target, http.StatusFound)
+
+	// Check chained go links here rather than letting the browser follow
+	// redirects until it gives up.
+	if isLocalLink(t, target) {
+		var chainErr *linkChainError
+		if _, err := followLinks(t, target, []string{link.Short}, nil); errors.As(err, &chainErr) {
+			log.Printf("serving %q: %v", short, err)
+			http.Error(w, err.Error(), http.StatusLoopDetected)
+			return
+		}
+	}
+
+	if preview || link.Preview {
+		stats.mu.Lock()
+		clicks := stats.clicks[t.statsKey(link.Short)]
+		stats.mu.Unlock()
+		previewTmpl.Execute(w, previewData{Link: link, Destination: target, Clicks: clicks, Pattern: match != nil})
+		return
+	}
+	http.Redirect(w, r, target, link.redirectStatus())
+}
+
+// cutPreview reports whether path requests a preview of a link, either as
+// {name}+ or {name}+/{path}. If so, it returns the short name and path
+// without the "+".
+func cutPreview(path string) (short, trimmed string, ok bool) {
+	if first, rest, found := strings.Cut(path, "/"); strings.HasSuffix(first, "+") {
+		short = strings.TrimSuffix(first, "+")
+		if found {
+			return short, short + "/" + rest, true
+		}
+		return short, short, true
+	}
+	if strings.HasSuffix(path, "+") {
+		short = strings.TrimSuffix(path, "+")
+		return short, short, true
+	}
+	return "", "", false
+}
+
+// previewData is the data used by the previewTmpl template.
+type previewData struct {
+	Link *Link
+
+	// Destination is the expanded destination of the link.
+	Destination string
+
+	// Clicks is the number of times the link has been followed.
+	Clicks int
+
+	// Pattern is set if Link was built from a pattern rule rather than
+	// stored.
+	Pattern bool
+}
+
+// canonicalLink returns the link that link is an alias of, or link itself if
+// it is not an alias. It returns fs.ErrNotExist if the canonical link has
+// been deleted, and a linkChainError if aliases form a loop. Aliases are
+// flattened when saved, so a well-formed alias only needs one step.
+func canonicalLink(t *tenant, link *Link) (*Link, error) {
+	chain := []string{link.Short}
+	for link.AliasOf != "" {
+		var err error
+		if chain, err = visitLink(chain, link.AliasOf); err != nil {
+			return nil, err
+		}
+		if link, err = t.db().Load(link.AliasOf); err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// unavailableData is the data used by the unavailableTmpl template.
+type unavailableData struct {
+	Link *Link
+
+	// Reason explains why the link cannot be resolved.
+	Reason string
+}
+
+// disabledReason describes why link is disabled.
+func disabledReason(link *Link) string {
+	return "This link has been disabled: " + link.DisabledReason
+}
+
+// inactiveReason describes why link is not active at time now.
+func inactiveReason(link *Link, now time.Time) string {
+	if !link.ActiveFrom.IsZero() && now.Before(link.ActiveFrom) {
+		return "This link is not active until " + link.ActiveFrom.Format("Jan _2, 2006 3:04pm MST") + "."
+	}
+	return "This link expired on " + link.ExpiresAt.Format("Jan _2, 2006 3:04pm MST") + "."
 }
 
 // acceptHTML returns whether the request can accept a text/html response.
@@ -377,12 +921,23 @@ type detailData struct {
 	Editable bool
 	Link     *Link
 	XSRF     string
+
+	// TryXSRF is the XSRF token for trying the destination on /.try.
+	TryXSRF string
+
+	// Aliases are the links that resolve to Link that the user can view.
+	Aliases []*Link
+
+	// Admin indicates whether the current user is an admin, who can edit
+	// and unlock any link.
+	Admin bool
 }
 
 func serveDetail(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
 	short := strings.TrimPrefix(r.RequestURI, "/.detail/")
 
-	link, err := db.Load(short)
+	link, err := t.db().Load(short)
 	if errors.Is(err, fs.ErrNotExist) {
 		http.NotFound(w, r)
 		return
@@ -393,6 +948,16 @@ func serveDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canView(t, link, login) {
+		http.Error(w, "link is restricted", http.StatusForbidden)
+		return
+	}
+
 	if !acceptHTML(r) {
 		w.Header().Set("Content-Type", "application/json")
 		enc := json.NewEncoder(w)
@@ -401,21 +966,28 @@ func serveDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	login, err := currentUser(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	ownerExists, err := userExists(r.Context(), link.Owner)
+	exists, err := ownerExists(r.Context(), link.Owner)
 	if err != nil {
 		log.Printf("looking up tailnet user %q: %v", link.Owner, err)
 	}
 
-	data := detailData{Link: link}
-	if link.Owner == login || !ownerExists {
+	data := detailData{Link: link, Admin: t.isAdmin(login)}
+	aliases, err := t.db().LoadAliases(link.Short)
+	if err != nil {
+		log.Printf("loading aliases of %q: %v", link.Short, err)
+	}
+	for _, alias := range aliases {
+		if canView(t, alias, login) {
+			data.Aliases = append(data.Aliases, alias)
+		}
+	}
+	if data.Admin || (!link.Locked && (isOwner(link, login) || !exists)) {
 		data.Editable = true
-		data.Link.Owner = login
+		if !data.Admin && !isOwner(link, login) {
+			data.Link.Owner = login
+		}
 		data.XSRF = xsrftoken.Generate(xsrfKey, login, short)
+		data.TryXSRF = xsrftoken.Generate(xsrfKey, login, tryXSRFAction)
 	}
 
 	detailTmpl.Execute(w, data)
@@ -428,30 +1000,108 @@ type expandEnv struct {
 	// "http://go/who/amelie", Path is "amelie".
 	Path string
 
+	// Query is the query of the incoming request.  For example, in
+	// "http://go/search?q=foo", {{.Query.Get "q"}} is "foo".
+	Query templateQuery
+
+	// Match holds the named captures of the pattern that matched the
+	// request, if any.  For the pattern "(?P<key>[A-Z]+-[0-9]+)",
+	// {{.Match.key}} in "http://go/PROJ-123" is "PROJ-123".
+	Match map[string]string
+
 	// user is the current user, if any.
 	// For example, "foo@example.com" or "foo@github".
 	user string
+
+	// queryMode is the QueryMode of the link being expanded, which
+	// controls how query parameters not read by the template are passed
+	// on to the destination.
+	queryMode string
 }
 
-var errNoUser = errors.New("no user")
+// Query modes control what happens to incoming query parameters that a link
+// template does not read through .Query.
+const (
+	// queryModePass appends unused query parameters to the destination,
+	// even if the destination already has parameters with the same name.
+	// Links with no query mode pass their parameters on too, as links
+	// always have.
+	queryModePass = "pass"
+
+	// queryModeMerge adds unused query parameters to the destination,
+	// unless the destination already has a parameter with the same name.
+	queryModeMerge = "merge"
+
+	// queryModeDrop discards unused query parameters.
+	queryModeDrop = "drop"
+)
 
-// User returns the current user, or errNoUser if there is no user.
-func (e expandEnv) User() (string, error) {
-	if e.user == "" {
-		return "", errNoUser
+// validQueryMode reports whether mode is a known query mode.
+func validQueryMode(mode string) bool {
+	switch mode {
+	case "", queryModePass, queryModeMerge, queryModeDrop:
+		return true
 	}
-	return e.user, nil
+	return false
 }
 
-var expandFuncMap = texttemplate.FuncMap{
-	"PathEscape":  url.PathEscape,
-	"QueryEscape": url.QueryEscape,
-	"TrimSuffix":  strings.TrimSuffix,
+// templateQuery is the incoming request query, as made available to link
+// templates. It records the parameters read by a template, so that unused
+// parameters can be passed on to the destination.
+type templateQuery struct {
+	url.Values
+	used map[string]bool
 }
 
-// expandLink returns the expanded long URL to redirect to, executing any
-// embedded templates with env data.
-//
+// newTemplateQuery returns a templateQuery for the query values v.
+func newTemplateQuery(v url.Values) templateQuery {
+	return templateQuery{Values: v, used: make(map[string]bool)}
+}
+
+// Get returns the first value for key, or the empty string.
+func (q templateQuery) Get(key string) string {
+	q.markUsed(key)
+	return q.Values.Get(key)
+}
+
+// Has reports whether key is present in the query.
+func (q templateQuery) Has(key string) bool {
+	q.markUsed(key)
+	return q.Values.Has(key)
+}
+
+func (q templateQuery) markUsed(key string) {
+	if q.used != nil {
+		q.used[key] = true
+	}
+}
+
+// unused returns the names of query parameters not read by a template, in
+// sorted order.
+func (q templateQuery) unused() []string {
+	var keys []string
+	for k := range q.Values {
+		if !q.used[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errNoUser = errors.New("no user")
+
+// User returns the current user, or errNoUser if there is no user.
+func (e expandEnv) User() (string, error) {
+	if e.user == "" {
+		return "", errNoUser
+	}
+	return e.user, nil
+}
+
+// expandLink returns the expanded long URL to redirect to, executing any
+// embedded templates with env data.
+//
 // If long does not include templates, the default behavior is to append
 // env.Path to long.
 func expandLink(long string, env expandEnv) (string, error) {
@@ -463,21 +1113,36 @@ func expandLink(long string, env expandEnv) (string, error) {
 			long += "{{with .Path}}/{{.}}{{end}}"
 		}
 	}
-	tmpl, err := texttemplate.New("").Funcs(expandFuncMap).Parse(long)
+	tmpl, err := parseLinkTemplate(long)
 	if err != nil {
 		return "", err
 	}
-	buf := new(bytes.Buffer)
-	if err := tmpl.Execute(buf, env); err != nil {
+	long, err = executeLinkTemplate(tmpl, env)
+	if err != nil {
 		return "", err
 	}
-	long = buf.String()
 
-	_, err = url.Parse(long)
+	u, err := url.Parse(long)
 	if err != nil {
 		return "", err
 	}
-	return long, nil
+	unused := env.Query.unused()
+	if env.queryMode == queryModeDrop || len(unused) == 0 {
+		return long, nil
+	}
+	dq := u.Query()
+	for _, k := range unused {
+		switch env.queryMode {
+		case queryModeMerge:
+			if !dq.Has(k) {
+				dq[k] = env.Query.Values[k]
+			}
+		default:
+			dq[k] = append(dq[k], env.Query.Values[k]...)
+		}
+	}
+	u.RawQuery = dq.Encode()
+	return u.String(), nil
 }
 
 func devMode() bool { return *dev != "" }
@@ -488,6 +1153,9 @@ func devMode() bool { return *dev != "" }
 // If the user can't be determined (such as requests coming through a subnet router),
 // an error is returned unless the -allow-unknown-users flag is set.
 var currentUser = func(r *http.Request) (string, error) {
+	if login, ok := tokenUser(r); ok {
+		return login, nil
+	}
 	if devMode() {
 		return "foo@example.com", nil
 	}
@@ -521,9 +1189,89 @@ func userExists(ctx context.Context, login string) (bool, error) {
 	return true, nil
 }
 
-var reShortName = regexp.MustCompile(`^\w[\w\-\.]*$`)
+// reShortName matches valid short names: one or more slash-separated
+// segments, each starting with a letter or number.
+var reShortName = regexp.MustCompile(`^\w[\w\-\.]*(/\w[\w\-\.]*)*$`)
+
+// maxShortSegments is the maximum number of slash-separated segments in a
+// short name.
+const maxShortSegments = 4
+
+// validShortName reports whether short is a valid short name: one matching
+// reShortName, with no more segments than loadLink tries.
+func validShortName(short string) bool {
+	return reShortName.MatchString(short) && strings.Count(short, "/") < maxShortSegments
+}
+
+// validateLink returns an error if short isn't a valid short name, or long
+// isn't a valid destination for it.
+func validateLink(short, long string) error {
+	if !validShortName(short) {
+		return fmt.Errorf("short may only contain letters, numbers, dash, and period, with up to %d segments separated by slashes", maxShortSegments)
+	}
+	return validateLong(long)
+}
+
+// validateLong returns an error if long isn't a link template that parses,
+// or is a URL that browsers run as script rather than navigate to.
+func validateLong(long string) error {
+	if _, err := parseLinkTemplate(long); err != nil {
+		return fmt.Errorf("long contains an invalid template: %v", err)
+	}
+	if scheme, _, ok := strings.Cut(long, ":"); ok {
+		// browsers ignore whitespace and control characters in schemes
+		scheme = strings.ToLower(strings.Map(func(r rune) rune {
+			if r <= ' ' {
+				return -1
+			}
+			return r
+		}, scheme))
+		switch scheme {
+		case "javascript", "vbscript", "data":
+			return fmt.Errorf("long may not be a %s: URL", scheme)
+		}
+	}
+	return nil
+}
+
+// loadLink returns the link whose short name is the longest prefix of path
+// made up of whole path segments, along with that short name and the
+// unmatched remainder of path. For example, if go/team and go/team/infra
+// both exist, "team/infra/oncall" loads go/team/infra with remainder
+// "oncall", and "team/web" loads go/team with remainder "web".
+//
+// If pending is non-nil, it is used in place of the stored link with the same
+// ID. If no prefix of path is a link, loadLink returns fs.ErrNotExist with
+// short set to the first path segment.
+func loadLink(t *tenant, path string, pending *Link) (link *Link, short, remainder string, err error) {
+	segments := strings.SplitN(path, "/", maxShortSegments+1)
+	n := len(segments)
+	if n > maxShortSegments {
+		n = maxShortSegments
+	}
+	for i := n; i > 0; i-- {
+		if segments[i-1] == "" {
+			continue
+		}
+		short = strings.Join(segments[:i], "/")
+		remainder = strings.TrimPrefix(path[len(short):], "/")
+		if pending != nil && linkID(short) == linkID(pending.Short) {
+			return pending, short, remainder, nil
+		}
+		link, err = t.db().Load(short)
+		if err == nil {
+			return link, short, remainder, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, short, remainder, err
+		}
+	}
+	short, remainder, _ = strings.Cut(path, "/")
+	return nil, short, remainder, fs.ErrNotExist
+}
 
 func serveDelete(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
 	short := strings.TrimPrefix(r.RequestURI, "/.delete/")
 	if short == "" {
 		http.Error(w, "short required", http.StatusBadRequest)
@@ -536,27 +1284,46 @@ func serveDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	link, err := db.Load(short)
+	link, err := t.db().Load(short)
 	if errors.Is(err, fs.ErrNotExist) {
 		http.NotFound(w, r)
 		return
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if link.Owner != login {
+	if link.Locked && !t.isAdmin(login) {
+		http.Error(w, "link is locked; only an admin can delete it", http.StatusForbidden)
+		return
+	}
+	if !isOwner(link, login) && !t.isAdmin(login) {
 		http.Error(w, "cannot delete link owned by another user", http.StatusForbidden)
 		return
 	}
 
-	if !xsrftoken.Valid(r.PostFormValue("xsrf"), xsrfKey, login, short) {
+	if !validXSRF(r, r.PostFormValue("xsrf"), login, short) {
 		http.Error(w, "invalid XSRF token", http.StatusBadRequest)
 		return
 	}
 
-	if err := db.Delete(short); err != nil {
+	aliases, err := t.db().LoadAliases(short)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	deleteLinkStats(link)
+	if len(aliases) > 0 {
+		http.Error(w, fmt.Sprintf("cannot delete link with %d aliases; delete or update its aliases first", len(aliases)), http.StatusConflict)
+		return
+	}
+
+	if err := t.db().Delete(short); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deleteLinkStats(t, link)
+	requestActor(r).record(t, auditLinkDelete, link.Short, link, nil)
 
 	deleteTmpl.Execute(w, link)
 }
@@ -564,18 +1331,22 @@ func serveDelete(w http.ResponseWriter, r *http.Request) {
 // serveSave handles requests to save or update a Link.  Both short name and
 // long URL are validated for proper format. Existing links may only be updated
 // by their owner.
+//
+// If an "alias_of" value is provided, the link is saved as an alias of that
+// link instead, and long is ignored.
 func serveSave(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
 	short, long := r.FormValue("short"), r.FormValue("long")
-	if short == "" || long == "" {
-		http.Error(w, "short and long required", http.StatusBadRequest)
-		return
+	aliasOf := strings.TrimSpace(r.FormValue("alias_of"))
+	if aliasOf != "" {
+		long = ""
 	}
-	if !reShortName.MatchString(short) {
-		http.Error(w, "short may only contain letters, numbers, dash, and period", http.StatusBadRequest)
+	if short == "" || (long == "" && aliasOf == "") {
+		http.Error(w, "short and long required", http.StatusBadRequest)
 		return
 	}
-	if _, err := texttemplate.New("").Funcs(expandFuncMap).Parse(long); err != nil {
-		http.Error(w, fmt.Sprintf("long contains an invalid template: %v", err), http.StatusBadRequest)
+	if err := validateLink(short, long); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -585,13 +1356,18 @@ func serveSave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	link, err := db.Load(short)
+	link, err := t.db().Load(short)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if link != nil && link.Owner != "" && link.Owner != login {
-		exists, err := userExists(r.Context(), link.Owner)
+	if link != nil && link.Locked && !t.isAdmin(login) {
+		http.Error(w, "link is locked; only an admin can change it", http.StatusForbidden)
+		return
+	}
+	if link != nil && link.Owner != "" && !isOwner(link, login) && !t.isAdmin(login) {
+		exists, err := ownerExists(r.Context(), link.Owner)
 		if err != nil {
 			log.Printf("looking up tailnet user %q: %v", link.Owner, err)
 		}
@@ -603,37 +1379,106 @@ func serveSave(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// allow transferring ownership to valid users. If empty, set owner to current user.
+	// allow transferring ownership to valid users and groups. If empty, set
+	// owner to current user, unless they own the link through its group.
 	owner := r.FormValue("owner")
 	if owner != "" {
-		exists, err := userExists(r.Context(), owner)
+		exists, err := ownerExists(r.Context(), owner)
 		if err != nil {
 			log.Printf("looking up tailnet user %q: %v", owner, err)
 		}
 		if !exists {
-			http.Error(w, "new owner not a valid user: "+owner, http.StatusBadRequest)
+			http.Error(w, "new owner not a valid user or group: "+owner, http.StatusBadRequest)
 			return
 		}
+	} else if link != nil && strings.HasPrefix(link.Owner, groupPrefix) && isOwner(link, login) {
+		owner = link.Owner
 	} else {
 		owner = login
 	}
 
+	if aliasOf != "" {
+		canonical, err := aliasTarget(t, short, aliasOf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		aliasOf = canonical.Short
+		if link != nil {
+			aliases, err := t.db().LoadAliases(short)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(aliases) > 0 {
+				http.Error(w, "a link with aliases cannot itself be an alias", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	now := time.Now().UTC()
+	action := auditLinkUpdate
+	var before *Link
 	if link == nil {
+		action = auditLinkCreate
 		link = &Link{
 			Short:   short,
 			Created: now,
 		}
+	} else {
+		c := *link
+		before = &c
 	}
 	link.ID = linkID(short)
 	link.Short = short
 	link.Long = long
+	link.AliasOf = aliasOf
 	link.LastEdit = now
 	link.Owner = owner
-	if err := db.Save(link); err != nil {
+	if v, ok := optionalFormValue(r, "description"); ok {
+		link.Description = strings.TrimSpace(v)
+	}
+	if v, ok := optionalFormValue(r, "tags"); ok {
+		tags, err := parseTags(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		link.Tags = tags
+	}
+	if v, ok := optionalFormValue(r, "query_mode"); ok {
+		if !validQueryMode(v) {
+			http.Error(w, "query_mode must be empty, \"pass\", \"merge\", or \"drop\"", http.StatusBadRequest)
+			return
+		}
+		link.QueryMode = v
+	}
+	if err := setRedirectOptions(r, link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := setActiveTimes(r, link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := setLinkState(r, link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := setVisibility(r, link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkLinkChain(t, link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := t.db().Save(link); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	requestActor(r).record(t, action, link.Short, before, link)
 
 	if acceptHTML(r) {
 		successTmpl.Execute(w, homeData{Short: short})
@@ -643,53 +1488,516 @@ func serveSave(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// serveExport prints a snapshot of the link database. Links are JSON encoded
-// and printed one per line. This format is used to restore link snapshots on
-// startup.
-func serveExport(w http.ResponseWriter, _ *http.Request) {
+// aliasTarget returns the canonical link that a new alias named short
+// pointing at aliasOf should resolve to. Aliases of aliases are flattened to
+// point at the canonical link directly, and aliases of short itself are
+// rejected.
+func aliasTarget(t *tenant, short, aliasOf string) (*Link, error) {
+	target, err := t.db().Load(aliasOf)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("alias target go/%s does not exist", aliasOf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := canonicalLink(t, target)
+	if err != nil {
+		return nil, err
+	}
+	if linkID(canonical.Short) == linkID(short) {
+		return nil, fmt.Errorf("go/%s cannot be an alias of itself", short)
+	}
+	return canonical, nil
+}
+
+// formTimeLayout is the layout used by datetime-local form inputs.
+// Times entered in forms are interpreted as UTC.
+const formTimeLayout = "2006-01-02T15:04"
+
+// optionalFormValue returns the first value for key in the request form, and
+// whether key was present at all. Absent keys leave stored values untouched,
+// while empty values clear them.
+func optionalFormValue(r *http.Request, key string) (string, bool) {
+	r.FormValue(key) // ensure the form is parsed
+	vs, ok := r.Form[key]
+	if !ok || len(vs) == 0 {
+		return "", false
+	}
+	return vs[0], true
+}
+
+// parseFormTime parses a time from a form value, accepting either RFC 3339
+// or the datetime-local input format. An empty value returns the zero time.
+func parseFormTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(formTimeLayout, v)
+}
+
+// setRedirectOptions updates the Status and Preview fields of link from the
+// "status" and "preview" request values, if present. An empty status uses
+// the default redirect status.
+func setRedirectOptions(r *http.Request, link *Link) error {
+	if v, ok := optionalFormValue(r, "status"); ok {
+		status := 0
+		if v != "" {
+			var err error
+			if status, err = strconv.Atoi(v); err != nil || !validRedirectStatus(status) {
+				return fmt.Errorf("status must be one of %v", redirectStatuses)
+			}
+		}
+		link.Status = status
+	}
+	if v, ok := optionalFormValue(r, "preview"); ok {
+		preview, err := parseFormBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid preview value: %v", err)
+		}
+		link.Preview = preview
+	}
+	return nil
+}
+
+// setLinkState updates the Disabled, DisabledReason, and Locked fields of
+// link from the "disabled", "disabled_reason", and "locked" request values,
+// if present. Disabled links must have a reason.
+func setLinkState(r *http.Request, link *Link) error {
+	if v, ok := optionalFormValue(r, "disabled"); ok {
+		disabled, err := parseFormBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid disabled value: %v", err)
+		}
+		link.Disabled = disabled
+	}
+	if v, ok := optionalFormValue(r, "disabled_reason"); ok {
+		link.DisabledReason = strings.TrimSpace(v)
+	}
+	if link.Disabled && link.DisabledReason == "" {
+		return errors.New("disabled_reason required when disabling a link")
+	}
+	if v, ok := optionalFormValue(r, "locked"); ok {
+		locked, err := parseFormBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid locked value: %v", err)
+		}
+		link.Locked = locked
+	}
+	return nil
+}
+
+// parseFormBool parses a boolean form value. An empty value is false, so
+// that a checkbox can be paired with an empty hidden input of the same name
+// to send a value when it is unchecked.
+func parseFormBool(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// setActiveTimes updates the ActiveFrom and ExpiresAt fields of link from the
+// "active_from" and "expires_at" request values, if present.
+func setActiveTimes(r *http.Request, link *Link) error {
+	if v, ok := optionalFormValue(r, "active_from"); ok {
+		t, err := parseFormTime(v)
+		if err != nil {
+			return fmt.Errorf("invalid active_from time: %v", err)
+		}
+		link.ActiveFrom = t
+	}
+	if v, ok := optionalFormValue(r, "expires_at"); ok {
+		t, err := parseFormTime(v)
+		if err != nil {
+			return fmt.Errorf("invalid expires_at time: %v", err)
+		}
+		link.ExpiresAt = t
+	}
+	if !link.ActiveFrom.IsZero() && !link.ExpiresAt.IsZero() && !link.ExpiresAt.After(link.ActiveFrom) {
+		return errors.New("expires_at must be after active_from")
+	}
+	return nil
+}
+
+// exportBatchSize is the number of links loaded at a time by serveExport.
+const exportBatchSize = 1000
+
+// serveExport prints a snapshot of the link database, sorted by ID. By
+// default, links are JSON encoded and printed one per line. This format is
+// read by golink import to restore link snapshots. The "format" request value
+// selects another format: "csv", "yaml", or "html" for a bookmark file
+// browsers can import.
+//
+// Links are loaded and written in batches, so large databases aren't held
+// in memory. Admins are sent every link. Other users are only sent the links
+// listed for them.
+func serveExport(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	format, err := parseFormat(r.FormValue("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err := flushStats(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	links, err := db.LoadAll()
+	login, _ := currentUser(r)
+	var keep func(*Link) bool
+	if !t.isAdmin(login) {
+		keep = func(link *Link) bool { return isListed(t, link, login) }
+	}
+
+	// load the first batch before writing, so errors can still be reported
+	page := LinkPage{Limit: exportBatchSize}
+	links, after, err := loadPage(t, page, keep)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	sort.Slice(links, func(i, j int) bool {
-		return links[i].Short < links[j].Short
-	})
-	encoder := json.NewEncoder(w)
-	for _, link := range links {
-		if err := encoder.Encode(link); err != nil {
-			panic(http.ErrAbortHandler)
+	if format != formatJSONL {
+		w.Header().Set("Content-Type", exportFormats[format].contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "links."+exportFormats[format].ext))
+	}
+	next := func() ([]*Link, error) {
+		batch := links
+		if batch == nil && after != "" {
+			page.After = after
+			if batch, after, err = loadPage(t, page, keep); err != nil {
+				return nil, err
+			}
+		}
+		links = nil
+		return batch, nil
+	}
+	if err := streamLinks(w, format, t.Hostname, next); err != nil {
+		log.Printf("exporting links: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// serveStats returns the number of times each link has been visited, most
+// visited first, as JSON. Only the links listed for the current user are
+// included, unless they are an admin. Links are loaded in batches, sorted by
+// the database's sum of their clicks.
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	if err := flushStats(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	login, _ := currentUser(r)
+	var keep func(*Link) bool
+	if !t.isAdmin(login) {
+		keep = func(link *Link) bool { return isListed(t, link, login) }
+	}
+
+	visits := []visitData{}
+	page := LinkPage{Sort: "clicks", Desc: true, Limit: exportBatchSize}
+	for {
+		links, next, err := loadPage(t, page, keep)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats.mu.Lock()
+		for _, link := range links {
+			visits = append(visits, visitData{Short: link.Short, NumClicks: stats.clicks[t.statsKey(link.Short)]})
+		}
+		stats.mu.Unlock()
+		if next == "" {
+			break
 		}
+		page.After = next
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(visits)
+}
+
+// importData is the response to a request to /.import.
+type importData struct {
+	Imported int
 }
 
-func resolveLink(link string) (string, error) {
+// importXSRFAction is the XSRF action for importing links.
+const importXSRFAction = ".import"
+
+// serveImport saves the posted links that don't already exist, or updates
+// existing links too if the "update" request value is set. Links are read
+// from the uploaded "file", or the request body, in any of the formats written
+// by serveExport, named by the "format" request value or the file's
+// extension.
+//
+// Only admins can import links, since imported links keep their owners.
+func serveImport(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !t.isAdmin(login) {
+		http.Error(w, "only admins can import links", http.StatusForbidden)
+		return
+	}
+	if !validXSRF(r, r.FormValue("xsrf"), login, importXSRFAction) {
+		http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+		return
+	}
+	format, err := parseFormat(r.FormValue("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	update, err := parseFormBool(r.FormValue("update"))
+	if err != nil {
+		http.Error(w, "invalid update value", http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if file, header, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		body = file
+		if r.FormValue("format") == "" {
+			format = formatOfFile(header.Filename)
+		}
+	}
+
+	n, err := importLinks(t, body, format, update, requestActor(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("imported %d links, then: %v", n, err), http.StatusBadRequest)
+		return
+	}
+	if acceptHTML(r) {
+		http.Redirect(w, r, fmt.Sprintf("/.all?imported=%d", n), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(importData{Imported: n})
+}
+
+// importLinks reads links in format from r and saves those that don't
+// already exist in t. If update is set, existing links are updated with the
+// fields that were read instead. It returns the number of links saved, which
+// are recorded in the audit log as imported by actor.
+//
+// The links are saved in one transaction, so nothing is saved if any of the
+// links can't be read, validated, or saved, or new links lack a destination.
+func importLinks(t *tenant, r io.Reader, format string, update bool, actor auditActor) (int, error) {
+	links, err := readLinks(r, format)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	var changed, before []*Link
+	for _, l := range links {
+		link := l.link
+		existing, err := t.db().Load(link.Short)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, err
+		}
+		var prev *Link
+		if existing != nil {
+			if !update {
+				continue
+			}
+			c := *existing
+			prev = &c
+			if link = updateImported(existing, l, now); link == nil {
+				continue // unchanged
+			}
+		} else if l.columns != nil {
+			if link.Long == "" && link.AliasOf == "" {
+				return 0, fmt.Errorf("%s: long required for new links", link.Short)
+			}
+			if link.Created.IsZero() {
+				link.Created = now
+			}
+			if link.LastEdit.IsZero() {
+				link.LastEdit = now
+			}
+		}
+		if err := validateImported(link); err != nil {
+			return 0, err
+		}
+		changed = append(changed, link)
+		before = append(before, prev)
+	}
+
+	if len(changed) == 0 {
+		return 0, nil
+	}
+	if err := t.db().SaveLinks(changed); err != nil {
+		return 0, err
+	}
+	for i, link := range changed {
+		actor.record(t, auditLinkImport, link.Short, before[i], link)
+	}
+	return len(changed), nil
+}
+
+// updateImported returns link updated with the fields of the imported link l,
+// or nil if that doesn't change it. Links in the JSON Lines format replace the
+// existing link, other than its creation time.
+func updateImported(link *Link, l importedLink, now time.Time) *Link {
+	if l.columns == nil {
+		updated := *l.link
+		updated.Model = link.Model
+		updated.Created = link.Created
+		return &updated
+	}
+	var changed bool
+	for _, name := range l.columns {
+		if name == "short" || name == "created" || name == "last_edit" {
+			continue
+		}
+		c, _ := columnByName(name)
+		if v := c.get(l.link); v != c.get(link) {
+			c.set(link, v)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	link.LastEdit = now
+	return link
+}
+
+// validateImported returns an error if the imported link isn't one that
+// serveSave, or savePersonal for personal links, would save. Personal links
+// may only be imported for the user that owns them.
+func validateImported(link *Link) error {
+	short := link.Short
+	if login, name, ok := cutPersonal(short); ok {
+		if link.Owner != login {
+			return fmt.Errorf("%s: personal links must be owned by %s", link.Short, login)
+		}
+		short = personalPrefix + name
+	}
+	if err := validateLink(short, link.Long); err != nil {
+		return fmt.Errorf("%s: %v", link.Short, err)
+	}
+	return nil
+}
+
+// maxLinkDepth is the maximum number of go links followed when resolving a
+// link whose destination is another go link.
+const maxLinkDepth = 8
+
+// linkChainError is returned when following go links that point to other go
+// links loops back on itself, or exceeds maxLinkDepth.
+type linkChainError struct {
+	// Chain is the short names followed, in order. For loops, the last
+	// element is the name that was already visited.
+	Chain []string
+	Loop  bool
+}
+
+func (e *linkChainError) Error() string {
+	chain := "go/" + strings.Join(e.Chain, " -> go/")
+	if e.Loop {
+		return "link loop: " + chain
+	}
+	return fmt.Sprintf("link chain longer than %d links: %s", maxLinkDepth, chain)
+}
+
+// visitLink returns chain with short appended, or a linkChainError if short
+// was already visited or chain is already at its maximum length.
+func visitLink(chain []string, short string) ([]string, error) {
+	for _, visited := range chain {
+		if linkID(visited) == linkID(short) {
+			return nil, &linkChainError{Chain: append(chain[:len(chain):len(chain)], short), Loop: true}
+		}
+	}
+	if len(chain) >= maxLinkDepth {
+		return nil, &linkChainError{Chain: append(chain[:len(chain):len(chain)], short)}
+	}
+	return append(chain, short), nil
+}
+
+// isLocalLink reports whether dst is a URL on t's hostname.
+func isLocalLink(t *tenant, dst string) bool {
+	u, err := url.Parse(dst)
+	return err == nil && (u.Hostname() == "" || u.Hostname() == t.Hostname)
+}
+
+func resolveLink(t *tenant, link string) (string, error) {
+	return followLinks(t, link, nil, nil)
+}
+
+// followLinks resolves link, following destinations that are themselves go
+// links. The chain holds the short names already followed. If pending is
+// non-nil, it is used in place of the stored link with the same ID, so that a
+// link can be checked before it is saved.
+func followLinks(t *tenant, link string, chain []string, pending *Link) (string, error) {
 	// if link specified as "go/name", trim "go" prefix.
 	// Remainder will parse as URL with no scheme or host
-	link = strings.TrimPrefix(link, *hostname)
+	if rest, ok := strings.CutPrefix(link, t.Hostname+"/"); ok {
+		link = "/" + rest
+	}
 	u, err := url.Parse(link)
 	if err != nil {
 		return "", err
 	}
-	short, remainder, _ := strings.Cut(strings.TrimPrefix(u.RequestURI(), "/"), "/")
-	l, err := db.Load(short)
+	path := strings.TrimPrefix(u.EscapedPath(), "/")
+	l, short, remainder, err := loadLink(t, path, pending)
+	var match map[string]string
+	if errors.Is(err, fs.ErrNotExist) {
+		if l, match, err = loadPatternLink(t, path); err == nil {
+			short, remainder = path, ""
+		}
+	}
 	if err != nil {
 		return "", err
 	}
-	dst, err := expandLink(l.Long, expandEnv{Now: time.Now().UTC(), Path: remainder})
-	if err == nil {
-		if u, uErr := url.Parse(dst); uErr == nil && (u.Hostname() == "" || u.Hostname() == *hostname) {
-			dst, err = resolveLink(dst)
-		}
+	if chain, err = visitLink(chain, short); err != nil {
+		return "", err
+	}
+	if l, err = canonicalLink(t, l); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	if l.Disabled {
+		return "", fmt.Errorf("go/%s: %s", l.Short, disabledReason(l))
+	}
+	if !l.activeAt(now) {
+		return "", fmt.Errorf("go/%s: %s", l.Short, inactiveReason(l, now))
+	}
+	dst, err := expandLink(l.Long, expandEnv{Now: now, Path: remainder, Query: newTemplateQuery(u.Query()), Match: match, queryMode: l.QueryMode})
+	if err == nil && isLocalLink(t, dst) {
+		dst, err = followLinks(t, dst, chain, pending)
 	}
 	return dst, err
 }
 
+// checkLinkChain returns a linkChainError if saving link would create a loop
+// of go links, or a chain longer than maxLinkDepth. Destinations are
+// expanded with an empty path, so loops that only occur for some paths are
+// caught when the link is resolved instead.
+func checkLinkChain(t *tenant, link *Link) error {
+	_, err := followLinks(t, link.Short, nil, link)
+	var chainErr *linkChainError
+	if errors.As(err, &chainErr) {
+		return chainErr
+	}
+	return nil
+}
+
 func loadDBConfig() (Config, error) {
 	config := Config{}
 	// load .env file
@@ -4,7 +4,9 @@
 package golink
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"net/http"
 	"net/http/httptest"
@@ -29,18 +31,55 @@ func TestServeGo(t *testing.T) {
 		"who":         {Short: "who", Long: "http://who/"},
 		"me":          {Short: "me", Long: "/who/{{.User}}"},
 		"invalid-var": {Short: "invalid-var", Long: "/who/{{.Invalid}}"},
+		"expired":     {Short: "expired", Long: "http://who/", ExpiresAt: time.Now().Add(-time.Hour)},
+		"scheduled":   {Short: "scheduled", Long: "http://who/", ActiveFrom: time.Now().Add(time.Hour)},
+		"whom":        {Short: "whom", AliasOf: "who"},
+		"dangling":    {Short: "dangling", AliasOf: "deleted"},
+		"loop-a":      {Short: "loop-a", AliasOf: "loop-b"},
+		"loop-b":      {Short: "loop-b", AliasOf: "loop-a"},
+		"chain-a":     {Short: "chain-a", Long: "/chain-b"},
+		"chain-b":     {Short: "chain-b", Long: "http://go/chain-a"},
+		"team":        {Short: "team", Long: "http://wiki/teams/"},
+		"team/infra":  {Short: "team/infra", Long: "http://infra/"},
+		"ops-1":       {Short: "ops-1", Long: "http://ops/"},
+		"incident":    {Short: "incident", Long: "http://doc/", Disabled: true, DisabledReason: "leaked document"},
+		"moved":       {Short: "moved", Long: "http://new/", Status: http.StatusMovedPermanently},
+		"sensitive":   {Short: "sensitive", Long: "http://secret/", Owner: "foo@example.com", Preview: true},
+		"bug":         {Short: "bug", Long: `http://bugs/{{.Query.Get "id"}}`, QueryMode: queryModePass},
+		"hidden":      {Short: "hidden", Long: "http://hidden/", Visibility: visibilityUnlisted},
+		"payroll":     {Short: "payroll", Long: "http://payroll/", Visibility: visibilityRestricted, AllowedUsers: Principals{"foo@example.com"}},
+		"board":       {Short: "board", Long: "http://board/", Visibility: visibilityRestricted, AllowedUsers: Principals{"bar@example.com"}},
+		"boardroom":   {Short: "boardroom", AliasOf: "board"},
 	}
 
 	db = NewMockDatabase(ctrl)
+	var all []*Link
+	for _, link := range links {
+		all = append(all, link)
+	}
+	db.(*MockDatabase).EXPECT().LoadAll().Return(all, nil).AnyTimes()
+	// suggestions are searched by trigram similarity, as on Postgres
+	db.(*MockDatabase).EXPECT().Search(gomock.Any()).Return(all, nil).AnyTimes()
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			return link, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return([]*Pattern{
+		{Regexp: `(?i)(?P<key>[a-z]+-[0-9]+)`, Long: `https://jira/browse/{{ToUpper .Match.key}}`},
+		{Regexp: `pr(?P<num>[0-9]+)`, Long: `https://github/pull/{{.Match.num}}`},
+	}, nil).AnyTimes()
 
 	tests := []struct {
 		name        string
 		link        string
 		short       string
 		currentUser func(*http.Request) (string, error)
+		html        bool // whether the request accepts HTML
 		wantStatus  int
 		wantLink    string
-		shouldErr   bool
+		wantBody    string
 	}{
 		{
 			name:       "simple link",
@@ -68,9 +107,15 @@ func TestServeGo(t *testing.T) {
 			name:       "unknown link",
 			link:       "/does-not-exist",
 			short:      "does-not-exist",
-			shouldErr:  true,
 			wantStatus: http.StatusNotFound,
 		},
+		{
+			name:       "unknown link with suggestion",
+			link:       "/hwo/amelie",
+			short:      "hwo",
+			wantStatus: http.StatusNotFound,
+			wantBody:   `href="/who/amelie"`,
+		},
 		{
 			name:       "unknown variable",
 			link:       "/invalid-var",
@@ -84,6 +129,161 @@ func TestServeGo(t *testing.T) {
 			currentUser: func(*http.Request) (string, error) { return "", nil },
 			wantStatus:  http.StatusUnauthorized,
 		},
+		{
+			name:       "expired link",
+			link:       "/expired",
+			short:      "expired",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "link not yet active",
+			link:       "/scheduled",
+			short:      "scheduled",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "nested short name",
+			link:       "/team/infra/oncall",
+			short:      "team/infra",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://infra/oncall",
+		},
+		{
+			name:       "parent of nested short name",
+			link:       "/team/web/oncall",
+			short:      "team",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://wiki/teams/web/oncall",
+		},
+		{
+			name:       "nested short name details",
+			link:       "/team/infra+",
+			short:      "team/infra",
+			wantStatus: http.StatusFound,
+			wantLink:   "/.detail/team/infra",
+		},
+		{
+			name:       "alias",
+			link:       "/whom/amelie",
+			short:      "whom",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://who/amelie",
+		},
+		{
+			name:       "alias of deleted link",
+			link:       "/dangling",
+			short:      "dangling",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "alias loop",
+			link:       "/loop-a",
+			short:      "loop-a",
+			wantStatus: http.StatusLoopDetected,
+		},
+		{
+			name:       "chained link loop",
+			link:       "/chain-a/foo",
+			short:      "chain-a",
+			wantStatus: http.StatusLoopDetected,
+		},
+		{
+			name:       "pattern link",
+			link:       "/proj-123",
+			short:      "proj-123",
+			wantStatus: http.StatusFound,
+			wantLink:   "https://jira/browse/PROJ-123",
+		},
+		{
+			name:       "second pattern link",
+			link:       "/pr42",
+			short:      "pr42",
+			wantStatus: http.StatusFound,
+			wantLink:   "https://github/pull/42",
+		},
+		{
+			name:       "link takes precedence over pattern",
+			link:       "/ops-1",
+			short:      "ops-1",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://ops/",
+		},
+		{
+			name:       "disabled link",
+			link:       "/incident",
+			short:      "incident",
+			wantStatus: http.StatusGone,
+			wantBody:   "leaked document",
+		},
+		{
+			name:       "permanent redirect",
+			link:       "/moved/foo",
+			short:      "moved",
+			wantStatus: http.StatusMovedPermanently,
+			wantLink:   "http://new/foo",
+		},
+		{
+			name:       "always preview",
+			link:       "/sensitive",
+			short:      "sensitive",
+			wantStatus: http.StatusOK,
+			wantBody:   `href="http://secret/"`,
+		},
+		{
+			name:       "preview in browser",
+			link:       "/who+/amelie",
+			short:      "who",
+			html:       true,
+			wantStatus: http.StatusOK,
+			wantBody:   `href="http://who/amelie"`,
+		},
+		{
+			name:       "details for non-browser",
+			link:       "/who+/amelie",
+			short:      "who",
+			wantStatus: http.StatusFound,
+			wantLink:   "/.detail/who",
+		},
+		{
+			name:       "query passed",
+			link:       "/who?q=amelie",
+			short:      "who",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://who/?q=amelie",
+		},
+		{
+			name:       "query used and passed",
+			link:       "/bug?id=123&tab=info",
+			short:      "bug",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://bugs/123?tab=info",
+		},
+		{
+			name:       "unlisted link",
+			link:       "/hidden",
+			short:      "hidden",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://hidden/",
+		},
+		{
+			name:       "restricted link, allowed user",
+			link:       "/payroll",
+			short:      "payroll",
+			wantStatus: http.StatusFound,
+			wantLink:   "http://payroll/",
+		},
+		{
+			name:       "restricted link, other user",
+			link:       "/board",
+			short:      "board",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "alias of restricted link",
+			link:       "/boardroom",
+			short:      "boardroom",
+			wantStatus: http.StatusForbidden,
+		},
 	}
 
 	for _, tt := range tests {
@@ -97,21 +297,10 @@ func TestServeGo(t *testing.T) {
 			}
 
 			r := httptest.NewRequest("GET", tt.link, nil)
-			w := httptest.NewRecorder()
-
-			var result interface{}
-			var err error
-			if tt.shouldErr {
-				err = fs.ErrNotExist
-			} else {
-				result = links[tt.short]
+			if tt.html {
+				r.Header.Set("Accept", "text/html")
 			}
-
-			db.(*MockDatabase).
-				EXPECT().
-				Load(tt.short).
-				Return(result, err)
-
+			w := httptest.NewRecorder()
 			serveGo(w, r)
 
 			if w.Code != tt.wantStatus {
@@ -120,6 +309,9 @@ func TestServeGo(t *testing.T) {
 			if gotLink := w.Header().Get("Location"); gotLink != tt.wantLink {
 				t.Errorf("serveGo(%q) = %q; want %q", tt.link, gotLink, tt.wantLink)
 			}
+			if tt.wantBody != "" && !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("serveGo(%q) body does not contain %q", tt.link, tt.wantBody)
+			}
 		})
 	}
 }
@@ -129,12 +321,14 @@ func TestServeSave(t *testing.T) {
 	defer ctrl.Finish()
 
 	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
 
 	tests := []struct {
 		name              string
 		short             string
 		long              string
 		allowUnknownUsers bool
+		loadErr           error
 		currentUser       func(*http.Request) (string, error)
 		wantStatus        int
 	}{
@@ -150,6 +344,18 @@ func TestServeSave(t *testing.T) {
 			long:       "http://who/",
 			wantStatus: http.StatusBadRequest,
 		},
+		{
+			name:       "too many segments",
+			short:      "a/b/c/d/e",
+			long:       "http://who/",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "script URL",
+			short:      "who",
+			long:       "java\tscript:alert(1)",
+			wantStatus: http.StatusBadRequest,
+		},
 		{
 			name:       "save simple link",
 			short:      "who",
@@ -163,6 +369,13 @@ func TestServeSave(t *testing.T) {
 			currentUser: func(*http.Request) (string, error) { return "bar@example.com", nil },
 			wantStatus:  http.StatusForbidden,
 		},
+		{
+			name:       "load error",
+			short:      "who",
+			long:       "http://who/",
+			loadErr:    errors.New("database is down"),
+			wantStatus: http.StatusInternalServerError,
+		},
 		{
 			name:        "disallow unknown users",
 			short:       "who2",
@@ -202,6 +415,11 @@ func TestServeSave(t *testing.T) {
 					Load(tt.short).
 					Return(link, err)
 			}
+			if tt.loadErr != nil {
+				db.(*MockDatabase).EXPECT().
+					Load(tt.short).
+					Return(nil, tt.loadErr)
+			}
 
 			if tt.wantStatus == http.StatusOK {
 				db.(*MockDatabase).EXPECT().
@@ -240,6 +458,7 @@ func TestServeDelete(t *testing.T) {
 	defer ctrl.Finish()
 
 	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
 	links := map[string]*Link{
 		"a":   {Short: "a", Owner: "a@example.com"},
 		"foo": {Short: "foo", Owner: "foo@example.com"},
@@ -253,6 +472,7 @@ func TestServeDelete(t *testing.T) {
 		name        string
 		short       string
 		xsrf        string
+		loadErr     error
 		currentUser func(*http.Request) (string, error)
 		wantStatus  int
 	}{
@@ -266,6 +486,12 @@ func TestServeDelete(t *testing.T) {
 			short:      "does-not-exist",
 			wantStatus: http.StatusNotFound,
 		},
+		{
+			name:       "load error",
+			short:      "foo",
+			loadErr:    errors.New("database is down"),
+			wantStatus: http.StatusInternalServerError,
+		},
 		{
 			name:       "unowned link",
 			short:      "a",
@@ -301,6 +527,9 @@ func TestServeDelete(t *testing.T) {
 				if link == nil {
 					err = fs.ErrNotExist
 				}
+				if tt.loadErr != nil {
+					link, err = nil, tt.loadErr
+				}
 
 				db.(*MockDatabase).EXPECT().
 					Load(tt.short).
@@ -308,6 +537,9 @@ func TestServeDelete(t *testing.T) {
 			}
 
 			if tt.wantStatus == http.StatusOK {
+				db.(*MockDatabase).EXPECT().
+					LoadAliases(tt.short).
+					Return(nil, nil)
 				db.(*MockDatabase).EXPECT().
 					Delete(tt.short).
 					Return(nil)
@@ -332,13 +564,15 @@ func TestServeDelete(t *testing.T) {
 
 func TestExpandLink(t *testing.T) {
 	tests := []struct {
-		name      string    // test name
-		long      string    // long URL for golink
-		now       time.Time // current time
-		user      string    // current user resolving link
-		remainder string    // remainder of URL path after golink name
-		wantErr   bool      // whether we expect an error
-		want      string    // expected redirect URL
+		name      string     // test name
+		long      string     // long URL for golink
+		now       time.Time  // current time
+		user      string     // current user resolving link
+		remainder string     // remainder of URL path after golink name
+		query     url.Values // query of the incoming request
+		queryMode string     // QueryMode of the golink
+		wantErr   bool       // whether we expect an error
+		want      string     // expected redirect URL
 	}{
 		{
 			name: "dont-mangle-escapes",
@@ -414,10 +648,61 @@ func TestExpandLink(t *testing.T) {
 			remainder: "a/",
 			want:      "http://host.com/a",
 		},
+		{
+			name:  "query-get",
+			long:  `http://host.com/search?q={{QueryEscape (.Query.Get "q")}}`,
+			query: url.Values{"q": {"a b"}},
+			want:  "http://host.com/search?q=a+b",
+		},
+		{
+			name:  "query-has",
+			long:  `http://host.com/{{if .Query.Has "all"}}all{{else}}some{{end}}`,
+			query: url.Values{"all": {""}},
+			want:  "http://host.com/all",
+		},
+		{
+			name:  "query-passed-by-default",
+			long:  "http://host.com/foo",
+			query: url.Values{"a": {"1"}},
+			want:  "http://host.com/foo?a=1",
+		},
+		{
+			name:      "query-dropped",
+			long:      "http://host.com/foo",
+			query:     url.Values{"a": {"1"}},
+			queryMode: queryModeDrop,
+			want:      "http://host.com/foo",
+		},
+		{
+			name:    "malformed-destination",
+			long:    "http://host.com/%zz",
+			wantErr: true,
+		},
+		{
+			name:      "query-pass",
+			long:      "http://host.com/foo?a=0",
+			query:     url.Values{"a": {"1"}, "b": {"2"}},
+			queryMode: queryModePass,
+			want:      "http://host.com/foo?a=0&a=1&b=2",
+		},
+		{
+			name:      "query-merge",
+			long:      "http://host.com/foo?a=0",
+			query:     url.Values{"a": {"1"}, "b": {"2"}},
+			queryMode: queryModeMerge,
+			want:      "http://host.com/foo?a=0&b=2",
+		},
+		{
+			name:      "query-pass-skips-used",
+			long:      `http://host.com/{{.Query.Get "id"}}`,
+			query:     url.Values{"id": {"123"}, "tab": {"info"}},
+			queryMode: queryModePass,
+			want:      "http://host.com/123?tab=info",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := expandLink(tt.long, expandEnv{Now: tt.now, Path: tt.remainder, user: tt.user})
+			got, err := expandLink(tt.long, expandEnv{Now: tt.now, Path: tt.remainder, Query: newTemplateQuery(tt.query), user: tt.user, queryMode: tt.queryMode})
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("expandLink(%q) returned error %v; want %v", tt.long, err, tt.wantErr)
 			}
@@ -439,6 +724,12 @@ func TestResolveLink(t *testing.T) {
 		"m":    {Short: "m", Long: "http://go/meet"},
 		"chat": {Short: "chat", Long: "/meet"},
 	}
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			return link, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
 
 	tests := []struct {
 		link  string
@@ -487,22 +778,17 @@ func TestResolveLink(t *testing.T) {
 			short: "m",
 			want:  "https://meet.google.com/lookup/foo",
 		},
-		// {
-		// 	// aliased go links without hostname
-		// 	link:  "chat/foo",
-		// 	short: "chat",
-		// 	want:  "https://meet.google.com/lookup/foo",
-		// },
+		{
+			// aliased go links without hostname
+			link:  "chat/foo",
+			short: "chat",
+			want:  "https://meet.google.com/lookup/foo",
+		},
 	}
 	for _, tt := range tests {
 		name := "golink " + tt.link
 		t.Run(name, func(t *testing.T) {
-			db.(*MockDatabase).EXPECT().
-				Load(tt.short).
-				Return(links[tt.short], nil).
-				AnyTimes()
-
-			got, err := resolveLink(tt.link)
+			got, err := resolveLink(defaultTenant(), tt.link)
 			if err != nil {
 				t.Error(err)
 			}
@@ -512,3 +798,535 @@ func TestResolveLink(t *testing.T) {
 		})
 	}
 }
+
+func TestSetRedirectOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		link        Link
+		form        url.Values
+		wantStatus  int
+		wantPreview bool
+		wantErr     bool
+	}{
+		{
+			name:        "absent values",
+			link:        Link{Status: 301, Preview: true},
+			form:        url.Values{},
+			wantStatus:  301,
+			wantPreview: true,
+		},
+		{
+			name:        "set values",
+			form:        url.Values{"status": {"308"}, "preview": {"true"}},
+			wantStatus:  308,
+			wantPreview: true,
+		},
+		{
+			name: "clear values",
+			link: Link{Status: 301, Preview: true},
+			form: url.Values{"status": {""}, "preview": {""}},
+		},
+		{
+			name:        "checked checkbox with hidden input",
+			form:        url.Values{"preview": {"true", ""}},
+			wantPreview: true,
+		},
+		{
+			name:    "invalid status",
+			form:    url.Values{"status": {"200"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid preview",
+			form:    url.Values{"preview": {"maybe"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			link := tt.link
+			err := setRedirectOptions(r, &link)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setRedirectOptions() returned error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if link.Status != tt.wantStatus || link.Preview != tt.wantPreview {
+				t.Errorf("setRedirectOptions() = %d, %v; want %d, %v", link.Status, link.Preview, tt.wantStatus, tt.wantPreview)
+			}
+		})
+	}
+}
+
+func TestSetActiveTimes(t *testing.T) {
+	tests := []struct {
+		name           string
+		form           url.Values
+		wantActiveFrom time.Time
+		wantExpiresAt  time.Time
+		wantErr        bool
+	}{
+		{
+			name: "absent values",
+			form: url.Values{},
+		},
+		{
+			name:          "datetime-local",
+			form:          url.Values{"expires_at": {"2022-06-02T15:04"}},
+			wantExpiresAt: time.Date(2022, 6, 2, 15, 4, 0, 0, time.UTC),
+		},
+		{
+			name:           "rfc3339",
+			form:           url.Values{"active_from": {"2022-06-02T15:04:05+02:00"}},
+			wantActiveFrom: time.Date(2022, 6, 2, 13, 4, 5, 0, time.UTC),
+		},
+		{
+			name:    "invalid time",
+			form:    url.Values{"expires_at": {"tomorrow"}},
+			wantErr: true,
+		},
+		{
+			name:    "expires before active",
+			form:    url.Values{"active_from": {"2022-06-02T15:04"}, "expires_at": {"2022-06-01T15:04"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			link := new(Link)
+			err := setActiveTimes(r, link)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setActiveTimes() returned error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !link.ActiveFrom.Equal(tt.wantActiveFrom) || !link.ExpiresAt.Equal(tt.wantExpiresAt) {
+				t.Errorf("setActiveTimes() = %v, %v; want %v, %v", link.ActiveFrom, link.ExpiresAt, tt.wantActiveFrom, tt.wantExpiresAt)
+			}
+		})
+	}
+}
+
+func TestImportLinks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
+	snapshot := `{"Short":"a","Long":"http://a/","Owner":"foo@example.com","Description":"the a link","Tags":["docs","team"]}
+{"Short":"b","Long":"http://b/","Owner":"foo@example.com"}
+{"Short":"","Long":"http://ignored/"}
+`
+	db.(*MockDatabase).EXPECT().Load("a").Return(nil, fs.ErrNotExist)
+	db.(*MockDatabase).EXPECT().Load("b").Return(&Link{Short: "b"}, nil)
+	db.(*MockDatabase).EXPECT().SaveLinks(gomock.Any()).DoAndReturn(func(links []*Link) error {
+		if len(links) != 1 {
+			t.Fatalf("imported %d links; want 1", len(links))
+		}
+		if link := links[0]; link.Short != "a" || link.Description != "the a link" || !link.Tags.Has("docs") || !link.Tags.Has("team") {
+			t.Errorf("imported link = %+v", link)
+		}
+		return nil
+	})
+
+	n, err := importLinks(defaultTenant(), strings.NewReader(snapshot), formatJSONL, false, systemActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("importLinks() = %d; want 1", n)
+	}
+
+	// a failed save imports nothing, and isn't recorded in the audit log
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).Return(nil, fs.ErrNotExist).Times(2)
+	db.(*MockDatabase).EXPECT().SaveLinks(gomock.Any()).Return(errors.New("duplicate key"))
+	n, err = importLinks(defaultTenant(), strings.NewReader(snapshot), formatJSONL, false, systemActor)
+	if err == nil || n != 0 {
+		t.Errorf("importLinks() with a failed save = %d, %v; want 0 and an error", n, err)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Tags
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "Docs, team  #oncall,docs", want: Tags{"docs", "oncall", "team"}},
+		{in: "bad/tag", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTags(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTags(%q) returned error %v; want %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseTags(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestServeSearch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().
+		Search(LinkSearch{Query: "docs", Limit: maxSearchResults}).
+		Return([]*Link{{Short: "docs", Long: "https://docs/", Description: "team docs"}}, nil)
+
+	r := httptest.NewRequest("GET", "/.search?q=docs", nil)
+	w := httptest.NewRecorder()
+	serveSearch(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("serveSearch() = %d; want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("serveSearch() content type = %q; want application/json", got)
+	}
+	if !strings.Contains(w.Body.String(), `"Description": "team docs"`) {
+		t.Errorf("serveSearch() body = %s; want docs link", w.Body)
+	}
+
+	// empty queries don't hit the database
+	r = httptest.NewRequest("GET", "/.search", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	serveSearch(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("serveSearch() = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServeAllPages(t *testing.T) {
+	links := make(map[string]*Link)
+	for i := 0; i < allPageSize+5; i++ {
+		short := fmt.Sprintf("link%03d", i)
+		links[short] = &Link{Short: short, Long: "http://" + short + "/"}
+	}
+	links["link001"].Visibility = visibilityRestricted
+	links["link001"].Owner = "bar@example.com"
+	fakeLinks(t, links)
+
+	var all []*Link
+	for path := "/.all"; path != ""; {
+		w := httptest.NewRecorder()
+		serveAll(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("serveAll(%s) = %d; want %d", path, w.Code, http.StatusOK)
+		}
+		var page []*Link
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, page...)
+		path = ""
+		if next := w.Header().Get("Link"); next != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(next, "<"), `>; rel="next"`)
+		}
+	}
+	if len(all) != allPageSize+4 || all[0].Short != "link000" || all[1].Short != "link002" {
+		t.Errorf("serveAll() pages listed %d links starting %q; want %d without the restricted link", len(all), all[0].Short, allPageSize+4)
+	}
+
+	r := httptest.NewRequest("GET", "/.all?sort=color", nil)
+	w := httptest.NewRecorder()
+	serveAll(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("serveAll(sort=color) = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+
+	r = httptest.NewRequest("GET", "/.all?sort=clicks&order=desc", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	serveAll(w, r)
+	if body := w.Body.String(); !strings.Contains(body, `href="/.all?sort=clicks"`) || !strings.Contains(body, "Next page") {
+		t.Errorf("serveAll(sort=clicks) = %s; want ascending clicks sort and next page links", body)
+	}
+}
+
+func TestServeSuggest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().
+		Search(LinkSearch{Query: "do", Limit: maxSearchResults}).
+		Return([]*Link{
+			{Short: "docs", Description: "team docs"},
+			{Short: "dogs"},
+			{Short: "todo", Description: "todo list"},
+		}, nil)
+
+	stats.mu.Lock()
+	oldClicks := stats.clicks
+	stats.clicks = ClickStats{"todo": 10, "docs": 3}
+	stats.mu.Unlock()
+	t.Cleanup(func() {
+		stats.mu.Lock()
+		stats.clicks = oldClicks
+		stats.mu.Unlock()
+	})
+
+	r := httptest.NewRequest("GET", "/.suggest?q=do", nil)
+	w := httptest.NewRecorder()
+	serveSuggest(w, r)
+
+	if got := w.Header().Get("Content-Type"); got != "application/x-suggestions+json" {
+		t.Errorf("serveSuggest() content type = %q", got)
+	}
+	want := `["do",["todo","docs","dogs"],["todo list","team docs",""],["http://go/todo","http://go/docs","http://go/dogs"]]`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("serveSuggest() = %s; want %s", got, want)
+	}
+}
+
+func TestServeSaveAlias(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
+	links := map[string]*Link{
+		"kubernetes": {Short: "kubernetes", Long: "https://kubernetes.io/", Owner: "foo@example.com"},
+		"k8s":        {Short: "k8s", AliasOf: "kubernetes", Owner: "foo@example.com"},
+	}
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			return link, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadAliases("kubernetes").Return([]*Link{links["k8s"]}, nil).AnyTimes()
+
+	tests := []struct {
+		name        string
+		short       string
+		aliasOf     string
+		wantStatus  int
+		wantAliasOf string
+	}{
+		{
+			name:        "alias of canonical link",
+			short:       "kube",
+			aliasOf:     "kubernetes",
+			wantStatus:  http.StatusOK,
+			wantAliasOf: "kubernetes",
+		},
+		{
+			name:        "alias of alias is flattened",
+			short:       "kube",
+			aliasOf:     "k8s",
+			wantStatus:  http.StatusOK,
+			wantAliasOf: "kubernetes",
+		},
+		{
+			name:       "alias of missing link",
+			short:      "kube",
+			aliasOf:    "does-not-exist",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "alias of itself through another alias",
+			short:      "kubernetes",
+			aliasOf:    "k8s",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantStatus == http.StatusOK {
+				db.(*MockDatabase).EXPECT().Save(gomock.Any()).DoAndReturn(func(link *Link) error {
+					if link.AliasOf != tt.wantAliasOf || link.Long != "" {
+						t.Errorf("saved link = %+v; want alias of %q", link, tt.wantAliasOf)
+					}
+					return nil
+				})
+			}
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{
+				"short":    {tt.short},
+				"alias_of": {tt.aliasOf},
+			}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			serveSave(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("serveSave(%q, alias of %q) = %d; want %d: %s", tt.short, tt.aliasOf, w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestServeSaveLinkState(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oldAdmins := *admins
+	*admins = "admin@example.com"
+	t.Cleanup(func() { *admins = oldAdmins })
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
+	links := map[string]*Link{
+		"open":   {Short: "open", Long: "http://open/", Owner: "foo@example.com"},
+		"locked": {Short: "locked", Long: "http://locked/", Owner: "foo@example.com", Locked: true},
+	}
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			// return a copy, so saves don't affect other tests
+			l := *link
+			return &l, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+
+	tests := []struct {
+		name       string
+		user       string
+		form       url.Values
+		wantStatus int
+		wantLink   *Link // fields of the saved link to check
+	}{
+		{
+			name:       "owner disables link",
+			user:       "foo@example.com",
+			form:       url.Values{"short": {"open"}, "long": {"http://open/"}, "disabled": {"true"}, "disabled_reason": {"incident"}},
+			wantStatus: http.StatusOK,
+			wantLink:   &Link{Disabled: true, DisabledReason: "incident"},
+		},
+		{
+			name:       "disabling requires a reason",
+			user:       "foo@example.com",
+			form:       url.Values{"short": {"open"}, "long": {"http://open/"}, "disabled": {"true"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "owner locks link",
+			user:       "foo@example.com",
+			form:       url.Values{"short": {"open"}, "long": {"http://open/"}, "locked": {"true"}},
+			wantStatus: http.StatusOK,
+			wantLink:   &Link{Locked: true},
+		},
+		{
+			name:       "owner cannot edit locked link",
+			user:       "foo@example.com",
+			form:       url.Values{"short": {"locked"}, "long": {"http://elsewhere/"}, "locked": {""}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin unlocks link",
+			user:       "admin@example.com",
+			form:       url.Values{"short": {"locked"}, "long": {"http://locked/"}, "owner": {"foo@example.com"}, "locked": {""}},
+			wantStatus: http.StatusOK,
+			wantLink:   &Link{Locked: false},
+		},
+		{
+			name:       "admin edits another's link",
+			user:       "admin@example.com",
+			form:       url.Values{"short": {"open"}, "long": {"http://open/"}, "owner": {"foo@example.com"}, "disabled": {"true"}, "disabled_reason": {"incident"}},
+			wantStatus: http.StatusOK,
+			wantLink:   &Link{Disabled: true, DisabledReason: "incident"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldCurrentUser := currentUser
+			currentUser = func(*http.Request) (string, error) { return tt.user, nil }
+			t.Cleanup(func() { currentUser = oldCurrentUser })
+
+			if tt.wantStatus == http.StatusOK {
+				db.(*MockDatabase).EXPECT().Save(gomock.Any()).DoAndReturn(func(link *Link) error {
+					if link.Disabled != tt.wantLink.Disabled || link.DisabledReason != tt.wantLink.DisabledReason || link.Locked != tt.wantLink.Locked {
+						t.Errorf("saved link = %+v; want %+v", link, tt.wantLink)
+					}
+					if link.Owner != "foo@example.com" {
+						t.Errorf("saved link owner = %q; want %q", link.Owner, "foo@example.com")
+					}
+					return nil
+				})
+			}
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			serveSave(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("serveSave(%v) = %d; want %d: %s", tt.form, w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestResolveLinkChains(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	links := map[string]*Link{
+		"a":    {Short: "a", Long: "http://go/b"},
+		"b":    {Short: "b", Long: "/a"},
+		"self": {Short: "self", Long: "/Self"},
+		"end":  {Short: "end", Long: "https://example.com/"},
+	}
+	// a long chain of links: deep0 -> deep1 -> ... -> end
+	for i := 0; i <= maxLinkDepth; i++ {
+		short := fmt.Sprintf("deep%d", i)
+		links[short] = &Link{Short: short, Long: fmt.Sprintf("/deep%d", i+1)}
+	}
+	links[fmt.Sprintf("deep%d", maxLinkDepth+1)] = &Link{Short: "last", Long: "/end"}
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[linkID(short)]; ok {
+			return link, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return(nil, nil).AnyTimes()
+
+	tests := []struct {
+		link      string
+		wantLoop  bool
+		wantChain string
+	}{
+		{link: "a", wantLoop: true, wantChain: "link loop: go/a -> go/b -> go/a"},
+		{link: "self", wantLoop: true, wantChain: "link loop: go/self -> go/Self"},
+		{link: "deep0", wantChain: fmt.Sprintf("link chain longer than %d links", maxLinkDepth)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			_, err := resolveLink(defaultTenant(), tt.link)
+			var chainErr *linkChainError
+			if !errors.As(err, &chainErr) {
+				t.Fatalf("resolveLink(%q) error = %v; want linkChainError", tt.link, err)
+			}
+			if chainErr.Loop != tt.wantLoop {
+				t.Errorf("resolveLink(%q) loop = %v; want %v", tt.link, chainErr.Loop, tt.wantLoop)
+			}
+			if !strings.HasPrefix(err.Error(), tt.wantChain) {
+				t.Errorf("resolveLink(%q) error = %q; want prefix %q", tt.link, err, tt.wantChain)
+			}
+		})
+	}
+
+	// saving a link that would close a loop is rejected
+	if err := checkLinkChain(defaultTenant(), &Link{Short: "end", Long: "/a"}); err == nil {
+		t.Errorf("checkLinkChain(end -> a) = nil; want error")
+	}
+	if err := checkLinkChain(defaultTenant(), &Link{Short: "end", Long: "/self-help"}); err != nil {
+		t.Errorf("checkLinkChain(end -> self-help) = %v; want nil", err)
+	}
+	if err := checkLinkChain(defaultTenant(), &Link{Short: "b", Long: "https://example.com/"}); err != nil {
+		t.Errorf("checkLinkChain(b -> example.com) = %v; want nil", err)
+	}
+}
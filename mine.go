@@ -0,0 +1,249 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// mineXSRFAction is the XSRF action for bulk changes made on the /.mine page.
+const mineXSRFAction = ".mine"
+
+// mineData is the data used by the mineTmpl template.
+type mineData struct {
+	User  string
+	XSRF  string
+	Links []ownedLink
+}
+
+// ownedLink is a link with its visit stats, as listed on the /.mine page.
+type ownedLink struct {
+	*Link
+	Clicks    int
+	LastClick *time.Time `json:",omitempty"`
+}
+
+// mineResult is the JSON response to bulk changes made through /.mine.
+type mineResult struct {
+	Transferred int `json:",omitempty"`
+	Deleted     int `json:",omitempty"`
+}
+
+// loadOwned returns t's shared links owned directly by owner, sorted by ID.
+// Personal links are managed on the /.me page instead.
+func loadOwned(t *tenant, owner string) ([]*Link, error) {
+	var links []*Link
+	page := LinkPage{Owner: owner, Limit: exportBatchSize}
+	for {
+		batch, next, err := loadPage(t, page, func(link *Link) bool {
+			_, _, personal := cutPersonal(link.Short)
+			return !personal
+		})
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, batch...)
+		if next == "" {
+			return links, nil
+		}
+		page.After = next
+	}
+}
+
+// ownedLinks returns the shared links owned by login, sorted by ID, with
+// their visit stats.
+func ownedLinks(t *tenant, login string) ([]ownedLink, error) {
+	links, err := loadOwned(t, login)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make([]ownedLink, len(links))
+	stats.mu.Lock()
+	for i, link := range links {
+		key := t.statsKey(link.Short)
+		owned[i] = ownedLink{Link: link, Clicks: stats.clicks[key]}
+		if last, ok := stats.lastClick[key]; ok {
+			owned[i].LastClick = &last
+		}
+	}
+	stats.mu.Unlock()
+	return owned, nil
+}
+
+// serveMine lists the links owned by the current user, with how often and
+// when they were last visited. POST requests transfer or delete several of
+// them at once.
+func serveMine(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if login == "" {
+		http.Error(w, "listing your links requires a logged in user", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "POST" {
+		changeMine(w, r, t, login)
+		return
+	}
+
+	links, err := ownedLinks(t, login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(links)
+		return
+	}
+	mineTmpl.Execute(w, mineData{
+		User:  login,
+		XSRF:  xsrftoken.Generate(xsrfKey, login, mineXSRFAction),
+		Links: links,
+	})
+}
+
+// changeMine handles requests to transfer or delete the links named by the
+// "short" request values, depending on the "action" value. Every link must
+// be owned by login, and the change is made to all of them in one
+// transaction, or to none of them.
+func changeMine(w http.ResponseWriter, r *http.Request, t *tenant, login string) {
+	if !validXSRF(r, r.PostFormValue("xsrf"), login, mineXSRFAction) {
+		http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+		return
+	}
+	r.ParseForm()
+	shorts := r.PostForm["short"]
+	if len(shorts) == 0 {
+		http.Error(w, "no links selected", http.StatusBadRequest)
+		return
+	}
+
+	var links []*Link
+	selected := make(map[string]bool)
+	for _, short := range shorts {
+		if selected[linkID(short)] {
+			continue
+		}
+		link, err := t.db().Load(short)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "link not found: "+short, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if link.Owner != login {
+			http.Error(w, fmt.Sprintf("cannot change %s; owned by %s", link.Short, link.Owner), http.StatusForbidden)
+			return
+		}
+		if link.Locked && !t.isAdmin(login) {
+			http.Error(w, fmt.Sprintf("%s is locked; only an admin can change it", link.Short), http.StatusForbidden)
+			return
+		}
+		links = append(links, link)
+		selected[linkID(link.Short)] = true
+	}
+	shorts = make([]string, len(links))
+	for i, link := range links {
+		shorts[i] = link.Short
+	}
+
+	var result mineResult
+	switch action := r.PostFormValue("action"); action {
+	case "transfer":
+		owner := strings.TrimSpace(r.PostFormValue("owner"))
+		if owner == "" {
+			http.Error(w, "owner required", http.StatusBadRequest)
+			return
+		}
+		exists, err := ownerExists(r.Context(), owner)
+		if err != nil {
+			log.Printf("looking up tailnet user %q: %v", owner, err)
+		}
+		if !exists {
+			http.Error(w, "new owner not a valid user or group: "+owner, http.StatusBadRequest)
+			return
+		}
+		actor := requestActor(r)
+		before := make(map[string]*Link)
+		transferred, err := t.db().TransferLinks(LinkTransfer{
+			From:   login,
+			To:     owner,
+			Shorts: shorts,
+			Time:   time.Now().UTC(),
+			Audit: func(prev, link *Link) *AuditEntry {
+				before[link.Short] = prev
+				return actor.entry(auditLinkTransfer, link.Short, prev, link)
+			},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, link := range transferred {
+			queueLinkEvent(t, auditLinkTransfer, actor.Login, before[link.Short], link)
+		}
+		result.Transferred = len(transferred)
+	case "delete":
+		// links with aliases can only be deleted along with their aliases
+		for _, link := range links {
+			aliases, err := t.db().LoadAliases(link.Short)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, alias := range aliases {
+				if !selected[linkID(alias.Short)] {
+					http.Error(w, fmt.Sprintf("cannot delete %s without its alias %s", link.Short, alias.Short), http.StatusConflict)
+					return
+				}
+			}
+		}
+		actor := requestActor(r)
+		deleted, err := t.db().DeleteLinks(LinkDeletion{
+			Shorts: shorts,
+			Owner:  login,
+			Audit: func(link *Link) *AuditEntry {
+				return actor.entry(auditLinkDelete, link.Short, link, nil)
+			},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, link := range deleted {
+			deleteLinkStats(t, link)
+			queueLinkEvent(t, auditLinkDelete, actor.Login, link, nil)
+		}
+		result.Deleted = len(deleted)
+	default:
+		http.Error(w, fmt.Sprintf("unknown action %q; must be transfer or delete", action), http.StatusBadRequest)
+		return
+	}
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	http.Redirect(w, r, "/.mine", http.StatusFound)
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestServeMine(t *testing.T) {
+	links := map[string]*Link{
+		"docs":                     {Short: "docs", Long: "http://docs/", Owner: "foo@example.com"},
+		"wiki":                     {Short: "wiki", Long: "http://wiki/", Owner: "foo@example.com"},
+		"w":                        {Short: "w", AliasOf: "wiki", Owner: "foo@example.com"},
+		"plans":                    {Short: "plans", Long: "http://plans/", Owner: "bar@example.com"},
+		"~foo@example.com/standup": {Short: "~foo@example.com/standup", Long: "http://meet/", Owner: "foo@example.com"},
+	}
+	audit := fakeLinks(t, links)
+
+	clicked := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	stats.mu.Lock()
+	oldClicks, oldLastClick := stats.clicks, stats.lastClick
+	stats.clicks = ClickStats{"docs": 3}
+	stats.lastClick = map[string]time.Time{"docs": clicked}
+	stats.mu.Unlock()
+	t.Cleanup(func() {
+		stats.mu.Lock()
+		stats.clicks, stats.lastClick = oldClicks, oldLastClick
+		stats.mu.Unlock()
+	})
+
+	w := httptest.NewRecorder()
+	serveMine(w, httptest.NewRequest("GET", "/.mine", nil))
+	var got []ownedLink
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("serveMine() = %s: %v", w.Body, err)
+	}
+	var shorts []string
+	for _, link := range got {
+		shorts = append(shorts, link.Short)
+	}
+	if strings.Join(shorts, ",") != "docs,w,wiki" {
+		t.Errorf("serveMine() listed %q; want docs, w, and wiki", shorts)
+	}
+	if got[0].Clicks != 3 || got[0].LastClick == nil || !got[0].LastClick.Equal(clicked) || got[1].LastClick != nil {
+		t.Errorf("serveMine() stats = %+v, %+v", got[0], got[1])
+	}
+
+	r := httptest.NewRequest("GET", "/.mine", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	serveMine(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "go/docs") || !strings.Contains(body, "Apr 5, 2023") || strings.Contains(body, "go/plans") {
+		t.Errorf("serveMine() page = %s", body)
+	}
+
+	xsrf := xsrftoken.Generate(xsrfKey, "foo@example.com", mineXSRFAction)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/.mine", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveMine(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "no xsrf",
+			form:       url.Values{"action": {"delete"}, "short": {"docs"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "another user's link",
+			form:       url.Values{"xsrf": {xsrf}, "action": {"transfer"}, "owner": {"baz@example.com"}, "short": {"docs", "plans"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "link with alias",
+			form:       url.Values{"xsrf": {xsrf}, "action": {"delete"}, "short": {"wiki"}},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "unknown action",
+			form:       url.Values{"xsrf": {xsrf}, "action": {"archive"}, "short": {"docs"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "transfer",
+			form:       url.Values{"xsrf": {xsrf}, "action": {"transfer"}, "owner": {"baz@example.com"}, "short": {"docs"}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"Transferred":1}`,
+		},
+		{
+			name:       "delete with alias",
+			form:       url.Values{"xsrf": {xsrf}, "action": {"delete"}, "short": {"wiki", "w"}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"Deleted":2}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := post(tt.form)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("serveMine(POST) = %d; want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("serveMine(POST) = %s; want %s", w.Body, tt.wantBody)
+			}
+		})
+	}
+
+	if got := links["docs"]; got.Owner != "baz@example.com" {
+		t.Errorf("transferred link = %+v", got)
+	}
+	if got := links["plans"]; got.Owner != "bar@example.com" {
+		t.Errorf("another user's link changed: %+v", got)
+	}
+	if _, ok := links["wiki"]; ok {
+		t.Error("deleted link still exists")
+	}
+	var actions []string
+	for _, entry := range *audit {
+		actions = append(actions, entry.Action+" "+entry.Target)
+	}
+	if got, want := strings.Join(actions, ", "), "link.transfer docs, link.delete w, link.delete wiki"; got != want {
+		t.Errorf("audit log = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+)
+
+var expiryNotice = flag.Duration("expiry-notice", 72*time.Hour, "notify link owners this long before a link expires")
+
+// Notifier delivers notifications about links to their owners.
+type Notifier interface {
+	// NotifyExpiring is called once for each link that will expire within
+	// the notice period set by the -expiry-notice flag.
+	NotifyExpiring(ctx context.Context, link *Link) error
+}
+
+// ExpiryNotifier is used to tell link owners about upcoming link expiry.
+// By default notifications are only logged. Programs embedding golink may
+// replace it before calling Run.
+var ExpiryNotifier Notifier = logNotifier{}
+
+// logNotifier is a Notifier that writes notifications to the server log.
+type logNotifier struct{}
+
+func (logNotifier) NotifyExpiring(_ context.Context, link *Link) error {
+	log.Printf("go/%s (owned by %s) expires at %v", link.Short, link.Owner, link.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// notifyExpiring notifies the owners of links expiring within the notice
+// period after now. Links are notified once for each distinct expiry time,
+// which is stored with the link. Links are passed to ExpiryNotifier as their
+// tenant sees them, without a tenant prefix on their short names.
+func notifyExpiring(ctx context.Context, now time.Time) error {
+	for _, t := range allTenants() {
+		links, err := t.db().LoadExpired(LinkExpiry{Since: now, Until: now.Add(*expiryNotice)})
+		if err != nil {
+			return err
+		}
+
+		for _, link := range links {
+			if link.ExpiryNotified.Equal(link.ExpiresAt) {
+				continue
+			}
+			if err := ExpiryNotifier.NotifyExpiring(ctx, link); err != nil {
+				log.Printf("notifying expiry of %q: %v", link.Short, err)
+				continue
+			}
+			if err := t.db().SaveExpiryNotice(link.Short, link.ExpiresAt); err != nil {
+				log.Printf("recording expiry notice of %q: %v", link.Short, err)
+			}
+		}
+	}
+	return nil
+}
+
+// notifyExpiringLoop checks for expiring links every ten minutes, and queues
+// webhooks for links that have expired since the last check. This function
+// never returns.
+func notifyExpiringLoop() {
+	for {
+		now := time.Now().UTC()
+		if err := notifyExpiring(context.Background(), now); err != nil {
+			log.Printf("checking expiring links: %v", err)
+		}
+		if err := queueExpired(now); err != nil {
+			log.Printf("checking expired links: %v", err)
+		}
+		time.Sleep(10 * time.Minute)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+type recordingNotifier struct {
+	expiring []string
+}
+
+func (n *recordingNotifier) NotifyExpiring(_ context.Context, link *Link) error {
+	n.expiring = append(n.expiring, link.Short)
+	return nil
+}
+
+func TestNotifyExpiring(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	setTenants(t, "go,sales", "")
+	now := time.Date(2022, 6, 2, 12, 0, 0, 0, time.UTC)
+	links := []*Link{
+		{ID: "soon", Short: "soon", ExpiresAt: now.Add(time.Hour)},
+		{ID: "later", Short: "later", ExpiresAt: now.Add(30 * 24 * time.Hour)},
+		{ID: "expired", Short: "expired", ExpiresAt: now.Add(-time.Hour)},
+		{ID: "forever", Short: "forever"},
+		{ID: "sales:quota", Short: "sales:quota", ExpiresAt: now.Add(time.Hour)},
+	}
+	db.(*MockDatabase).EXPECT().LoadExpired(gomock.Any()).DoAndReturn(func(q LinkExpiry) ([]*Link, error) {
+		var expiring []*Link
+		for _, link := range links {
+			tenant, _, ok := strings.Cut(link.Short, ":")
+			if !ok {
+				tenant = ""
+			}
+			if tenant == q.Tenant && link.ExpiresAt.After(q.Since) && !link.ExpiresAt.After(q.Until) {
+				c := *link
+				expiring = append(expiring, &c)
+			}
+		}
+		return expiring, nil
+	}).Times(6)
+	db.(*MockDatabase).EXPECT().SaveExpiryNotice(gomock.Any(), gomock.Any()).DoAndReturn(func(short string, expiresAt time.Time) error {
+		for _, link := range links {
+			if link.Short == short {
+				link.ExpiryNotified = expiresAt
+			}
+		}
+		return nil
+	}).Times(3)
+
+	n := new(recordingNotifier)
+	oldNotifier := ExpiryNotifier
+	ExpiryNotifier = n
+	t.Cleanup(func() { ExpiryNotifier = oldNotifier })
+
+	// notices are stored with the link, so they aren't sent again, and
+	// links of other tenants are notified without the tenant prefix
+	for i := 0; i < 2; i++ {
+		if err := notifyExpiring(context.Background(), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"soon", "quota"}; !cmp.Equal(n.expiring, want) {
+		t.Fatalf("notified %q; want %q", n.expiring, want)
+	}
+
+	// extending the expiry time results in a new notification
+	links[0].ExpiresAt = now.Add(2 * time.Hour)
+	if err := notifyExpiring(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.expiring) != 3 || n.expiring[2] != "soon" {
+		t.Errorf("notified %q; want [soon quota soon]", n.expiring)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// patternsXSRFAction is the XSRF action for changes made on the patterns page.
+const patternsXSRFAction = ".patterns"
+
+// compilePattern compiles a pattern's regular expression so that it must
+// match the whole path.
+func compilePattern(expr string) (*regexp.Regexp, error) {
+	return compileRegexp("^(?:" + expr + ")$")
+}
+
+// matchPattern returns the first pattern in patterns that matches path, along
+// with the named captures of the match. It returns nil if no pattern matches.
+// Patterns that don't compile are skipped.
+func matchPattern(patterns []*Pattern, path string) (*Pattern, map[string]string) {
+	for _, p := range patterns {
+		re, err := compilePattern(p.Regexp)
+		if err != nil {
+			log.Printf("pattern %d: %v", p.ID, err)
+			continue
+		}
+		m := re.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		captures := make(map[string]string)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				captures[name] = m[i]
+			}
+		}
+		return p, captures
+	}
+	return nil, nil
+}
+
+// loadPatternLink returns a link for path built from the first matching
+// pattern, along with the named captures of the match. It returns
+// fs.ErrNotExist if no pattern matches.
+func loadPatternLink(t *tenant, path string) (*Link, map[string]string, error) {
+	patterns, err := t.db().LoadPatterns()
+	if err != nil {
+		return nil, nil, err
+	}
+	p, captures := matchPattern(patterns, path)
+	if p == nil {
+		return nil, nil, fs.ErrNotExist
+	}
+	return &Link{Short: path, Long: p.Long, Owner: p.Owner}, captures, nil
+}
+
+// patternsData is the data used by the patternsTmpl template.
+type patternsData struct {
+	Patterns []*Pattern
+	XSRF     string
+
+	// User is the current user, who may delete patterns they own.
+	User string
+
+	// Admin indicates whether the current user is an admin, who can
+	// create and change patterns.
+	Admin bool
+
+	// Edit is the pattern being edited, if any.
+	Edit *Pattern
+
+	// Test is the path being tested against the patterns, if any.
+	Test string
+
+	// Link is set if a link with the Test name exists, and takes
+	// precedence over patterns.
+	Link *Link
+
+	// Match is the pattern that matched Test, if any.
+	Match *Pattern
+
+	// Captures are the named captures of Match.
+	Captures map[string]string
+
+	// Destination is Test expanded by the matching pattern or link.
+	Destination string
+
+	// Error describes why Test could not be expanded.
+	Error string
+}
+
+// servePatterns serves the pattern list, and handles requests to create,
+// update, delete, and test patterns.
+func servePatterns(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "POST" {
+		savePattern(w, r, t, login)
+		return
+	}
+
+	patterns, err := t.db().LoadPatterns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := patternsData{
+		Patterns: patterns,
+		User:     login,
+		Admin:    t.isAdmin(login),
+		XSRF:     xsrftoken.Generate(xsrfKey, login, patternsXSRFAction),
+		Test:     strings.TrimPrefix(strings.TrimSpace(r.FormValue("test")), "go/"),
+	}
+	if data.Test != "" {
+		testPatterns(t, &data, login)
+	}
+	if v := r.FormValue("edit"); v != "" {
+		for _, p := range patterns {
+			if strconv.FormatUint(uint64(p.ID), 10) == v && data.Admin {
+				data.Edit = p
+			}
+		}
+	}
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if data.Test != "" {
+			enc.Encode(struct {
+				Test        string
+				Link        *Link             `json:",omitempty"`
+				Match       *Pattern          `json:",omitempty"`
+				Captures    map[string]string `json:",omitempty"`
+				Destination string            `json:",omitempty"`
+				Error       string            `json:",omitempty"`
+			}{data.Test, data.Link, data.Match, data.Captures, data.Destination, data.Error})
+			return
+		}
+		enc.Encode(patterns)
+		return
+	}
+	patternsTmpl.Execute(w, data)
+}
+
+// testPatterns fills in which link or pattern data.Test resolves to, and its
+// destination.
+func testPatterns(t *tenant, data *patternsData, login string) {
+	path := data.Test
+	env := expandEnv{Now: time.Now().UTC(), user: login}
+	link, _, remainder, err := loadLink(t, path, nil)
+	switch {
+	case err == nil && !canView(t, link, login):
+		data.Error = "go/" + path + " is restricted."
+		return
+	case err == nil:
+		data.Link = link
+		if link, err = canonicalLink(t, link); err == nil {
+			env.Path = remainder
+			data.Destination, err = expandLink(link.Long, env)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		data.Match, data.Captures = matchPattern(data.Patterns, path)
+		if data.Match == nil {
+			data.Error = "No link or pattern matches go/" + path + "."
+			return
+		}
+		env.Match = data.Captures
+		data.Destination, err = expandLink(data.Match.Long, env)
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+}
+
+// savePattern handles requests to create, update, or delete a pattern.
+// Patterns can match any name, including names other users would create
+// links for, so only admins can create or change them. Owners may still
+// delete their patterns.
+func savePattern(w http.ResponseWriter, r *http.Request, t *tenant, login string) {
+	if !validXSRF(r, r.PostFormValue("xsrf"), login, patternsXSRFAction) {
+		http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+		return
+	}
+
+	admin := t.isAdmin(login)
+	pattern := new(Pattern)
+	if v := r.PostFormValue("id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		pattern, err = t.db().LoadPattern(uint(id))
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if pattern.Owner != login && !admin {
+			http.Error(w, "cannot change pattern owned by another user", http.StatusForbidden)
+			return
+		}
+	}
+
+	var before *Pattern
+	if pattern.ID != 0 {
+		c := *pattern
+		before = &c
+	}
+
+	if r.PostFormValue("delete") != "" {
+		if pattern.ID == 0 {
+			http.Error(w, "id required", http.StatusBadRequest)
+			return
+		}
+		if err := t.db().DeletePattern(pattern.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestActor(r).record(t, auditPatternDelete, strconv.FormatUint(uint64(pattern.ID), 10), before, nil)
+		http.Redirect(w, r, "/.patterns", http.StatusFound)
+		return
+	}
+
+	if !admin {
+		http.Error(w, "only admins can create or change patterns", http.StatusForbidden)
+		return
+	}
+
+	expr, long := r.PostFormValue("regexp"), r.PostFormValue("long")
+	if expr == "" || long == "" {
+		http.Error(w, "regexp and long required", http.StatusBadRequest)
+		return
+	}
+	if _, err := compilePattern(expr); err != nil {
+		http.Error(w, fmt.Sprintf("regexp is invalid: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseLinkTemplate(long); err != nil {
+		http.Error(w, fmt.Sprintf("long contains an invalid template: %v", err), http.StatusBadRequest)
+		return
+	}
+	priority := 0
+	if v := r.PostFormValue("priority"); v != "" {
+		var err error
+		if priority, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "priority must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pattern.Regexp = expr
+	pattern.Long = long
+	pattern.Priority = priority
+	pattern.Description = strings.TrimSpace(r.PostFormValue("description"))
+	pattern.Owner = login
+	pattern.LastEdit = time.Now().UTC()
+	if err := t.db().SavePattern(pattern); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	action := auditPatternUpdate
+	if before == nil {
+		action = auditPatternCreate
+	}
+	requestActor(r).record(t, action, strconv.FormatUint(uint64(pattern.ID), 10), before, pattern)
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pattern)
+		return
+	}
+	http.Redirect(w, r, "/.patterns", http.StatusFound)
+}
@@ -0,0 +1,237 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestMatchPattern(t *testing.T) {
+	patterns := []*Pattern{
+		{Regexp: `(`},
+		{Regexp: `pr(?P<num>[0-9]+)`},
+		{Regexp: `(?P<project>[A-Z]+)-(?P<issue>[0-9]+)(?:/(?P<rest>.*))?`},
+		{Regexp: `[a-z]+[0-9]+`},
+	}
+	tests := []struct {
+		path      string
+		want      int // index of matching pattern, or -1
+		wantMatch map[string]string
+	}{
+		{path: "pr123", want: 1, wantMatch: map[string]string{"num": "123"}},
+		{path: "PROJ-123", want: 2, wantMatch: map[string]string{"project": "PROJ", "issue": "123", "rest": ""}},
+		{path: "PROJ-123/comments", want: 2, wantMatch: map[string]string{"project": "PROJ", "issue": "123", "rest": "comments"}},
+		{path: "abc9", want: 3, wantMatch: map[string]string{}},
+		{path: "xpr123", want: 3, wantMatch: map[string]string{}},
+		{path: "pr123x", want: -1},
+		{path: "proj-123", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, match := matchPattern(patterns, tt.path)
+			if tt.want < 0 {
+				if got != nil {
+					t.Errorf("matchPattern(%q) = %q; want no match", tt.path, got.Regexp)
+				}
+				return
+			}
+			if got != patterns[tt.want] {
+				t.Fatalf("matchPattern(%q) = %+v; want %q", tt.path, got, patterns[tt.want].Regexp)
+			}
+			if !cmp.Equal(match, tt.wantMatch) {
+				t.Errorf("matchPattern(%q) captures = %v; want %v", tt.path, match, tt.wantMatch)
+			}
+		})
+	}
+}
+
+func TestServePatternsTest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if short == "meet" {
+			return &Link{Short: "meet", Long: "https://meet.example/"}, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return([]*Pattern{
+		{Regexp: `(?P<key>[A-Z]+-[0-9]+)`, Long: `https://jira/browse/{{.Match.key}}`},
+	}, nil).AnyTimes()
+
+	tests := []struct {
+		test            string
+		wantLink        bool
+		wantMatch       bool
+		wantDestination string
+	}{
+		{test: "PROJ-1", wantMatch: true, wantDestination: "https://jira/browse/PROJ-1"},
+		{test: "meet/standup", wantLink: true, wantDestination: "https://meet.example/standup"},
+		{test: "nothing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.test, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/.patterns?test="+url.QueryEscape(tt.test), nil)
+			w := httptest.NewRecorder()
+			servePatterns(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("servePatterns(%q) = %d; want %d", tt.test, w.Code, http.StatusOK)
+			}
+			var got struct {
+				Link        *Link
+				Match       *Pattern
+				Destination string
+				Error       string
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if (got.Link != nil) != tt.wantLink || (got.Match != nil) != tt.wantMatch {
+				t.Errorf("servePatterns(%q) link = %v, match = %v; want link %v, match %v", tt.test, got.Link, got.Match, tt.wantLink, tt.wantMatch)
+			}
+			if got.Destination != tt.wantDestination {
+				t.Errorf("servePatterns(%q) destination = %q; want %q", tt.test, got.Destination, tt.wantDestination)
+			}
+			if tt.wantDestination == "" && got.Error == "" {
+				t.Errorf("servePatterns(%q) returned no error", tt.test)
+			}
+		})
+	}
+}
+
+func TestSavePattern(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oldCurrentUser := currentUser
+	currentUser = func(*http.Request) (string, error) { return "foo@example.com", nil }
+	t.Cleanup(func() {
+		currentUser = oldCurrentUser
+	})
+
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
+	patterns := map[uint]*Pattern{
+		1: {Regexp: `pr[0-9]+`, Long: "https://github/pulls", Owner: "foo@example.com"},
+		2: {Regexp: `cl[0-9]+`, Long: "https://review/", Owner: "bar@example.com"},
+	}
+	db.(*MockDatabase).EXPECT().LoadPattern(gomock.Any()).DoAndReturn(func(id uint) (*Pattern, error) {
+		if p, ok := patterns[id]; ok {
+			p.ID = id
+			return p, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+
+	xsrf := xsrftoken.Generate(xsrfKey, "foo@example.com", patternsXSRFAction)
+	tests := []struct {
+		name       string
+		form       url.Values
+		admin      bool
+		wantSave   bool
+		wantDelete bool
+		wantStatus int
+	}{
+		{
+			name:       "create",
+			form:       url.Values{"xsrf": {xsrf}, "regexp": {`(?P<key>[A-Z]+-[0-9]+)`}, "long": {"https://jira/{{.Match.key}}"}, "priority": {"5"}},
+			admin:      true,
+			wantSave:   true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "create as non-admin",
+			form:       url.Values{"xsrf": {xsrf}, "regexp": {`.*`}, "long": {"https://evil/"}, "priority": {"100"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "update own pattern",
+			form:       url.Values{"xsrf": {xsrf}, "id": {"1"}, "regexp": {`pr(?P<num>[0-9]+)`}, "long": {"https://github/pull/{{.Match.num}}"}},
+			admin:      true,
+			wantSave:   true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "update own pattern as non-admin",
+			form:       url.Values{"xsrf": {xsrf}, "id": {"1"}, "regexp": {`.*`}, "long": {"https://github/"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "delete own pattern",
+			form:       url.Values{"xsrf": {xsrf}, "id": {"1"}, "delete": {"1"}},
+			wantDelete: true,
+			wantStatus: http.StatusFound,
+		},
+		{
+			name:       "update pattern owned by another user",
+			form:       url.Values{"xsrf": {xsrf}, "id": {"2"}, "regexp": {`cl[0-9]+`}, "long": {"https://review/"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin updates pattern owned by another user",
+			form:       url.Values{"xsrf": {xsrf}, "id": {"2"}, "regexp": {`cl[0-9]+`}, "long": {"https://review/c/"}},
+			admin:      true,
+			wantSave:   true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing xsrf",
+			form:       url.Values{"regexp": {`pr[0-9]+`}, "long": {"https://github/"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid regexp",
+			form:       url.Values{"xsrf": {xsrf}, "regexp": {`pr(`}, "long": {"https://github/"}},
+			admin:      true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid priority",
+			form:       url.Values{"xsrf": {xsrf}, "regexp": {`pr[0-9]+`}, "long": {"https://github/"}, "priority": {"high"}},
+			admin:      true,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldAdmins := *admins
+			if tt.admin {
+				*admins = "foo@example.com"
+			}
+			t.Cleanup(func() { *admins = oldAdmins })
+			if tt.wantSave {
+				db.(*MockDatabase).EXPECT().SavePattern(gomock.Any()).DoAndReturn(func(p *Pattern) error {
+					if p.Regexp != tt.form.Get("regexp") || p.Owner != "foo@example.com" {
+						t.Errorf("saved pattern = %+v", p)
+					}
+					return nil
+				})
+			}
+			if tt.wantDelete {
+				db.(*MockDatabase).EXPECT().DeletePattern(uint(1)).Return(nil)
+			}
+
+			r := httptest.NewRequest("POST", "/.patterns", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			servePatterns(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("servePatterns(%v) = %d; want %d: %s", tt.form, w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// personalPrefix is the path prefix of personal links. go/me/{name} resolves
+// {name} in the current user's personal namespace.
+const personalPrefix = "me/"
+
+// personalMarker starts the stored short name of a personal link, which is
+// "~{login}/{name}". Short names created through the shared namespace can't
+// contain it, so personal links never collide with shared ones.
+const personalMarker = "~"
+
+// personalXSRFAction is the XSRF action for changes made on the personal
+// links page.
+const personalXSRFAction = ".me"
+
+// personalShort returns the stored short name of the personal link name
+// belonging to login.
+func personalShort(login, name string) string {
+	return personalMarker + login + "/" + name
+}
+
+// cutPersonal reports whether short is the stored short name of a personal
+// link. If so, it returns the link's user and its name within their
+// namespace.
+func cutPersonal(short string) (login, name string, ok bool) {
+	rest, ok := strings.CutPrefix(short, personalMarker)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "/")
+}
+
+// loadUserLink is like loadLink, but resolves paths starting with "me/" in
+// the personal namespace of login. If login has no matching personal link,
+// the path is resolved as a shared link by longest prefix: shared links
+// nested under "me/" come first, then the rest of the path, and then a shared
+// link named "me", so that such links keep working.
+func loadUserLink(t *tenant, path, login string) (link *Link, short, remainder string, err error) {
+	name, ok := strings.CutPrefix(path, personalPrefix)
+	if !ok || name == "" || login == "" {
+		return loadLink(t, path, nil)
+	}
+	link, short, remainder, err = loadLink(t, personalShort(login, name), nil)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return link, short, remainder, err
+	}
+
+	// shared links nested under "me/" are longer matches than the rest of
+	// the path, and a shared link named "me" is shorter
+	shared, sharedShort, sharedRemainder, sharedErr := loadLink(t, path, nil)
+	if sharedErr == nil && strings.Contains(sharedShort, "/") {
+		return shared, sharedShort, sharedRemainder, nil
+	}
+	if sharedErr != nil && !errors.Is(sharedErr, fs.ErrNotExist) {
+		return nil, sharedShort, sharedRemainder, sharedErr
+	}
+	link, short, remainder, err = loadLink(t, name, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return shared, sharedShort, sharedRemainder, sharedErr
+	}
+	return link, short, remainder, err
+}
+
+// personalLinks returns the personal links belonging to login, sorted by
+// name. They are loaded by the prefix of their IDs, in pages.
+func personalLinks(t *tenant, login string) ([]*Link, error) {
+	var mine []*Link
+	page := LinkPage{Prefix: linkID(personalShort(login, "")), Limit: exportBatchSize}
+	for {
+		batch, next, err := loadPage(t, page, func(link *Link) bool {
+			owner, _, ok := cutPersonal(link.Short)
+			return ok && owner == login
+		})
+		if err != nil {
+			return nil, err
+		}
+		mine = append(mine, batch...)
+		if next == "" {
+			break
+		}
+		page.After = next
+	}
+	sort.Slice(mine, func(i, j int) bool {
+		return mine[i].Short < mine[j].Short
+	})
+	return mine, nil
+}
+
+// personalData is the data used by the personalTmpl template.
+type personalData struct {
+	User  string
+	XSRF  string
+	Links []personalLink
+}
+
+// personalLink is a personal link with its name in the user's namespace.
+type personalLink struct {
+	Name   string
+	Link   *Link
+	Clicks int
+}
+
+// servePersonal lists the current user's personal links, and handles
+// requests to create, update, and delete them.
+func servePersonal(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if login == "" {
+		http.Error(w, "personal links require a logged in user", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "POST" {
+		savePersonal(w, r, t, login)
+		return
+	}
+
+	links, err := personalLinks(t, login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(links)
+		return
+	}
+
+	data := personalData{
+		User: login,
+		XSRF: xsrftoken.Generate(xsrfKey, login, personalXSRFAction),
+	}
+	stats.mu.Lock()
+	for _, link := range links {
+		_, name, _ := cutPersonal(link.Short)
+		data.Links = append(data.Links, personalLink{Name: name, Link: link, Clicks: stats.clicks[t.statsKey(link.Short)]})
+	}
+	stats.mu.Unlock()
+	personalTmpl.Execute(w, data)
+}
+
+// savePersonal handles requests to create, update, or delete one of login's
+// personal links, named by the "name" request value.
+func savePersonal(w http.ResponseWriter, r *http.Request, t *tenant, login string) {
+	if !validXSRF(r, r.PostFormValue("xsrf"), login, personalXSRFAction) {
+		http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimSpace(r.PostFormValue("name")), personalPrefix)
+	// personal links resolve under the user's namespace, which takes up a
+	// segment of the short name
+	if !validShortName(personalPrefix + name) {
+		http.Error(w, fmt.Sprintf("name may only contain letters, numbers, dash, and period, with up to %d segments separated by slashes", maxShortSegments-1), http.StatusBadRequest)
+		return
+	}
+	short := personalShort(login, name)
+
+	link, err := t.db().Load(short)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.PostFormValue("delete") != "" {
+		if link == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := t.db().Delete(short); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleteLinkStats(t, link)
+		requestActor(r).record(t, auditLinkDelete, short, link, nil)
+		http.Redirect(w, r, "/.me", http.StatusFound)
+		return
+	}
+
+	long := r.PostFormValue("long")
+	if long == "" {
+		http.Error(w, "long required", http.StatusBadRequest)
+		return
+	}
+	if err := validateLong(long); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	action := auditLinkUpdate
+	var before *Link
+	if link == nil {
+		action = auditLinkCreate
+		link = &Link{Short: short, Created: now}
+	} else {
+		c := *link
+		before = &c
+	}
+	link.ID = linkID(short)
+	link.Long = long
+	link.Description = strings.TrimSpace(r.PostFormValue("description"))
+	link.Owner = login
+	link.LastEdit = now
+	if err := checkLinkChain(t, link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := t.db().Save(link); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestActor(r).record(t, action, short, before, link)
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(link)
+		return
+	}
+	http.Redirect(w, r, "/.me", http.StatusFound)
+}
+
+// servePersonalExport prints a snapshot of the current user's personal
+// links, in the same format as /.export.
+func servePersonalExport(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if login == "" {
+		http.Error(w, "personal links require a logged in user", http.StatusUnauthorized)
+		return
+	}
+	links, err := personalLinks(t, login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	for _, link := range links {
+		if err := encoder.Encode(link); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestServeGoPersonal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	links := map[string]*Link{
+		"standup":                   {Short: "standup", Long: "http://meet/team-standup/"},
+		"me":                        {Short: "me", Long: "http://people/"},
+		"wiki":                      {Short: "wiki", Long: "http://wiki/"},
+		"me/wiki":                   {Short: "me/wiki", Long: "http://wiki/people/"},
+		"~foo@example.com/standup":  {Short: "~foo@example.com/standup", Long: "http://meet/foo/", Owner: "foo@example.com"},
+		"~bar@example.com/calendar": {Short: "~bar@example.com/calendar", Long: "http://cal/bar/", Owner: "bar@example.com"},
+	}
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			return link, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return(nil, nil).AnyTimes()
+	db.(*MockDatabase).EXPECT().Search(gomock.Any()).Return(nil, nil).AnyTimes()
+
+	tests := []struct {
+		link       string
+		wantStatus int
+		wantLink   string
+	}{
+		{link: "/me/standup/notes", wantStatus: http.StatusFound, wantLink: "http://meet/foo/notes"},
+		{link: "/me/calendar", wantStatus: http.StatusFound, wantLink: "http://people/calendar"},
+		{link: "/me/wiki/home", wantStatus: http.StatusFound, wantLink: "http://wiki/people/home"},
+		{link: "/me", wantStatus: http.StatusFound, wantLink: "http://people/"},
+		{link: "/standup", wantStatus: http.StatusFound, wantLink: "http://meet/team-standup/"},
+		{link: "/~bar@example.com/calendar", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.link, nil)
+			w := httptest.NewRecorder()
+			serveGo(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("serveGo(%q) = %d; want %d", tt.link, w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLink {
+				t.Errorf("serveGo(%q) = %q; want %q", tt.link, got, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestServePersonal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	links := map[string]*Link{
+		"docs":                      {Short: "docs", Long: "http://docs/"},
+		"~foo@example.com/standup":  {Short: "~foo@example.com/standup", Long: "http://meet/foo/", Owner: "foo@example.com"},
+		"~bar@example.com/calendar": {Short: "~bar@example.com/calendar", Long: "http://cal/bar/", Owner: "bar@example.com"},
+	}
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().AppendAudit(gomock.Any()).Return(nil).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPage(gomock.Any()).DoAndReturn(func(p LinkPage) ([]*Link, string, error) {
+		var page []*Link
+		for _, link := range links {
+			if id := linkID(link.Short); id > p.After && strings.HasPrefix(id, p.Prefix) {
+				page = append(page, link)
+			}
+		}
+		return page, "", nil
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := links[short]; ok {
+			return link, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return(nil, nil).AnyTimes()
+
+	// listing and export only include the current user's personal links
+	for _, tt := range []struct {
+		path  string
+		serve http.HandlerFunc
+	}{
+		{path: "/.me", serve: servePersonal},
+		{path: "/.me/export", serve: servePersonalExport},
+	} {
+		w := httptest.NewRecorder()
+		tt.serve(w, httptest.NewRequest("GET", tt.path, nil))
+		body := w.Body.String()
+		if !strings.Contains(body, "~foo@example.com/standup") || strings.Contains(body, "docs") || strings.Contains(body, "bar@example.com") {
+			t.Errorf("%s = %s; want only foo's personal links", tt.path, body)
+		}
+	}
+
+	xsrf := xsrftoken.Generate(xsrfKey, "foo@example.com", personalXSRFAction)
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantSave   string
+		wantDelete string
+		wantStatus int
+	}{
+		{
+			name:       "create",
+			form:       url.Values{"xsrf": {xsrf}, "name": {"me/review"}, "long": {"http://review/foo"}},
+			wantSave:   "~foo@example.com/review",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "update",
+			form:       url.Values{"xsrf": {xsrf}, "name": {"standup"}, "long": {"http://meet/foo2/"}},
+			wantSave:   "~foo@example.com/standup",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "delete",
+			form:       url.Values{"xsrf": {xsrf}, "name": {"standup"}, "delete": {"1"}},
+			wantDelete: "~foo@example.com/standup",
+			wantStatus: http.StatusFound,
+		},
+		{
+			name:       "delete missing link",
+			form:       url.Values{"xsrf": {xsrf}, "name": {"calendar"}, "delete": {"1"}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "invalid name",
+			form:       url.Values{"xsrf": {xsrf}, "name": {"~bar@example.com/calendar"}, "long": {"http://evil/"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too many segments",
+			form:       url.Values{"xsrf": {xsrf}, "name": {"a/b/c/d"}, "long": {"http://deep/"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing xsrf",
+			form:       url.Values{"name": {"review"}, "long": {"http://review/"}},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantSave != "" {
+				db.(*MockDatabase).EXPECT().Save(gomock.Any()).DoAndReturn(func(link *Link) error {
+					if link.Short != tt.wantSave || link.Long != tt.form.Get("long") || link.Owner != "foo@example.com" {
+						t.Errorf("saved link = %+v", link)
+					}
+					return nil
+				})
+			}
+			if tt.wantDelete != "" {
+				db.(*MockDatabase).EXPECT().Delete(tt.wantDelete).Return(nil)
+				db.(*MockDatabase).EXPECT().DeleteStats(tt.wantDelete).Return(nil)
+			}
+
+			r := httptest.NewRequest("POST", "/.me", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			servePersonal(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("servePersonal(%v) = %d; want %d: %s", tt.form, w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantSave != "" {
+				var link Link
+				if err := json.NewDecoder(w.Body).Decode(&link); err != nil {
+					t.Fatal(err)
+				}
+				if link.ID != linkID(tt.wantSave) {
+					t.Errorf("saved link ID = %q; want %q", link.ID, linkID(tt.wantSave))
+				}
+			}
+		})
+	}
+}
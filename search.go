@@ -0,0 +1,176 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"sort"
+	"strings"
+)
+
+// searchScore returns how well link matches the lowercase search terms.
+// Matches on the short name rank highest, followed by tags, description,
+// long URL, and owner.
+func searchScore(link *Link, terms []string) int {
+	short := strings.ToLower(link.Short)
+	score := 0
+	for _, term := range terms {
+		switch {
+		case linkID(short) == linkID(term):
+			score += 100
+		case strings.HasPrefix(short, term):
+			score += 40
+		case strings.Contains(short, term):
+			score += 20
+		}
+		if link.Tags.Has(term) {
+			score += 15
+		}
+		if strings.Contains(strings.ToLower(link.Description), term) {
+			score += 10
+		}
+		if strings.Contains(strings.ToLower(link.Long), term) {
+			score += 5
+		}
+		if strings.Contains(strings.ToLower(link.Owner), term) {
+			score += 3
+		}
+	}
+	return score
+}
+
+// rankLinks sorts links by descending searchScore, then by short name.
+func rankLinks(links []*Link, terms []string) {
+	scores := make(map[*Link]int, len(links))
+	for _, link := range links {
+		scores[link] = searchScore(link, terms)
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		if scores[links[i]] != scores[links[j]] {
+			return scores[links[i]] > scores[links[j]]
+		}
+		return links[i].Short < links[j].Short
+	})
+}
+
+// maxSuggestions is the maximum number of close matches suggested for an
+// unknown short name.
+const maxSuggestions = 5
+
+// maxSuggestionCandidates is the maximum number of links searched for close
+// matches to an unknown short name.
+const maxSuggestionCandidates = 50
+
+// closeMatches returns up to max links with names similar to short, best
+// match first. Names are compared in their normalized linkID form, so case
+// and dashes are ignored. Links match when they are within a small edit
+// distance of short, or when one name is a prefix or substring of the other.
+//
+// If exactly one link is within an edit distance of one, it is also returned
+// as a strong match suitable for a one-click redirect.
+func closeMatches(short string, links []*Link, max int) (matches []*Link, strong *Link) {
+	id := linkID(short)
+	if id == "" {
+		return nil, nil
+	}
+
+	type match struct {
+		link  *Link
+		score int // lower is better
+	}
+	var found []match
+	var strongMatches []*Link
+	for _, link := range links {
+		lid := linkID(link.Short)
+		if lid == "" || lid == id {
+			continue
+		}
+		d := editDistance(id, lid)
+		switch {
+		case d <= maxEditDistance(id):
+			found = append(found, match{link, d})
+			if d <= 1 {
+				strongMatches = append(strongMatches, link)
+			}
+		case len(id) >= 2 && (strings.HasPrefix(lid, id) || strings.HasPrefix(id, lid)):
+			found = append(found, match{link, 10 + abs(len(lid)-len(id))})
+		case len(id) >= 3 && (strings.Contains(lid, id) || strings.Contains(id, lid)):
+			found = append(found, match{link, 20 + abs(len(lid)-len(id))})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score < found[j].score
+		}
+		return found[i].link.Short < found[j].link.Short
+	})
+	if len(found) > max {
+		found = found[:max]
+	}
+	for _, m := range found {
+		matches = append(matches, m.link)
+	}
+	if len(strongMatches) == 1 {
+		strong = strongMatches[0]
+	}
+	return matches, strong
+}
+
+// maxEditDistance returns the largest edit distance at which a name is
+// considered a typo of id. Short names allow fewer edits.
+func maxEditDistance(id string) int {
+	switch n := len(id); {
+	case n <= 2:
+		return 0
+	case n <= 4:
+		return 1
+	case n <= 8:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b: the number of insertions, deletions, substitutions, and transpositions
+// of adjacent bytes needed to turn one into the other.
+func editDistance(a, b string) int {
+	// d[i][j] is the distance between a[:i] and b[:j]
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if v := d[i-1][j] + 1; v < d[i][j] {
+				d[i][j] = v
+			}
+			if v := d[i][j-1] + 1; v < d[i][j] {
+				d[i][j] = v
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if v := d[i-2][j-2] + 1; v < d[i][j] {
+					d[i][j] = v
+				}
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
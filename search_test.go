@@ -0,0 +1,90 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRankLinks(t *testing.T) {
+	links := []*Link{
+		{Short: "standup", Long: "https://meet/standup", Description: "daily docs sync"},
+		{Short: "api-docs", Long: "https://docs/api"},
+		{Short: "docs", Long: "https://docs/"},
+		{Short: "wiki", Long: "https://wiki/", Tags: Tags{"docs"}},
+	}
+	rankLinks(links, []string{"docs"})
+
+	var got []string
+	for _, link := range links {
+		got = append(got, link.Short)
+	}
+	want := []string{"docs", "api-docs", "wiki", "standup"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("rankLinks() = %q; want %q", got, want)
+	}
+}
+
+func TestCloseMatches(t *testing.T) {
+	links := []*Link{
+		{Short: "jira"},
+		{Short: "Meeting-Notes"},
+		{Short: "meet"},
+		{Short: "docs"},
+		{Short: "api-docs"},
+	}
+
+	tests := []struct {
+		short      string
+		want       []string
+		wantStrong string
+	}{
+		{short: "jria", want: []string{"jira"}, wantStrong: "jira"},
+		{short: "JIRA2", want: []string{"jira"}, wantStrong: "jira"},
+		{short: "meetingnote", want: []string{"Meeting-Notes", "meet"}, wantStrong: "Meeting-Notes"},
+		{short: "mee", want: []string{"meet", "Meeting-Notes"}, wantStrong: "meet"},
+		{short: "doc", want: []string{"docs", "api-docs"}, wantStrong: "docs"},
+		{short: "zzz", want: nil},
+		{short: "jira", want: nil}, // exact matches are not suggestions
+	}
+	for _, tt := range tests {
+		t.Run(tt.short, func(t *testing.T) {
+			matches, strong := closeMatches(tt.short, links, maxSuggestions)
+			var got []string
+			for _, link := range matches {
+				got = append(got, link.Short)
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("closeMatches(%q) = %q; want %q", tt.short, got, tt.want)
+			}
+			var gotStrong string
+			if strong != nil {
+				gotStrong = strong.Short
+			}
+			if gotStrong != tt.wantStrong {
+				t.Errorf("closeMatches(%q) strong match = %q; want %q", tt.short, gotStrong, tt.wantStrong)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"jira", "jira", 0},
+		{"jria", "jira", 1},
+		{"jir", "jira", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d; want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
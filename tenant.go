@@ -0,0 +1,538 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var tenantConfig = flag.String("tenant-config", "", "path to a JSON file with settings for each hostname, such as its admins and OpenSearch description")
+
+// A tenant is one of the hostnames set by the -hostname flag. Each tenant
+// has its own links, patterns, and stats, stored in the same database.
+//
+// The first hostname is the default tenant, which also serves requests in dev
+// mode and from local commands. Its links are stored as-is, so adding tenants to an existing
+// server keeps its links. Links of other tenants are stored with their short
+// names prefixed by "{hostname}:".
+type tenant struct {
+	// Hostname is the tailnet hostname of the tenant, such as "go".
+	Hostname string
+
+	// Description is shown by browsers for the tenant's OpenSearch
+	// provider.
+	Description string
+
+	// Admins are users who can change any of the tenant's links, in
+	// addition to the admins set by the -admins flag.
+	Admins []string
+
+	// name identifies the tenant's stored links and patterns. It is empty
+	// for the default tenant.
+	name string
+}
+
+// tenantSettings are the per-tenant settings in the -tenant-config file,
+// keyed by hostname.
+type tenantSettings struct {
+	Description string   `json:"description"`
+	Admins      []string `json:"admins"`
+}
+
+// defaultDescription is the OpenSearch description of tenants that don't set
+// their own.
+const defaultDescription = "Private shortlinks on your tailnet"
+
+// tenants are the tenants served, in the order of the -hostname flag. It is
+// set up by loadTenants.
+var tenants []*tenant
+
+// hostnames returns the hostnames set by the -hostname flag, in order.
+func hostnames() []string {
+	var hosts []string
+	for _, h := range strings.Split(*hostname, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// loadTenants sets up a tenant for each hostname, with settings from the
+// -tenant-config file, if set.
+func loadTenants() error {
+	settings := make(map[string]tenantSettings)
+	if *tenantConfig != "" {
+		b, err := os.ReadFile(*tenantConfig)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &settings); err != nil {
+			return fmt.Errorf("parsing %s: %w", *tenantConfig, err)
+		}
+	}
+
+	byName := make(map[string]tenantSettings, len(settings))
+	for h, s := range settings {
+		byName[tenantName(h)] = s
+	}
+
+	tenants = nil
+	seen := make(map[string]bool)
+	for i, h := range hostnames() {
+		name := tenantName(h)
+		if seen[name] {
+			return fmt.Errorf("hostname %q listed more than once", h)
+		}
+		seen[name] = true
+		t := &tenant{Hostname: h, Description: defaultDescription}
+		if i > 0 {
+			t.name = name
+		}
+		if s, ok := byName[name]; ok {
+			if s.Description != "" {
+				t.Description = s.Description
+			}
+			t.Admins = s.Admins
+		}
+		tenants = append(tenants, t)
+	}
+	for h := range settings {
+		if !seen[tenantName(h)] {
+			return fmt.Errorf("%s: %q is not one of the hostnames", *tenantConfig, h)
+		}
+	}
+	return nil
+}
+
+// tenantName returns the name of the tenant for host: its first label,
+// without a port, in lower case. For example, "Sales.example.ts.net:80" is "sales".
+func tenantName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return strings.ToLower(host)
+}
+
+// defaultTenant returns the tenant for the first hostname.
+func defaultTenant() *tenant {
+	if len(tenants) == 0 {
+		return &tenant{Hostname: *hostname, Description: defaultDescription}
+	}
+	return tenants[0]
+}
+
+// allTenants returns every tenant, or the default tenant if no hostnames are
+// configured, as in dev mode.
+func allTenants() []*tenant {
+	if len(tenants) == 0 {
+		return []*tenant{defaultTenant()}
+	}
+	return tenants
+}
+
+// tenantKey is the request context key of the tenant serving a request.
+type tenantKey struct{}
+
+// serve returns a handler that serves requests with h on behalf of t. Each
+// tenant's listener is wrapped this way, so a request's tenant is the node it
+// was received by, not the Host header, which clients can set to anything.
+func (t *tenant) serve(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	})
+}
+
+// tenantFor returns the tenant serving r, or the default tenant if r wasn't
+// received by a tenant's listener, as for requests from local commands.
+func tenantFor(r *http.Request) *tenant {
+	if t, ok := r.Context().Value(tenantKey{}).(*tenant); ok {
+		return t
+	}
+	return defaultTenant()
+}
+
+// prefix returns the prefix of the short names of t's stored links.
+func (t *tenant) prefix() string {
+	if t.name == "" {
+		return ""
+	}
+	return t.name + ":"
+}
+
+// isAdmin reports whether login is an admin of t, either for all tenants or
+// for t alone.
+func (t *tenant) isAdmin(login string) bool {
+	if isAdmin(login) {
+		return true
+	}
+	for _, a := range t.Admins {
+		if login != "" && a == login {
+			return true
+		}
+	}
+	return false
+}
+
+// db returns the database of t's links.
+func (t *tenant) db() Database {
+	return tenantDB{db: db, t: t}
+}
+
+// statsKey returns the key of t's link short in the click stats, which are
+// shared by all tenants.
+func (t *tenant) statsKey(short string) string {
+	return t.prefix() + short
+}
+
+// owns reports whether the stored short name belongs to t.
+func (t *tenant) owns(stored string) bool {
+	if t.name != "" {
+		return strings.HasPrefix(stored, t.prefix())
+	}
+	first, _, _ := strings.Cut(stored, "/")
+	return !strings.Contains(first, ":")
+}
+
+// tenantDB is a Database of one tenant's links, stored in a Database shared
+// by all tenants. Links are returned with the tenant's prefix removed from
+// their short names, and never include links of other tenants.
+type tenantDB struct {
+	db Database
+	t  *tenant
+}
+
+// stored returns the stored short name of t's link short. It returns false if
+// short can't belong to t.
+func (d tenantDB) stored(short string) (string, bool) {
+	s := d.t.prefix() + short
+	return s, d.t.owns(s)
+}
+
+// fromStored returns a copy of the stored link l, as seen by the tenant.
+func (d tenantDB) fromStored(l *Link) *Link {
+	if d.t.name == "" {
+		return l
+	}
+	c := *l
+	c.Short = strings.TrimPrefix(l.Short, d.t.prefix())
+	c.AliasOf = strings.TrimPrefix(l.AliasOf, d.t.prefix())
+	c.ID = linkID(c.Short)
+	return &c
+}
+
+// filter returns the stored links that belong to the tenant, as seen by the
+// tenant.
+func (d tenantDB) filter(links []*Link) []*Link {
+	var owned []*Link
+	for _, l := range links {
+		if d.t.owns(l.Short) {
+			owned = append(owned, d.fromStored(l))
+		}
+	}
+	return owned
+}
+
+func (d tenantDB) LoadAll() ([]*Link, error) {
+	links, err := d.db.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(links), nil
+}
+
+func (d tenantDB) LoadPage(p LinkPage) ([]*Link, string, error) {
+	p.Tenant = d.t.name
+	links, next, err := d.db.LoadPage(p)
+	if err != nil {
+		return nil, "", err
+	}
+	return d.filter(links), next, nil
+}
+
+func (d tenantDB) Load(short string) (*Link, error) {
+	s, ok := d.stored(short)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	link, err := d.db.Load(s)
+	if err != nil {
+		return nil, err
+	}
+	return d.fromStored(link), nil
+}
+
+func (d tenantDB) Save(link *Link) error {
+	c, err := d.toStored(link)
+	if err != nil {
+		return err
+	}
+	if err := d.db.Save(c); err != nil {
+		return err
+	}
+	link.ID = linkID(link.Short)
+	return nil
+}
+
+func (d tenantDB) SaveExpiryNotice(short string, expiresAt time.Time) error {
+	s, ok := d.stored(short)
+	if !ok {
+		return fs.ErrNotExist
+	}
+	return d.db.SaveExpiryNotice(s, expiresAt)
+}
+
+func (d tenantDB) SaveLinks(links []*Link) error {
+	stored := make([]*Link, len(links))
+	for i, link := range links {
+		c, err := d.toStored(link)
+		if err != nil {
+			return err
+		}
+		stored[i] = c
+	}
+	if err := d.db.SaveLinks(stored); err != nil {
+		return err
+	}
+	for _, link := range links {
+		link.ID = linkID(link.Short)
+	}
+	return nil
+}
+
+func (d tenantDB) TransferLinks(q LinkTransfer) ([]*Link, error) {
+	q.Tenant = d.t.name
+	if q.Shorts != nil {
+		shorts, err := d.storedShorts(q.Shorts)
+		if err != nil {
+			return nil, err
+		}
+		q.Shorts = shorts
+	}
+	if audit := q.Audit; audit != nil {
+		q.Audit = func(before, after *Link) *AuditEntry {
+			entry := audit(d.fromStored(before), d.fromStored(after))
+			entry.Tenant = d.t.name
+			return entry
+		}
+	}
+	links, err := d.db.TransferLinks(q)
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(links), nil
+}
+
+// toStored returns link as it is stored in the shared database, with the
+// tenant's prefix added to its short name and alias.
+func (d tenantDB) toStored(link *Link) (*Link, error) {
+	s, ok := d.stored(link.Short)
+	if !ok {
+		return nil, fmt.Errorf("invalid short name %q", link.Short)
+	}
+	if d.t.name == "" {
+		return link, nil
+	}
+	c := *link
+	c.Short = s
+	if c.AliasOf != "" {
+		c.AliasOf = d.t.prefix() + c.AliasOf
+	}
+	return &c, nil
+}
+
+func (d tenantDB) Delete(short string) error {
+	s, ok := d.stored(short)
+	if !ok {
+		return fs.ErrNotExist
+	}
+	return d.db.Delete(s)
+}
+
+func (d tenantDB) DeleteLinks(q LinkDeletion) ([]*Link, error) {
+	shorts, err := d.storedShorts(q.Shorts)
+	if err != nil {
+		return nil, err
+	}
+	q.Shorts = shorts
+	if audit := q.Audit; audit != nil {
+		q.Audit = func(link *Link) *AuditEntry {
+			entry := audit(d.fromStored(link))
+			entry.Tenant = d.t.name
+			return entry
+		}
+	}
+	links, err := d.db.DeleteLinks(q)
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(links), nil
+}
+
+// storedShorts returns the stored short names of the tenant's links named
+// shorts.
+func (d tenantDB) storedShorts(shorts []string) ([]string, error) {
+	stored := make([]string, len(shorts))
+	for i, short := range shorts {
+		s, ok := d.stored(short)
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		stored[i] = s
+	}
+	return stored, nil
+}
+
+func (d tenantDB) Search(q LinkSearch) ([]*Link, error) {
+	q.Tenant = d.t.name
+	links, err := d.db.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(links), nil
+}
+
+func (d tenantDB) LoadExpired(q LinkExpiry) ([]*Link, error) {
+	q.Tenant = d.t.name
+	links, err := d.db.LoadExpired(q)
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(links), nil
+}
+
+func (d tenantDB) LoadAliases(short string) ([]*Link, error) {
+	s, ok := d.stored(short)
+	if !ok {
+		return nil, nil
+	}
+	links, err := d.db.LoadAliases(s)
+	if err != nil {
+		return nil, err
+	}
+	return d.filter(links), nil
+}
+
+func (d tenantDB) LoadPatterns() ([]*Pattern, error) {
+	patterns, err := d.db.LoadPatterns()
+	if err != nil {
+		return nil, err
+	}
+	var owned []*Pattern
+	for _, p := range patterns {
+		if p.Tenant == d.t.name {
+			owned = append(owned, p)
+		}
+	}
+	return owned, nil
+}
+
+func (d tenantDB) LoadPattern(id uint) (*Pattern, error) {
+	p, err := d.db.LoadPattern(id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Tenant != d.t.name {
+		return nil, fs.ErrNotExist
+	}
+	return p, nil
+}
+
+func (d tenantDB) SavePattern(p *Pattern) error {
+	p.Tenant = d.t.name
+	return d.db.SavePattern(p)
+}
+
+func (d tenantDB) DeletePattern(id uint) error {
+	if _, err := d.LoadPattern(id); err != nil {
+		return err
+	}
+	return d.db.DeletePattern(id)
+}
+
+func (d tenantDB) LoadStats() (ClickStats, error) {
+	stats, err := d.db.LoadStats()
+	if err != nil {
+		return nil, err
+	}
+	owned := make(ClickStats)
+	for short, clicks := range stats {
+		if d.t.owns(short) {
+			owned[strings.TrimPrefix(short, d.t.prefix())] = clicks
+		}
+	}
+	return owned, nil
+}
+
+func (d tenantDB) LoadLastClicks() (map[string]time.Time, error) {
+	last, err := d.db.LoadLastClicks()
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]time.Time)
+	for short, at := range last {
+		if d.t.owns(short) {
+			owned[strings.TrimPrefix(short, d.t.prefix())] = at
+		}
+	}
+	return owned, nil
+}
+
+func (d tenantDB) SaveStats(stats ClickStats) error {
+	stored := make(ClickStats, len(stats))
+	for short, clicks := range stats {
+		stored[d.t.prefix()+short] = clicks
+	}
+	return d.db.SaveStats(stored)
+}
+
+func (d tenantDB) DeleteStats(short string) error {
+	return d.db.DeleteStats(d.t.prefix() + short)
+}
+
+func (d tenantDB) AppendAudit(entry *AuditEntry) error {
+	entry.Tenant = d.t.name
+	return d.db.AppendAudit(entry)
+}
+
+func (d tenantDB) LoadAudit(q AuditQuery) ([]*AuditEntry, error) {
+	q.Tenant = d.t.name
+	return d.db.LoadAudit(q)
+}
+
+func (d tenantDB) SaveDelivery(del *WebhookDelivery) error {
+	del.Tenant = d.t.name
+	return d.db.SaveDelivery(del)
+}
+
+// LoadDueDeliveries returns the due webhook deliveries of all tenants, since
+// they are delivered together.
+func (d tenantDB) LoadDueDeliveries(q DueDeliveryQuery) ([]*WebhookDelivery, error) {
+	return d.db.LoadDueDeliveries(q)
+}
+
+func (d tenantDB) LoadDeliveries(q DeliveryQuery) ([]*WebhookDelivery, error) {
+	q.Tenant = d.t.name
+	return d.db.LoadDeliveries(q)
+}
+
+// LoadCheckpoint returns the checkpoint shared by all tenants, since
+// background tasks run for all of them together.
+func (d tenantDB) LoadCheckpoint(name string) (time.Time, error) {
+	return d.db.LoadCheckpoint(name)
+}
+
+func (d tenantDB) SaveCheckpoint(name string, t time.Time) error {
+	return d.db.SaveCheckpoint(name, t)
+}
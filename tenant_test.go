@@ -0,0 +1,257 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+// setTenants sets up tenants for hosts, with the tenant config in
+// config, for the duration of the test.
+func setTenants(t *testing.T, hosts, config string) {
+	t.Helper()
+	oldHostname, oldConfig, oldTenants := *hostname, *tenantConfig, tenants
+	t.Cleanup(func() {
+		*hostname, *tenantConfig, tenants = oldHostname, oldConfig, oldTenants
+	})
+	*hostname, *tenantConfig = hosts, ""
+	if config != "" {
+		*tenantConfig = filepath.Join(t.TempDir(), "tenants.json")
+		if err := os.WriteFile(*tenantConfig, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadTenants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	setTenants(t, "go, Sales,partner", `{"sales": {"description": "Sales links", "admins": ["boss@example.com"]}}`)
+
+	for i, want := range []struct {
+		hostname string
+		name     string
+		admin    bool
+	}{
+		{hostname: "go"},
+		{hostname: "Sales", name: "sales", admin: true},
+		{hostname: "partner", name: "partner"},
+	} {
+		got := tenants[i]
+		if got.Hostname != want.hostname || got.name != want.name {
+			t.Errorf("tenants[%d] = %q, %q; want %q, %q", i, got.Hostname, got.name, want.hostname, want.name)
+		}
+		if admin := got.isAdmin("boss@example.com"); admin != want.admin {
+			t.Errorf("tenants[%d].isAdmin(boss) = %v; want %v", i, admin, want.admin)
+		}
+	}
+	if d := tenants[1].Description; d != "Sales links" {
+		t.Errorf("sales description = %q; want %q", d, "Sales links")
+	}
+	if d := tenants[0].Description; d != defaultDescription {
+		t.Errorf("go description = %q; want %q", d, defaultDescription)
+	}
+
+	for _, tt := range []struct{ hosts, config string }{
+		{hosts: "go,sales,go"},
+		{hosts: "go", config: `{"sales": {}}`},
+		{hosts: "go", config: `not json`},
+	} {
+		*hostname, *tenantConfig = tt.hosts, ""
+		if tt.config != "" {
+			*tenantConfig = filepath.Join(t.TempDir(), "tenants.json")
+			os.WriteFile(*tenantConfig, []byte(tt.config), 0o600)
+		}
+		if err := loadTenants(); err == nil {
+			t.Errorf("loadTenants(%q, %q) = nil; want error", tt.hosts, tt.config)
+		}
+	}
+}
+
+func TestTenantFor(t *testing.T) {
+	setTenants(t, "go,sales", "")
+
+	tests := []struct {
+		name   string
+		host   string
+		served *tenant
+		want   string
+	}{
+		{name: "served by tenant", host: "sales", served: tenants[1], want: "sales"},
+		{name: "host of another tenant", host: "sales", served: tenants[0], want: "go"},
+		{name: "host ignored without listener", host: "sales", want: "go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *tenant
+			var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = tenantFor(r)
+			})
+			if tt.served != nil {
+				h = tt.served.serve(h)
+			}
+			r := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if got.Hostname != tt.want {
+				t.Errorf("tenantFor(%q) = %q; want %q", tt.host, got.Hostname, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	setTenants(t, "go,sales", "")
+
+	// stored holds links by their stored short names
+	stored := map[string]*Link{
+		"wiki":       {Short: "wiki", Long: "http://eng-wiki/"},
+		"docs":       {Short: "docs", Long: "http://eng-docs/"},
+		"sales:wiki": {Short: "sales:wiki", Long: "http://sales-wiki/"},
+	}
+	db = NewMockDatabase(ctrl)
+	db.(*MockDatabase).EXPECT().Load(gomock.Any()).DoAndReturn(func(short string) (*Link, error) {
+		if link, ok := stored[short]; ok {
+			c := *link
+			return &c, nil
+		}
+		return nil, fs.ErrNotExist
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadAll().DoAndReturn(func() ([]*Link, error) {
+		var all []*Link
+		for _, link := range stored {
+			c := *link
+			all = append(all, &c)
+		}
+		return all, nil
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().Search(gomock.Any()).DoAndReturn(func(LinkSearch) ([]*Link, error) {
+		// every link matches, so tenantDB is left to filter them
+		var all []*Link
+		for _, link := range stored {
+			c := *link
+			all = append(all, &c)
+		}
+		return all, nil
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPage(gomock.Any()).DoAndReturn(func(p LinkPage) ([]*Link, string, error) {
+		var page []*Link
+		for _, link := range stored {
+			id, prefix := linkID(link.Short), p.Prefix
+			owned := !strings.Contains(id, ":")
+			if p.Tenant != "" {
+				prefix = linkID(p.Tenant+":") + prefix
+				owned = strings.HasPrefix(id, prefix)
+			}
+			if owned && id > p.After && strings.HasPrefix(id, prefix) {
+				c := *link
+				c.ID = id
+				page = append(page, &c)
+			}
+		}
+		sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+		if len(page) > p.Limit {
+			page = page[:p.Limit]
+			return page, page[p.Limit-1].ID, nil
+		}
+		return page, "", nil
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().Save(gomock.Any()).DoAndReturn(func(link *Link) error {
+		link.ID = linkID(link.Short)
+		stored[link.Short] = link
+		return nil
+	}).AnyTimes()
+	db.(*MockDatabase).EXPECT().LoadPatterns().Return([]*Pattern{
+		{Regexp: `pr([0-9]+)`, Long: "http://eng-review/"},
+		{Regexp: `pr([0-9]+)`, Long: "http://sales-review/", Tenant: "sales"},
+	}, nil).AnyTimes()
+
+	tests := []struct {
+		host     string
+		link     string
+		wantLink string
+	}{
+		{host: "go", link: "/wiki", wantLink: "http://eng-wiki/"},
+		{host: "sales", link: "/wiki", wantLink: "http://sales-wiki/"},
+		{host: "go", link: "/pr1", wantLink: "http://eng-review/"},
+		{host: "sales", link: "/pr1", wantLink: "http://sales-review/"},
+		{host: "sales", link: "/docs"},
+		{host: "go", link: "/sales:wiki"},
+	}
+	byHost := map[string]*tenant{"go": tenants[0], "sales": tenants[1]}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.link, nil)
+		w := httptest.NewRecorder()
+		byHost[tt.host].serve(http.HandlerFunc(serveGo)).ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); got != tt.wantLink {
+			t.Errorf("serveGo(%s%s) = %q; want %q", tt.host, tt.link, got, tt.wantLink)
+		}
+	}
+
+	sales := tenants[1]
+	links, err := sales.db().LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Short != "wiki" || links[0].ID != "wiki" {
+		t.Errorf("sales links = %+v; want only wiki", links)
+	}
+
+	links, next, err := sales.db().LoadPage(LinkPage{Limit: 10})
+	if err != nil || next != "" || len(links) != 1 || links[0].Short != "wiki" {
+		t.Errorf("sales page = %+v, %q, %v; want only wiki", links, next, err)
+	}
+
+	// pages of the default tenant skip other tenants' links, and are refilled
+	links, next, err = loadPage(defaultTenant(), LinkPage{Limit: 2}, nil)
+	if err != nil || next != "" || len(links) != 2 || links[0].Short != "docs" || links[1].Short != "wiki" {
+		t.Errorf("default tenant page = %+v, %q, %v; want docs and wiki", links, next, err)
+	}
+
+	link := &Link{Short: "deck", Long: "http://slides/"}
+	if err := sales.db().Save(link); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored["sales:deck"]; !ok || link.ID != "deck" {
+		t.Errorf("saved sales link with ID %q; want stored as sales:deck with ID deck", link.ID)
+	}
+	alias := &Link{Short: "slides", AliasOf: "deck"}
+	if err := sales.db().Save(alias); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored["sales:slides"].AliasOf; got != "sales:deck" {
+		t.Errorf("stored alias of = %q; want %q", got, "sales:deck")
+	}
+	if got, err := sales.db().Load("slides"); err != nil || got.AliasOf != "deck" {
+		t.Errorf("loaded alias = %+v, %v; want alias of deck", got, err)
+	}
+}
+
+func TestServeOpenSearchTenant(t *testing.T) {
+	setTenants(t, "go,sales", `{"sales": {"description": "Sales links"}}`)
+
+	r := httptest.NewRequest("GET", "http://sales/.opensearch", nil)
+	w := httptest.NewRecorder()
+	tenants[1].serve(http.HandlerFunc(serveOpenSearch)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("serveOpenSearch() = %d; want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"<ShortName>sales</ShortName>", "<Description>Sales links</Description>", "http://sales/.suggest"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("serveOpenSearch() body does not contain %q:\n%s", want, body)
+		}
+	}
+}
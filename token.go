@@ -0,0 +1,97 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+var apiTokensFile = flag.String("api-tokens", "", "path to a JSON file mapping API tokens to the users they authenticate as")
+
+// apiTokens maps API tokens to the users they authenticate as. It is loaded
+// from the -api-tokens file by loadAPITokens.
+var apiTokens map[string]string
+
+// loadAPITokens loads apiTokens from the -api-tokens file, if set.
+func loadAPITokens() error {
+	if *apiTokensFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(*apiTokensFile)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]string)
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return fmt.Errorf("parsing %s: %w", *apiTokensFile, err)
+	}
+	for token, login := range tokens {
+		if token == "" || login == "" {
+			return fmt.Errorf("%s: tokens and users must not be empty", *apiTokensFile)
+		}
+	}
+	apiTokens = tokens
+	return nil
+}
+
+// tokenUsers returns the users that API tokens authenticate as, sorted, for
+// recording in the audit log without the tokens themselves.
+func tokenUsers() []string {
+	var users []string
+	for _, login := range apiTokens {
+		users = append(users, login)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// bearerToken returns the token of r's "Authorization: Bearer" header, if
+// any.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+// tokenUser returns the user authenticated by r's API token. It returns false
+// if r has no API token, or an unknown one.
+func tokenUser(r *http.Request) (string, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", false
+	}
+	login, ok := apiTokens[token]
+	return login, ok
+}
+
+// checkAPIToken rejects requests to h with an unknown API token, rather than
+// serving them as an anonymous user.
+func checkAPIToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			if _, ok := tokenUser(r); !ok {
+				http.Error(w, "invalid API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validXSRF reports whether token is a valid XSRF token for login and action.
+// Requests authenticated by an API token don't need one, since browsers
+// don't send API tokens on their own.
+func validXSRF(r *http.Request, token, login, action string) bool {
+	if _, ok := tokenUser(r); ok {
+		return true
+	}
+	return xsrftoken.Valid(token, xsrfKey, login, action)
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestLoadAPITokens(t *testing.T) {
+	oldFile, oldTokens := *apiTokensFile, apiTokens
+	t.Cleanup(func() { *apiTokensFile, apiTokens = oldFile, oldTokens })
+
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: `{"secret": "bot@example.com"}`},
+		{config: `{"secret": ""}`, wantErr: true},
+		{config: `not json`, wantErr: true},
+	} {
+		*apiTokensFile = filepath.Join(t.TempDir(), "tokens.json")
+		os.WriteFile(*apiTokensFile, []byte(tt.config), 0o600)
+		if err := loadAPITokens(); (err != nil) != tt.wantErr {
+			t.Errorf("loadAPITokens(%s) = %v; want error %v", tt.config, err, tt.wantErr)
+		}
+	}
+	if apiTokens["secret"] != "bot@example.com" {
+		t.Errorf("apiTokens = %v; want secret for bot@example.com", apiTokens)
+	}
+}
+
+func TestCheckAPIToken(t *testing.T) {
+	setAPITokens(t, map[string]string{"secret": "bot@example.com"}, "")
+
+	h := checkAPIToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login, _ := currentUser(r)
+		if !validXSRF(r, r.FormValue("xsrf"), login, "action") {
+			http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(login))
+	}))
+
+	tests := []struct {
+		name       string
+		auth       string
+		xsrf       string
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "token", auth: "Bearer secret", wantStatus: http.StatusOK, wantUser: "bot@example.com"},
+		{name: "unknown token", auth: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "no token", wantStatus: http.StatusBadRequest},
+		{name: "no token with xsrf", xsrf: xsrftoken.Generate(xsrfKey, "foo@example.com", "action"), wantStatus: http.StatusOK, wantUser: "foo@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/?xsrf="+tt.xsrf, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantUser != "" && w.Body.String() != tt.wantUser {
+				t.Errorf("user = %q; want %q", w.Body.String(), tt.wantUser)
+			}
+		})
+	}
+}
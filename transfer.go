@@ -0,0 +1,142 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// transferXSRFAction is the XSRF action for transferring links on the
+// /.transfer page.
+const transferXSRFAction = ".transfer"
+
+// transferData is the data used by the transferTmpl template, and the JSON
+// response to /.transfer requests.
+type transferData struct {
+	From   string
+	To     string
+	DryRun bool
+
+	// Links are the short names of the links transferred, or that would be
+	// by a dry run.
+	Links []string
+
+	XSRF  string `json:"-"`
+	Error string `json:"-"`
+}
+
+// transferLinks moves every shared link owned by from to to, and returns
+// their short names. Each transferred link is recorded in the audit log as
+// changed by actor, in the same transaction. If dryRun is set, the links
+// are only listed. Personal links are left in their user's namespace.
+func transferLinks(t *tenant, from, to string, actor auditActor, dryRun bool) ([]string, error) {
+	if dryRun {
+		links, err := loadOwned(t, from)
+		if err != nil {
+			return nil, err
+		}
+		shorts := make([]string, len(links))
+		for i, link := range links {
+			shorts[i] = link.Short
+		}
+		return shorts, nil
+	}
+
+	before := make(map[string]*Link)
+	links, err := t.db().TransferLinks(LinkTransfer{
+		From: from,
+		To:   to,
+		Time: time.Now().UTC(),
+		Audit: func(prev, link *Link) *AuditEntry {
+			before[link.Short] = prev
+			return actor.entry(auditLinkTransfer, link.Short, prev, link)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	shorts := make([]string, len(links))
+	for i, link := range links {
+		shorts[i] = link.Short
+		queueLinkEvent(t, auditLinkTransfer, actor.Login, before[link.Short], link)
+	}
+	return shorts, nil
+}
+
+// serveTransfer lets admins move all the links of one owner to another user
+// or group, such as when someone leaves. The "from" and "to" request values
+// name the owners. POST requests transfer the links, unless "dry_run" is
+// set, in which case the links that would be transferred are only listed.
+func serveTransfer(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !t.isAdmin(login) {
+		http.Error(w, "only admins can transfer links", http.StatusForbidden)
+		return
+	}
+
+	data := transferData{
+		From: strings.TrimSpace(r.FormValue("from")),
+		To:   strings.TrimSpace(r.FormValue("to")),
+		XSRF: xsrftoken.Generate(xsrfKey, login, transferXSRFAction),
+	}
+	if r.Method != "POST" {
+		transferTmpl.Execute(w, data)
+		return
+	}
+
+	if !validXSRF(r, r.PostFormValue("xsrf"), login, transferXSRFAction) {
+		http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+		return
+	}
+	if data.DryRun, err = parseFormBool(r.PostFormValue("dry_run")); err != nil {
+		http.Error(w, "dry_run must be a boolean", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	switch {
+	case data.From == "" || data.To == "":
+		data.Error, status = "from and to required", http.StatusBadRequest
+	case data.From == data.To:
+		data.Error, status = "from and to must be different owners", http.StatusBadRequest
+	default:
+		exists, err := ownerExists(r.Context(), data.To)
+		if err != nil {
+			log.Printf("looking up tailnet user %q: %v", data.To, err)
+		}
+		if !exists {
+			data.Error, status = "new owner not a valid user or group: "+data.To, http.StatusBadRequest
+		}
+	}
+	if data.Error == "" {
+		if data.Links, err = transferLinks(t, data.From, data.To, requestActor(r), data.DryRun); err != nil {
+			data.Error, status = err.Error(), http.StatusInternalServerError
+		}
+	}
+
+	if !acceptHTML(r) {
+		if data.Error != "" {
+			http.Error(w, data.Error, status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data)
+		return
+	}
+	w.WriteHeader(status)
+	transferTmpl.Execute(w, data)
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestServeTransfer(t *testing.T) {
+	links := map[string]*Link{
+		"docs":                     {Short: "docs", Long: "http://docs/", Owner: "bob@example.com"},
+		"wiki":                     {Short: "wiki", Long: "http://wiki/", Owner: "bob@example.com", Locked: true},
+		"plans":                    {Short: "plans", Long: "http://plans/", Owner: "amelie@example.com"},
+		"~bob@example.com/standup": {Short: "~bob@example.com/standup", Long: "http://meet/", Owner: "bob@example.com"},
+	}
+	fakeLinks(t, links)
+	setAPITokens(t, nil, "foo@example.com")
+	oldGroups := groups
+	groups = map[string][]string{"eng": {"amelie@example.com"}}
+	t.Cleanup(func() { groups = oldGroups })
+
+	xsrf := xsrftoken.Generate(xsrfKey, "foo@example.com", transferXSRFAction)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/.transfer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveTransfer(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+		wantLinks  string
+	}{
+		{name: "no xsrf", form: url.Values{"from": {"bob@example.com"}, "to": {"group:eng"}}, wantStatus: http.StatusBadRequest},
+		{name: "same owner", form: url.Values{"xsrf": {xsrf}, "from": {"bob@example.com"}, "to": {"bob@example.com"}}, wantStatus: http.StatusBadRequest},
+		{name: "unknown group", form: url.Values{"xsrf": {xsrf}, "from": {"bob@example.com"}, "to": {"group:sales"}}, wantStatus: http.StatusBadRequest},
+		{name: "dry run", form: url.Values{"xsrf": {xsrf}, "from": {"bob@example.com"}, "to": {"group:eng"}, "dry_run": {"true"}}, wantStatus: http.StatusOK, wantLinks: "docs,wiki"},
+		{name: "transfer", form: url.Values{"xsrf": {xsrf}, "from": {"bob@example.com"}, "to": {"group:eng"}}, wantStatus: http.StatusOK, wantLinks: "docs,wiki"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dryRun := tt.form.Get("dry_run") == "true"
+			w := post(tt.form)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("serveTransfer() = %d; want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var data transferData
+			if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(data.Links, ","); got != tt.wantLinks || data.DryRun != dryRun {
+				t.Errorf("serveTransfer() = %+v; want links %s", data, tt.wantLinks)
+			}
+			if got := links["docs"].Owner; (got == "group:eng") == dryRun {
+				t.Errorf("after transfer, docs owned by %q", got)
+			}
+		})
+	}
+
+	if got := links["wiki"]; got.Owner != "group:eng" || got.LastEdit.IsZero() {
+		t.Errorf("transferred locked link = %+v", got)
+	}
+	if got := links["~bob@example.com/standup"].Owner; got != "bob@example.com" {
+		t.Errorf("personal link transferred to %q", got)
+	}
+	if got := links["plans"].Owner; got != "amelie@example.com" {
+		t.Errorf("another user's link transferred to %q", got)
+	}
+
+	// members of the owning group can now edit the links
+	if !isOwner(links["docs"], "amelie@example.com") || isOwner(links["docs"], "bob@example.com") {
+		t.Errorf("isOwner(%q) for group members is wrong", links["docs"].Owner)
+	}
+
+	setAPITokens(t, nil, "")
+	if w := post(url.Values{"xsrf": {xsrf}, "from": {"amelie@example.com"}, "to": {"bob@example.com"}}); w.Code != http.StatusForbidden {
+		t.Errorf("serveTransfer() by non-admin = %d; want %d", w.Code, http.StatusForbidden)
+	}
+}
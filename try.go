@@ -0,0 +1,136 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// tryXSRFAction is the XSRF action for trying destination templates.
+const tryXSRFAction = ".try"
+
+// tryXSRFHeader is the header API clients without an API token send the XSRF
+// token returned by GET /.try in, instead of the try_xsrf form value.
+const tryXSRFHeader = "X-Golink-XSRF"
+
+// tryData is the data used by the tryTmpl template, and returned as JSON by
+// the /.try API.
+type tryData struct {
+	// Long is the destination template being tried.
+	Long string
+
+	// Path, Query, User, and Now are the sample values the template is
+	// expanded with.
+	Path  string
+	Query string
+	User  string
+	Now   time.Time
+
+	// QueryMode is the query mode used to expand Long.
+	QueryMode string
+
+	// Result is the expanded destination, if expansion succeeded.
+	Result string `json:",omitempty"`
+
+	// Error describes why expansion failed, if it did.
+	Error string `json:",omitempty"`
+
+	// XSRF is the token needed to expand templates, for clients without
+	// an API token.
+	XSRF string
+}
+
+// serveTry expands a destination template with sample values, so that link
+// owners can see what a link will resolve to before saving it. It accepts
+// the "long", "path", "query", "user", "now", and "query_mode" request
+// values, which may be sent by the link detail form. The user defaults to
+// the current user, and the time to the current time.
+//
+// Templates are only expanded for POST requests with a valid XSRF token, so
+// that other sites can't make browsers run templates. The token is sent in
+// the try_xsrf form value or the X-Golink-XSRF header, and is not needed with
+// an API token. GET requests show the form filled in with the request values,
+// and return the token to JSON clients.
+func serveTry(w http.ResponseWriter, r *http.Request) {
+	login, _ := currentUser(r)
+	data := tryData{
+		Long:      r.FormValue("long"),
+		Path:      strings.TrimPrefix(r.FormValue("path"), "/"),
+		Query:     strings.TrimPrefix(r.FormValue("query"), "?"),
+		QueryMode: r.FormValue("query_mode"),
+	}
+	if v, ok := optionalFormValue(r, "user"); ok {
+		data.User = v
+	} else {
+		data.User = login
+	}
+	data.Now = time.Now().UTC().Truncate(time.Minute)
+	if v := r.FormValue("now"); v != "" {
+		t, err := parseFormTime(v)
+		if err != nil {
+			data.Error = "invalid now time: " + err.Error()
+		}
+		data.Now = t
+	}
+	if r.Method == "POST" {
+		token := r.PostFormValue("try_xsrf")
+		if token == "" {
+			token = r.Header.Get(tryXSRFHeader)
+		}
+		if !validXSRF(r, token, login, tryXSRFAction) {
+			http.Error(w, "invalid XSRF token", http.StatusBadRequest)
+			return
+		}
+		if data.Long != "" && data.Error == "" {
+			data.Result, data.Error = tryExpand(data)
+		}
+	}
+	data.XSRF = xsrftoken.Generate(xsrfKey, login, tryXSRFAction)
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data)
+		return
+	}
+	tryTmpl.Execute(w, data)
+}
+
+// tryExpand expands data.Long with the sample values in data, returning the
+// result or a description of the error.
+func tryExpand(data tryData) (result, errMsg string) {
+	if !validQueryMode(data.QueryMode) {
+		return "", `query_mode must be empty, "pass", "merge", or "drop"`
+	}
+	query, err := url.ParseQuery(data.Query)
+	if err != nil {
+		return "", "invalid query: " + err.Error()
+	}
+	if _, err := parseLinkTemplate(data.Long); err != nil {
+		return "", "long contains an invalid template: " + err.Error()
+	}
+	env := expandEnv{
+		Now:       data.Now,
+		Path:      data.Path,
+		Query:     newTemplateQuery(query),
+		user:      data.User,
+		queryMode: data.QueryMode,
+	}
+	result, err = expandLink(data.Long, env)
+	if err != nil {
+		if errors.Is(err, errNoUser) {
+			return "", "link requires a valid user: " + err.Error()
+		}
+		return "", err.Error()
+	}
+	return result, ""
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+func TestServeTry(t *testing.T) {
+	xsrf := xsrftoken.Generate(xsrfKey, "foo@example.com", tryXSRFAction)
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantResult string
+		wantError  string
+	}{
+		{
+			name:       "path",
+			form:       url.Values{"long": {"http://who/"}, "path": {"/amelie"}},
+			wantResult: "http://who/amelie",
+		},
+		{
+			name:       "user",
+			form:       url.Values{"long": {"http://who/{{.User}}"}, "user": {"amelie@example.com"}},
+			wantResult: "http://who/amelie@example.com",
+		},
+		{
+			name:      "no user",
+			form:      url.Values{"long": {"http://who/{{.User}}"}, "user": {""}},
+			wantError: "link requires a valid user",
+		},
+		{
+			name:       "now",
+			form:       url.Values{"long": {`http://wiki/{{.Now.Format "2006-01-02"}}`}, "now": {"2022-06-02T15:04"}},
+			wantResult: "http://wiki/2022-06-02",
+		},
+		{
+			name:       "query",
+			form:       url.Values{"long": {"http://search/"}, "query": {"?q=foo"}, "query_mode": {"pass"}},
+			wantResult: "http://search/?q=foo",
+		},
+		{
+			name:      "parse error",
+			form:      url.Values{"long": {"http://who/{{.Path"}},
+			wantError: "long contains an invalid template: template: :1: unclosed action",
+		},
+		{
+			name:      "unknown field",
+			form:      url.Values{"long": {"http://who/{{.Foo}}"}},
+			wantError: "can't evaluate field Foo",
+		},
+		{
+			name:      "invalid time",
+			form:      url.Values{"long": {"http://who/"}, "now": {"tomorrow"}},
+			wantError: "invalid now time",
+		},
+		{
+			name:      "invalid query mode",
+			form:      url.Values{"long": {"http://who/"}, "query_mode": {"all"}},
+			wantError: "query_mode must be",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("try_xsrf", xsrf)
+			r := httptest.NewRequest("POST", "/.try", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			serveTry(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("serveTry(%v) = %d; want %d", tt.form, w.Code, http.StatusOK)
+			}
+			var got tryData
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Result != tt.wantResult {
+				t.Errorf("serveTry(%v) result = %q; want %q", tt.form, got.Result, tt.wantResult)
+			}
+			if !strings.Contains(got.Error, tt.wantError) || (tt.wantError == "") != (got.Error == "") {
+				t.Errorf("serveTry(%v) error = %q; want %q", tt.form, got.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestServeTryRequiresPost(t *testing.T) {
+	form := url.Values{"long": {"http://who/{{.Path}}"}, "path": {"amelie"}}
+
+	t.Run("get", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/.try?"+form.Encode(), nil)
+		w := httptest.NewRecorder()
+		serveTry(w, r)
+
+		var got tryData
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Long != form.Get("long") || got.Result != "" {
+			t.Errorf("serveTry(GET) = %+v; want the form filled in and not expanded", got)
+		}
+
+		// JSON clients send the token back in a header
+		r = httptest.NewRequest("POST", "/.try", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set(tryXSRFHeader, got.XSRF)
+		w = httptest.NewRecorder()
+		serveTry(w, r)
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Result != "http://who/amelie" {
+			t.Errorf("serveTry(POST with XSRF header) = %+v; want expanded", got)
+		}
+	})
+
+	t.Run("missing xsrf", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/.try", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveTry(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("serveTry(POST without XSRF) = %d; want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
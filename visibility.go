@@ -0,0 +1,164 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var groupsFile = flag.String("groups", "", "path to a JSON file mapping group names to their members, for restricting links to groups")
+
+// Link visibilities control who can resolve and list a link. The owner of a
+// link and admins can always see it.
+const (
+	// visibilityPublic links can be resolved and listed by anyone. This is
+	// the default.
+	visibilityPublic = ""
+
+	// visibilityUnlisted links can be resolved by anyone, but are hidden
+	// from listings, search, and exports.
+	visibilityUnlisted = "unlisted"
+
+	// visibilityRestricted links can only be resolved and listed by the
+	// users and groups in the link's AllowedUsers.
+	visibilityRestricted = "restricted"
+)
+
+// validVisibility reports whether v is a known link visibility.
+func validVisibility(v string) bool {
+	switch v {
+	case visibilityPublic, visibilityUnlisted, visibilityRestricted:
+		return true
+	}
+	return false
+}
+
+// groupPrefix marks a principal as a group rather than a user.
+const groupPrefix = "group:"
+
+// groups maps group names, without groupPrefix, to their members. It is
+// loaded from the -groups file on startup.
+var groups map[string][]string
+
+// loadGroups loads groups from the -groups file, if set.
+func loadGroups() error {
+	if *groupsFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(*groupsFile)
+	if err != nil {
+		return err
+	}
+	var g map[string][]string
+	if err := json.Unmarshal(b, &g); err != nil {
+		return fmt.Errorf("parsing %s: %w", *groupsFile, err)
+	}
+	groups = g
+	return nil
+}
+
+// inPrincipals reports whether login is one of ps, or a member of one of the
+// groups in ps.
+func inPrincipals(ps Principals, login string) bool {
+	if login == "" {
+		return false
+	}
+	for _, p := range ps {
+		if group, ok := strings.CutPrefix(p, groupPrefix); ok {
+			for _, member := range groups[group] {
+				if member == login {
+					return true
+				}
+			}
+		} else if p == login {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwner reports whether login owns link, either directly or as a member of
+// the group that owns it.
+func isOwner(link *Link, login string) bool {
+	if strings.HasPrefix(link.Owner, groupPrefix) {
+		return inPrincipals(Principals{link.Owner}, login)
+	}
+	return link.Owner == login
+}
+
+// ownerExists reports whether owner, a user or a group prefixed with
+// "group:", exists and can own links.
+func ownerExists(ctx context.Context, owner string) (bool, error) {
+	if group, ok := strings.CutPrefix(owner, groupPrefix); ok {
+		_, ok := groups[group]
+		return ok, nil
+	}
+	return userExists(ctx, owner)
+}
+
+// canView reports whether login can resolve t's link and see its details.
+// Personal links can only be seen by the user they belong to.
+func canView(t *tenant, link *Link, login string) bool {
+	if owner, _, ok := cutPersonal(link.Short); ok {
+		return owner == login
+	}
+	if link.Visibility != visibilityRestricted {
+		return true
+	}
+	return isOwner(link, login) || t.isAdmin(login) || inPrincipals(link.AllowedUsers, login)
+}
+
+// isListed reports whether link is shown to login in listings, search
+// results, and exports. Personal links are only listed on their user's
+// personal links page.
+func isListed(t *tenant, link *Link, login string) bool {
+	if _, _, ok := cutPersonal(link.Short); ok {
+		return false
+	}
+	switch link.Visibility {
+	case visibilityUnlisted:
+		return isOwner(link, login) || t.isAdmin(login)
+	case visibilityRestricted:
+		return canView(t, link, login)
+	}
+	return true
+}
+
+// listedLinks returns the links that are listed for login.
+func listedLinks(t *tenant, links []*Link, login string) []*Link {
+	var listed []*Link
+	for _, link := range links {
+		if isListed(t, link, login) {
+			listed = append(listed, link)
+		}
+	}
+	return listed
+}
+
+// setVisibility updates the Visibility and AllowedUsers fields of link from
+// the "visibility" and "allowed_users" request values, if present. Allowed
+// users are separated by commas or spaces, and groups are written as
+// "group:name". Restricted links must allow at least one user or group.
+func setVisibility(r *http.Request, link *Link) error {
+	if v, ok := optionalFormValue(r, "visibility"); ok {
+		if !validVisibility(v) {
+			return fmt.Errorf("visibility must be empty, %q, or %q", visibilityUnlisted, visibilityRestricted)
+		}
+		link.Visibility = v
+	}
+	if v, ok := optionalFormValue(r, "allowed_users"); ok {
+		link.AllowedUsers = parsePrincipals(v)
+	}
+	if link.Visibility == visibilityRestricted && len(link.AllowedUsers) == 0 {
+		return errors.New("allowed_users required for restricted links")
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCanView(t *testing.T) {
+	oldGroups, oldAdmins := groups, *admins
+	groups = map[string][]string{"eng": {"eng@example.com"}}
+	*admins = "admin@example.com"
+	t.Cleanup(func() {
+		groups, *admins = oldGroups, oldAdmins
+	})
+
+	public := &Link{Short: "public", Owner: "owner@example.com"}
+	unlisted := &Link{Short: "unlisted", Owner: "owner@example.com", Visibility: visibilityUnlisted}
+	restricted := &Link{Short: "restricted", Owner: "owner@example.com", Visibility: visibilityRestricted, AllowedUsers: Principals{"group:eng", "user@example.com"}}
+
+	tests := []struct {
+		link       *Link
+		login      string
+		wantView   bool
+		wantListed bool
+	}{
+		{link: public, login: "", wantView: true, wantListed: true},
+		{link: public, login: "other@example.com", wantView: true, wantListed: true},
+		{link: unlisted, login: "other@example.com", wantView: true, wantListed: false},
+		{link: unlisted, login: "owner@example.com", wantView: true, wantListed: true},
+		{link: unlisted, login: "admin@example.com", wantView: true, wantListed: true},
+		{link: restricted, login: "", wantView: false, wantListed: false},
+		{link: restricted, login: "other@example.com", wantView: false, wantListed: false},
+		{link: restricted, login: "user@example.com", wantView: true, wantListed: true},
+		{link: restricted, login: "eng@example.com", wantView: true, wantListed: true},
+		{link: restricted, login: "owner@example.com", wantView: true, wantListed: true},
+		{link: restricted, login: "admin@example.com", wantView: true, wantListed: true},
+	}
+	for _, tt := range tests {
+		if got := canView(defaultTenant(), tt.link, tt.login); got != tt.wantView {
+			t.Errorf("canView(%s, %q) = %v; want %v", tt.link.Short, tt.login, got, tt.wantView)
+		}
+		if got := isListed(defaultTenant(), tt.link, tt.login); got != tt.wantListed {
+			t.Errorf("isListed(%s, %q) = %v; want %v", tt.link.Short, tt.login, got, tt.wantListed)
+		}
+	}
+}
+
+func TestSetVisibility(t *testing.T) {
+	tests := []struct {
+		name        string
+		link        Link
+		form        url.Values
+		wantErr     bool
+		wantVis     string
+		wantAllowed string
+	}{
+		{
+			name:        "absent values keep current visibility",
+			link:        Link{Visibility: visibilityRestricted, AllowedUsers: Principals{"a@example.com"}},
+			form:        url.Values{},
+			wantVis:     visibilityRestricted,
+			wantAllowed: "a@example.com",
+		},
+		{
+			name:        "restrict to users and groups",
+			form:        url.Values{"visibility": {"restricted"}, "allowed_users": {"group:eng b@example.com, a@example.com,a@example.com"}},
+			wantVis:     visibilityRestricted,
+			wantAllowed: "a@example.com, b@example.com, group:eng",
+		},
+		{
+			name:    "unlisted",
+			form:    url.Values{"visibility": {"unlisted"}},
+			wantVis: visibilityUnlisted,
+		},
+		{
+			name:    "restricted requires allowed users",
+			form:    url.Values{"visibility": {"restricted"}, "allowed_users": {""}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid visibility",
+			form:    url.Values{"visibility": {"secret"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			link := tt.link
+			err := setVisibility(r, &link)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setVisibility() error = %v; want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if link.Visibility != tt.wantVis {
+				t.Errorf("Visibility = %q; want %q", link.Visibility, tt.wantVis)
+			}
+			if got := link.AllowedUsers.String(); got != tt.wantAllowed {
+				t.Errorf("AllowedUsers = %q; want %q", got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestVisibilityListings(t *testing.T) {
+	links := map[string]*Link{
+		"public":   {Short: "public", Long: "http://public/", Owner: "bar@example.com"},
+		"unlisted": {Short: "unlisted", Long: "http://unlisted/", Owner: "bar@example.com", Visibility: visibilityUnlisted},
+		"mine":     {Short: "mine", Long: "http://mine/", Owner: "foo@example.com", Visibility: visibilityUnlisted},
+		"shared":   {Short: "shared", Long: "http://shared/", Owner: "bar@example.com", Visibility: visibilityRestricted, AllowedUsers: Principals{"foo@example.com"}},
+		"secret":   {Short: "secret", Long: "http://secret/", Owner: "bar@example.com", Visibility: visibilityRestricted, AllowedUsers: Principals{"bar@example.com"}},
+	}
+	fakeLinks(t, links)
+	db.(*MockDatabase).EXPECT().Search(LinkSearch{Query: "e", Limit: maxSearchResults}).DoAndReturn(func(LinkSearch) ([]*Link, error) {
+		return []*Link{links["public"], links["unlisted"], links["mine"], links["shared"], links["secret"]}, nil
+	}).AnyTimes()
+
+	const want = "mine,public,shared"
+	shorts := func(t *testing.T, body string, lines bool) string {
+		var got []*Link
+		if lines {
+			dec := json.NewDecoder(strings.NewReader(body))
+			for dec.More() {
+				link := new(Link)
+				if err := dec.Decode(link); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, link)
+			}
+		} else if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, link := range got {
+			names = append(names, link.Short)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for _, tt := range []struct {
+		path  string
+		serve http.HandlerFunc
+		lines bool
+	}{
+		{path: "/.all", serve: serveAll},
+		{path: "/.export", serve: serveExport, lines: true},
+	} {
+		w := httptest.NewRecorder()
+		tt.serve(w, httptest.NewRequest("GET", tt.path, nil))
+		if got := shorts(t, w.Body.String(), tt.lines); got != want {
+			t.Errorf("%s links = %q; want %q", tt.path, got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveSearch(w, httptest.NewRequest("GET", "/.search?q=e", nil))
+	if got := shorts(t, w.Body.String(), false); got != "public,mine,shared" {
+		t.Errorf("/.search links = %q; want %q", got, "public,mine,shared")
+	}
+
+	for short, wantStatus := range map[string]int{
+		"unlisted": http.StatusOK,
+		"shared":   http.StatusOK,
+		"secret":   http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		serveDetail(w, httptest.NewRequest("GET", "/.detail/"+short, nil))
+		if w.Code != wantStatus {
+			t.Errorf("serveDetail(%q) = %d; want %d", short, w.Code, wantStatus)
+		}
+	}
+}
+
+func TestDetailHidesRestrictedAliases(t *testing.T) {
+	fakeLinks(t, map[string]*Link{
+		"docs":    {Short: "docs", Long: "http://docs/", Owner: "bar@example.com"},
+		"manual":  {Short: "manual", AliasOf: "docs", Owner: "bar@example.com"},
+		"roadmap": {Short: "roadmap", AliasOf: "docs", Owner: "bar@example.com", Visibility: visibilityRestricted, AllowedUsers: Principals{"bar@example.com"}},
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/.detail/docs", nil)
+	r.Header.Set("Accept", "text/html")
+	serveDetail(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "manual") || strings.Contains(body, "roadmap") {
+		t.Errorf("serveDetail(docs) = %s; want manual listed as an alias, without roadmap", body)
+	}
+}
@@ -0,0 +1,518 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var webhooksFile = flag.String("webhooks", "", "path to a JSON file of webhooks to notify when links are created, updated, deleted, or expire")
+
+// Events sent to webhooks.
+const (
+	webhookLinkCreate = "link.create"
+	webhookLinkUpdate = "link.update"
+	webhookLinkDelete = "link.delete"
+	webhookLinkExpire = "link.expire"
+)
+
+// webhookEvents are the events webhooks can subscribe to.
+var webhookEvents = []string{
+	webhookLinkCreate,
+	webhookLinkUpdate,
+	webhookLinkDelete,
+	webhookLinkExpire,
+}
+
+const (
+	// webhookTimeout is how long subscribers have to respond to a delivery.
+	webhookTimeout = 10 * time.Second
+
+	// webhookRetryDelay is how long to wait before retrying a failed
+	// delivery. It doubles after each failed attempt.
+	webhookRetryDelay = 30 * time.Second
+
+	// webhookMaxAttempts is the number of times a delivery is attempted
+	// before giving up on it.
+	webhookMaxAttempts = 10
+
+	// webhookPollInterval is how often the queue of each webhook is checked
+	// for deliveries due to be retried.
+	webhookPollInterval = 15 * time.Second
+
+	// webhookBatchSize is the number of deliveries loaded from the queue at
+	// once.
+	webhookBatchSize = 100
+
+	// webhookPageSize is the number of deliveries shown on each page of
+	// /.webhooks.
+	webhookPageSize = 100
+)
+
+// A webhook is a subscription to link events, from the -webhooks file.
+type webhook struct {
+	// URL is where events are POSTed.
+	URL string `json:"url"`
+
+	// Secret is the key of the HMAC-SHA256 signature of each payload, sent
+	// in the X-Golink-Signature header.
+	Secret string `json:"secret"`
+
+	// Events, if set, are the events sent to the webhook. Otherwise it is
+	// sent every event.
+	Events []string `json:"events,omitempty"`
+
+	// Hostnames, if set, are the tenants whose events are sent to the
+	// webhook. Otherwise it is sent the events of every tenant.
+	Hostnames []string `json:"hostnames,omitempty"`
+
+	// queued wakes the webhook's worker when deliveries are queued for it.
+	queued chan struct{}
+}
+
+// wake wakes h's worker, if it is running and not already woken.
+func (h *webhook) wake() {
+	select {
+	case h.queued <- struct{}{}:
+	default:
+	}
+}
+
+// subscribed reports whether h is sent t's event.
+func (h *webhook) subscribed(t *tenant, event string) bool {
+	return (len(h.Events) == 0 || contains(h.Events, event)) &&
+		(len(h.Hostnames) == 0 || contains(h.Hostnames, t.Hostname))
+}
+
+// contains reports whether s is one of ss.
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooks are the subscriptions loaded from the -webhooks file by
+// loadWebhooks.
+var webhooks []*webhook
+
+// loadWebhooks loads webhooks from the -webhooks file, if set. It must be
+// called after loadTenants, to check the hostnames of each webhook.
+func loadWebhooks() error {
+	if *webhooksFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(*webhooksFile)
+	if err != nil {
+		return err
+	}
+	var hooks []*webhook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		return fmt.Errorf("parsing %s: %w", *webhooksFile, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range hooks {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: invalid webhook URL %q", *webhooksFile, h.URL)
+		}
+		if seen[h.URL] {
+			return fmt.Errorf("%s: webhook %s listed more than once", *webhooksFile, h.URL)
+		}
+		seen[h.URL] = true
+		if h.Secret == "" {
+			return fmt.Errorf("%s: webhook %s has no secret", *webhooksFile, h.URL)
+		}
+		for _, event := range h.Events {
+			if !contains(webhookEvents, event) {
+				return fmt.Errorf("%s: unknown event %q; must be one of %v", *webhooksFile, event, webhookEvents)
+			}
+		}
+		for _, host := range h.Hostnames {
+			if !contains(hostnames(), host) {
+				return fmt.Errorf("%s: %q is not one of the hostnames", *webhooksFile, host)
+			}
+		}
+		h.queued = make(chan struct{}, 1)
+	}
+	webhooks = hooks
+	return nil
+}
+
+// webhookPayload is the JSON body POSTed to webhooks.
+type webhookPayload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+
+	// Actor is the user who made the change, or "golink" for expiry.
+	Actor string `json:"actor"`
+
+	// Short is the short name of the link.
+	Short string `json:"short"`
+
+	// Restricted is set if the link is, or was, only visible to some
+	// users, in which case Link and Previous are left out.
+	Restricted bool `json:"restricted,omitempty"`
+
+	// Link is the link after the change, or before it was deleted, and
+	// Previous is the link before it was updated.
+	Link     *Link `json:"link,omitempty"`
+	Previous *Link `json:"previous,omitempty"`
+}
+
+// queueWebhooks queues the delivery of event, for a change to link made by
+// actor, to each of t's webhooks subscribed to it. previous is the link
+// before an update. Personal links are private to their user, so changes to
+// them are not sent. Webhooks can't tell who may see restricted links, so
+// only the short names of those are sent.
+func queueWebhooks(t *tenant, event, actor string, link, previous *Link) {
+	if len(webhooks) == 0 {
+		return
+	}
+	if _, _, personal := cutPersonal(link.Short); personal {
+		return
+	}
+
+	now := time.Now().UTC()
+	p := webhookPayload{
+		Event:    event,
+		Time:     now,
+		Host:     t.Hostname,
+		Actor:    actor,
+		Short:    link.Short,
+		Link:     link,
+		Previous: previous,
+	}
+	if link.Visibility == visibilityRestricted || (previous != nil && previous.Visibility == visibilityRestricted) {
+		p.Restricted, p.Link, p.Previous = true, nil, nil
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("encoding %s of %q: %v", event, link.Short, err)
+		return
+	}
+
+	for _, h := range webhooks {
+		if !h.subscribed(t, event) {
+			continue
+		}
+		d := &WebhookDelivery{
+			Created:     now,
+			URL:         h.URL,
+			Event:       event,
+			Payload:     payload,
+			Status:      DeliveryPending,
+			NextAttempt: now,
+		}
+		if err := t.db().SaveDelivery(d); err != nil {
+			log.Printf("queueing %s of %q for %s: %v", event, link.Short, h.URL, err)
+			continue
+		}
+		h.wake()
+	}
+}
+
+// queueLinkEvent queues the webhook event for a change to a link recorded
+// in the audit log with action. Other changes are not sent to webhooks.
+func queueLinkEvent(t *tenant, action, actor string, before, after any) {
+	prev, _ := before.(*Link)
+	link, _ := after.(*Link)
+	if action == auditLinkDelete {
+		if prev != nil {
+			queueWebhooks(t, webhookLinkDelete, actor, prev, nil)
+		}
+		return
+	}
+	if link == nil {
+		return
+	}
+	switch action {
+	case auditLinkCreate:
+		queueWebhooks(t, webhookLinkCreate, actor, link, nil)
+	case auditLinkImport:
+		if prev == nil {
+			queueWebhooks(t, webhookLinkCreate, actor, link, nil)
+		} else {
+			queueWebhooks(t, webhookLinkUpdate, actor, link, prev)
+		}
+	case auditLinkUpdate, auditLinkTransfer:
+		queueWebhooks(t, webhookLinkUpdate, actor, link, prev)
+	}
+}
+
+// expiryCheckpoint is the checkpoint of queueExpired.
+const expiryCheckpoint = "webhooks.link.expire"
+
+// queueExpired queues link.expire events for the links of each tenant that
+// expired after the last check, and by now. The time of each check is saved,
+// so links that expire while golink isn't running are sent when it starts
+// again. The first check only saves the time, rather than sending every link
+// that has ever expired.
+func queueExpired(now time.Time) error {
+	since, err := db.LoadCheckpoint(expiryCheckpoint)
+	if err != nil {
+		return err
+	}
+	if since.IsZero() {
+		return db.SaveCheckpoint(expiryCheckpoint, now)
+	}
+
+	for _, t := range allTenants() {
+		subscribed := false
+		for _, h := range webhooks {
+			subscribed = subscribed || h.subscribed(t, webhookLinkExpire)
+		}
+		if !subscribed {
+			continue
+		}
+
+		links, err := t.db().LoadExpired(LinkExpiry{Since: since, Until: now})
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			queueWebhooks(t, webhookLinkExpire, systemActor.Login, link, nil)
+		}
+	}
+	return db.SaveCheckpoint(expiryCheckpoint, now)
+}
+
+// webhookClient sends webhook deliveries.
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// signWebhook returns the signature of body with secret, as sent in the
+// X-Golink-Signature header.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook attempts the queued deliveries to h that are due by now, in
+// order. It stops at the first delivery that fails, so a failing webhook is
+// only waited on for one attempt each time, and the rest of its deliveries
+// are left for the next time.
+func deliverWebhook(ctx context.Context, h *webhook, now time.Time) error {
+	for {
+		deliveries, err := db.LoadDueDeliveries(DueDeliveryQuery{URL: h.URL, By: now, Limit: webhookBatchSize})
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			attemptDelivery(ctx, h, d, now)
+			if err := db.SaveDelivery(d); err != nil {
+				return err
+			}
+			if d.Status != DeliveryDelivered {
+				return nil
+			}
+		}
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// failRemovedWebhooks fails the pending deliveries to webhooks that have been
+// removed from the -webhooks file, without sending them.
+func failRemovedWebhooks() error {
+	urls := make([]string, len(webhooks))
+	for i, h := range webhooks {
+		urls[i] = h.URL
+	}
+	for {
+		deliveries, err := db.LoadDueDeliveries(DueDeliveryQuery{Except: urls, Limit: webhookBatchSize})
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			d.Status, d.Error = DeliveryFailed, "webhook no longer configured"
+			if err := db.SaveDelivery(d); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// attemptDelivery sends d to its webhook h, and updates d with the result.
+// Failed deliveries are retried after webhookRetryDelay, doubling after each
+// attempt, until they have been attempted webhookMaxAttempts times.
+func attemptDelivery(ctx context.Context, h *webhook, d *WebhookDelivery, now time.Time) {
+	d.Attempts++
+	code, err := sendWebhook(ctx, h, d)
+	d.ResponseCode, d.Error = code, ""
+	switch {
+	case err == nil:
+		d.Status = DeliveryDelivered
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status, d.Error = DeliveryFailed, err.Error()
+	default:
+		d.Error = err.Error()
+		d.NextAttempt = now.Add(webhookRetryDelay << (d.Attempts - 1))
+	}
+}
+
+// sendWebhook POSTs the payload of d to h, and returns the status code of the
+// response, if any. Responses other than 2xx are errors.
+func sendWebhook(ctx context.Context, h *webhook, d *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "golink")
+	req.Header.Set("X-Golink-Event", d.Event)
+	req.Header.Set("X-Golink-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set("X-Golink-Signature", signWebhook(h.Secret, d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// startWebhooks fails the deliveries to webhooks that have been removed, and
+// starts a worker for each webhook. Each webhook has its own worker, so a slow
+// or failing subscriber only holds up its own deliveries.
+func startWebhooks() {
+	if err := failRemovedWebhooks(); err != nil {
+		log.Printf("failing deliveries to removed webhooks: %v", err)
+	}
+	for _, h := range webhooks {
+		go deliverWebhookLoop(h)
+	}
+}
+
+// deliverWebhookLoop delivers events to h as they are queued, and retries
+// failed deliveries when they are due. This function never returns.
+func deliverWebhookLoop(h *webhook) {
+	for {
+		if err := deliverWebhook(context.Background(), h, time.Now().UTC()); err != nil {
+			log.Printf("delivering webhooks to %s: %v", h.URL, err)
+		}
+		select {
+		case <-h.queued:
+		case <-time.After(webhookPollInterval):
+		}
+	}
+}
+
+// webhookSubscription describes a webhook on the /.webhooks page, without
+// its secret.
+type webhookSubscription struct {
+	URL       string
+	Events    []string
+	Hostnames []string
+}
+
+// webhooksData is the data used by the webhooksTmpl template.
+type webhooksData struct {
+	Webhooks   []webhookSubscription
+	Deliveries []*WebhookDelivery
+
+	// Status is the status deliveries are filtered by, if any, out of
+	// Statuses.
+	Status   string
+	Statuses []string
+
+	// NextURL links to the page of older deliveries, if any.
+	NextURL string
+}
+
+// serveWebhooks shows admins the webhooks of the tenant, and the log of
+// deliveries to them, newest first. The "status" request value filters the
+// deliveries, and "before" pages through them. Requests that don't accept
+// HTML are sent the deliveries as JSON, with the next page linked in a Link
+// header.
+func serveWebhooks(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	login, err := currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !t.isAdmin(login) {
+		http.Error(w, "only admins can see webhook deliveries", http.StatusForbidden)
+		return
+	}
+
+	q := DeliveryQuery{Status: r.FormValue("status"), Limit: webhookPageSize + 1}
+	if q.Status != "" && !contains([]string{DeliveryPending, DeliveryDelivered, DeliveryFailed}, q.Status) {
+		http.Error(w, "unknown status: "+q.Status, http.StatusBadRequest)
+		return
+	}
+	if v := r.FormValue("before"); v != "" {
+		before, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			http.Error(w, "invalid before: "+v, http.StatusBadRequest)
+			return
+		}
+		q.Before = uint(before)
+	}
+	deliveries, err := t.db().LoadDeliveries(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := webhooksData{
+		Deliveries: deliveries,
+		Status:     q.Status,
+		Statuses:   []string{DeliveryPending, DeliveryDelivered, DeliveryFailed},
+	}
+	if len(deliveries) > webhookPageSize {
+		data.Deliveries = deliveries[:webhookPageSize]
+		next := make(url.Values)
+		if q.Status != "" {
+			next.Set("status", q.Status)
+		}
+		next.Set("before", strconv.FormatUint(uint64(data.Deliveries[webhookPageSize-1].ID), 10))
+		data.NextURL = "/.webhooks?" + next.Encode()
+	}
+
+	if !acceptHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if data.NextURL != "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, data.NextURL))
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data.Deliveries)
+		return
+	}
+
+	for _, h := range webhooks {
+		if len(h.Hostnames) == 0 || contains(h.Hostnames, t.Hostname) {
+			data.Webhooks = append(data.Webhooks, webhookSubscription{URL: h.URL, Events: h.Events, Hostnames: h.Hostnames})
+		}
+	}
+	webhooksTmpl.Execute(w, data)
+}
@@ -0,0 +1,479 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"golang.org/x/net/xsrftoken"
+)
+
+// fakeDeliveries stores webhook deliveries and checkpoints in memory in the
+// fake database set up by fakeLinks, and returns the deliveries.
+func fakeDeliveries(t *testing.T) *[]*WebhookDelivery {
+	var (
+		mu          sync.Mutex
+		deliveries  []*WebhookDelivery
+		checkpoints = make(map[string]time.Time)
+	)
+	m := db.(*MockDatabase)
+	m.EXPECT().SaveDelivery(gomock.Any()).DoAndReturn(func(d *WebhookDelivery) error {
+		// deliveries to different webhooks are saved concurrently
+		mu.Lock()
+		defer mu.Unlock()
+		if d.ID == 0 {
+			d.ID = uint(len(deliveries) + 1)
+			deliveries = append(deliveries, d)
+		}
+		return nil
+	}).AnyTimes()
+	m.EXPECT().LoadDueDeliveries(gomock.Any()).DoAndReturn(func(q DueDeliveryQuery) ([]*WebhookDelivery, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		var due []*WebhookDelivery
+		for _, d := range deliveries {
+			// deliveries to other webhooks are being attempted concurrently
+			if (q.URL == "" || d.URL == q.URL) && !contains(q.Except, d.URL) && d.Status == DeliveryPending && (q.By.IsZero() || !d.NextAttempt.After(q.By)) {
+				due = append(due, d)
+			}
+		}
+		sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+		if len(due) > q.Limit {
+			due = due[:q.Limit]
+		}
+		return due, nil
+	}).AnyTimes()
+	m.EXPECT().LoadCheckpoint(gomock.Any()).DoAndReturn(func(name string) (time.Time, error) {
+		return checkpoints[name], nil
+	}).AnyTimes()
+	m.EXPECT().SaveCheckpoint(gomock.Any(), gomock.Any()).DoAndReturn(func(name string, t time.Time) error {
+		checkpoints[name] = t
+		return nil
+	}).AnyTimes()
+	m.EXPECT().LoadDeliveries(gomock.Any()).DoAndReturn(func(q DeliveryQuery) ([]*WebhookDelivery, error) {
+		var page []*WebhookDelivery
+		for i := len(deliveries) - 1; i >= 0; i-- {
+			d := deliveries[i]
+			if d.Tenant == q.Tenant && (q.Status == "" || d.Status == q.Status) && (q.Before == 0 || d.ID < q.Before) && len(page) < q.Limit {
+				page = append(page, d)
+			}
+		}
+		return page, nil
+	}).AnyTimes()
+	return &deliveries
+}
+
+// setWebhooks sets the webhooks for the duration of the test.
+func setWebhooks(t *testing.T, hooks ...*webhook) {
+	old := webhooks
+	t.Cleanup(func() { webhooks = old })
+	for _, h := range hooks {
+		h.queued = make(chan struct{}, 1)
+	}
+	webhooks = hooks
+}
+
+// deliverAll attempts the deliveries due by now to each webhook, as their
+// workers would.
+func deliverAll(t *testing.T, now time.Time) {
+	t.Helper()
+	for _, h := range webhooks {
+		if err := deliverWebhook(context.Background(), h, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// webhookReceiver is a webhook subscriber that checks the signature of the
+// deliveries it receives, and responds to them with its status codes in
+// turn.
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	statuses []int
+	received []webhookPayload
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if got, want := r.Header.Get("X-Golink-Signature"), signWebhook(rcv.secret, body); got != want {
+		rcv.t.Errorf("X-Golink-Signature = %q; want %q", got, want)
+	}
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		rcv.t.Errorf("decoding payload %s: %v", body, err)
+	}
+	if got := r.Header.Get("X-Golink-Event"); got != p.Event {
+		rcv.t.Errorf("X-Golink-Event = %q; want %q", got, p.Event)
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.received = append(rcv.received, p)
+	status := http.StatusNoContent
+	if len(rcv.statuses) > 0 {
+		status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	fakeLinks(t, map[string]*Link{})
+	deliveries := fakeDeliveries(t)
+
+	all := &webhookReceiver{t: t, secret: "s3cret", statuses: []int{http.StatusInternalServerError}}
+	allSrv := httptest.NewServer(all)
+	defer allSrv.Close()
+	deletes := &webhookReceiver{t: t, secret: "other"}
+	deletesSrv := httptest.NewServer(deletes)
+	defer deletesSrv.Close()
+	setWebhooks(t,
+		&webhook{URL: allSrv.URL, Secret: "s3cret"},
+		&webhook{URL: deletesSrv.URL, Secret: "other", Events: []string{webhookLinkDelete}},
+	)
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"short": {"docs"}, "long": {"http://docs/"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	serveSave(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("serveSave() = %d: %s", w.Code, w.Body)
+	}
+	if len(*deliveries) != 1 || (*deliveries)[0].URL != allSrv.URL || (*deliveries)[0].Event != webhookLinkCreate {
+		t.Fatalf("queued %+v; want link.create for %s", *deliveries, allSrv.URL)
+	}
+	d := (*deliveries)[0]
+
+	select {
+	case <-webhooks[0].queued:
+	default:
+		t.Error("queueing a delivery didn't wake the webhook's worker")
+	}
+
+	// the first attempt fails, and is retried after webhookRetryDelay
+	now := time.Now().UTC()
+	deliverAll(t, now)
+	if d.Status != DeliveryPending || d.Attempts != 1 || d.ResponseCode != http.StatusInternalServerError || !d.NextAttempt.Equal(now.Add(webhookRetryDelay)) {
+		t.Errorf("after failed attempt, delivery = %+v", d)
+	}
+	deliverAll(t, now.Add(time.Second))
+	if len(all.received) != 1 {
+		t.Errorf("delivery retried before it was due; received %d", len(all.received))
+	}
+	deliverAll(t, now.Add(time.Minute))
+	if d.Status != DeliveryDelivered || d.Attempts != 2 || d.Error != "" {
+		t.Errorf("after retry, delivery = %+v", d)
+	}
+	if len(all.received) != 2 {
+		t.Fatalf("received %d deliveries; want 2", len(all.received))
+	}
+	if p := all.received[1]; p.Event != webhookLinkCreate || p.Actor != "foo@example.com" || p.Link.Short != "docs" || p.Link.Long != "http://docs/" || p.Previous != nil {
+		t.Errorf("received %+v; want creation of docs", p)
+	}
+
+	r = httptest.NewRequest("POST", "/.delete/docs", strings.NewReader(url.Values{
+		"xsrf": {xsrftoken.Generate(xsrfKey, "foo@example.com", "docs")},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	serveDelete(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("serveDelete() = %d: %s", w.Code, w.Body)
+	}
+	deliverAll(t, time.Now().UTC())
+	for _, rcv := range []*webhookReceiver{all, deletes} {
+		if n := len(rcv.received); n == 0 || rcv.received[n-1].Event != webhookLinkDelete || rcv.received[n-1].Link.Short != "docs" {
+			t.Errorf("received %+v; want deletion of docs last", rcv.received)
+		}
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	fakeLinks(t, map[string]*Link{})
+	deliveries := fakeDeliveries(t)
+
+	rcv := &webhookReceiver{t: t, secret: "s3cret"}
+	for i := 0; i < webhookMaxAttempts; i++ {
+		rcv.statuses = append(rcv.statuses, http.StatusServiceUnavailable)
+	}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+	setWebhooks(t, &webhook{URL: srv.URL, Secret: "s3cret"}, &webhook{URL: "http://removed.example.com/", Secret: "gone"})
+
+	queueWebhooks(defaultTenant(), webhookLinkUpdate, "foo@example.com", &Link{Short: "docs"}, &Link{Short: "docs", Long: "http://old/"})
+	if len(*deliveries) != 2 {
+		t.Fatalf("queued %d deliveries; want 2", len(*deliveries))
+	}
+	d, removed := (*deliveries)[0], (*deliveries)[1]
+	webhooks = webhooks[:1]
+	if err := failRemovedWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	var delays []time.Duration
+	for d.Status == DeliveryPending && len(delays) <= webhookMaxAttempts {
+		last := now
+		now = d.NextAttempt
+		delays = append(delays, now.Sub(last))
+		deliverAll(t, now)
+	}
+	if d.Status != DeliveryFailed || d.Attempts != webhookMaxAttempts || d.ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("delivery = %+v; want failed after %d attempts", d, webhookMaxAttempts)
+	}
+	for i := 2; i < len(delays); i++ {
+		if delays[i] != 2*delays[i-1] {
+			t.Errorf("retry delays = %v; want doubling", delays)
+			break
+		}
+	}
+	if removed.Status != DeliveryFailed || removed.Attempts != 0 {
+		t.Errorf("delivery to removed webhook = %+v; want failed without attempts", removed)
+	}
+}
+
+func TestWebhookSlowSubscriber(t *testing.T) {
+	fakeLinks(t, map[string]*Link{})
+	deliveries := fakeDeliveries(t)
+
+	// the slow subscriber responds once the fast one has been sent its
+	// delivery, which would time out if they were sent in turn
+	fastSent := make(chan struct{})
+	slowSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fastSent:
+		case <-time.After(webhookTimeout / 2):
+			t.Error("slow subscriber held up the fast one")
+		}
+	}))
+	defer slowSrv.Close()
+	fastSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fastSent)
+	}))
+	defer fastSrv.Close()
+	setWebhooks(t, &webhook{URL: slowSrv.URL, Secret: "s3cret"}, &webhook{URL: fastSrv.URL, Secret: "s3cret"})
+
+	queueWebhooks(defaultTenant(), webhookLinkCreate, "foo@example.com", &Link{Short: "docs"}, nil)
+
+	// each webhook's worker delivers to it independently
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	for _, h := range webhooks {
+		wg.Add(1)
+		go func(h *webhook) {
+			defer wg.Done()
+			if err := deliverWebhook(context.Background(), h, now); err != nil {
+				t.Error(err)
+			}
+		}(h)
+	}
+	wg.Wait()
+	for _, d := range *deliveries {
+		if d.Status != DeliveryDelivered {
+			t.Errorf("delivery = %+v; want delivered", d)
+		}
+	}
+}
+
+func TestWebhookFailingSubscriber(t *testing.T) {
+	fakeLinks(t, map[string]*Link{})
+	deliveries := fakeDeliveries(t)
+
+	rcv := &webhookReceiver{t: t, secret: "s3cret", statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+	setWebhooks(t, &webhook{URL: srv.URL, Secret: "s3cret"})
+
+	for _, short := range []string{"a", "b", "c"} {
+		queueWebhooks(defaultTenant(), webhookLinkCreate, "foo@example.com", &Link{Short: short}, nil)
+	}
+
+	// each round stops at the first failed delivery, leaving the rest
+	// for the next one
+	now := time.Now().UTC()
+	deliverAll(t, now)
+	if len(rcv.received) != 1 {
+		t.Fatalf("received %d deliveries after a failure; want 1", len(rcv.received))
+	}
+	for _, d := range (*deliveries)[1:] {
+		if d.Status != DeliveryPending || d.Attempts != 0 {
+			t.Errorf("delivery after the failed one = %+v; want not attempted", d)
+		}
+	}
+
+	deliverAll(t, now.Add(time.Second))
+	deliverAll(t, now.Add(time.Minute))
+	var got []string
+	for _, p := range rcv.received {
+		got = append(got, p.Short)
+	}
+	if strings.Join(got, ",") != "a,b,c,a,b" {
+		t.Errorf("received %q; want a and b to fail once each, then all delivered", got)
+	}
+	for _, d := range *deliveries {
+		if d.Status != DeliveryDelivered {
+			t.Errorf("delivery = %+v; want delivered", d)
+		}
+	}
+}
+
+func TestQueueWebhooksRestricted(t *testing.T) {
+	fakeLinks(t, map[string]*Link{})
+	deliveries := fakeDeliveries(t)
+	setWebhooks(t, &webhook{URL: "http://bot.example.com/", Secret: "s3cret"})
+
+	link := &Link{Short: "payroll", Long: "http://payroll/secret", Visibility: visibilityRestricted, AllowedUsers: Principals{"foo@example.com"}}
+	previous := &Link{Short: "payroll", Long: "http://payroll/"}
+	queueWebhooks(defaultTenant(), webhookLinkUpdate, "foo@example.com", link, previous)
+	if len(*deliveries) != 1 {
+		t.Fatalf("queued %d deliveries; want 1", len(*deliveries))
+	}
+	payload := (*deliveries)[0].Payload
+	var p webhookPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Short != "payroll" || !p.Restricted || p.Link != nil || p.Previous != nil {
+		t.Errorf("payload = %+v; want only the short name of a restricted link", p)
+	}
+	if strings.Contains(string(payload), "http://payroll/") {
+		t.Errorf("payload %s contains the restricted link's destination", payload)
+	}
+}
+
+func TestQueueExpired(t *testing.T) {
+	now := time.Date(2022, 6, 2, 12, 0, 0, 0, time.UTC)
+	fakeLinks(t, map[string]*Link{
+		"gone":     {Short: "gone", ExpiresAt: now.Add(-time.Minute)},
+		"old":      {Short: "old", ExpiresAt: now.Add(-time.Hour)},
+		"later":    {Short: "later", ExpiresAt: now.Add(time.Hour)},
+		"forever":  {Short: "forever"},
+		"~foo/tmp": {Short: "~foo@example.com/tmp", ExpiresAt: now.Add(-time.Minute)},
+	})
+	deliveries := fakeDeliveries(t)
+	setWebhooks(t,
+		&webhook{URL: "http://expiry.example.com/", Secret: "s3cret", Events: []string{webhookLinkExpire}},
+		&webhook{URL: "http://creates.example.com/", Secret: "s3cret", Events: []string{webhookLinkCreate}},
+	)
+
+	// the first check only records when it was made
+	if err := queueExpired(now.Add(-10 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*deliveries) != 0 {
+		t.Fatalf("first check queued %+v; want nothing", *deliveries)
+	}
+
+	// later checks carry on from the last one, even after a restart
+	if err := queueExpired(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(*deliveries) != 1 {
+		t.Fatalf("queued %+v; want only the expiry of gone", *deliveries)
+	}
+	d := (*deliveries)[0]
+	var p webhookPayload
+	if err := json.Unmarshal(d.Payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if d.URL != "http://expiry.example.com/" || p.Event != webhookLinkExpire || p.Link.Short != "gone" || p.Actor != systemActor.Login {
+		t.Errorf("queued %+v with payload %+v; want expiry of gone", d, p)
+	}
+}
+
+func TestServeWebhooks(t *testing.T) {
+	fakeLinks(t, map[string]*Link{})
+	deliveries := fakeDeliveries(t)
+	setWebhooks(t, &webhook{URL: "http://bot.example.com/golink", Secret: "s3cret"})
+	queueWebhooks(defaultTenant(), webhookLinkCreate, "foo@example.com", &Link{Short: "docs"}, nil)
+	queueWebhooks(defaultTenant(), webhookLinkDelete, "foo@example.com", &Link{Short: "docs"}, nil)
+	(*deliveries)[0].Status = DeliveryDelivered
+
+	setAPITokens(t, nil, "")
+	w := httptest.NewRecorder()
+	serveWebhooks(w, httptest.NewRequest("GET", "/.webhooks", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("serveWebhooks() by non-admin = %d; want %d", w.Code, http.StatusForbidden)
+	}
+
+	setAPITokens(t, nil, "foo@example.com")
+	for _, tt := range []struct {
+		query string
+		want  []uint
+	}{
+		{query: "", want: []uint{2, 1}},
+		{query: "status=pending", want: []uint{2}},
+		{query: "before=2", want: []uint{1}},
+	} {
+		w := httptest.NewRecorder()
+		serveWebhooks(w, httptest.NewRequest("GET", "/.webhooks?"+tt.query, nil))
+		var got []*WebhookDelivery
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("serveWebhooks(%s): %v", tt.query, err)
+		}
+		var ids []uint
+		for _, d := range got {
+			ids = append(ids, d.ID)
+		}
+		if len(ids) != len(tt.want) || (len(ids) > 0 && ids[0] != tt.want[0]) {
+			t.Errorf("serveWebhooks(%s) = deliveries %v; want %v", tt.query, ids, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/.webhooks", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	serveWebhooks(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "http://bot.example.com/golink") || strings.Contains(body, "s3cret") {
+		t.Errorf("serveWebhooks() = %s; want the webhook URL without its secret", body)
+	}
+
+	w = httptest.NewRecorder()
+	serveWebhooks(w, httptest.NewRequest("GET", "/.webhooks?status=lost", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("serveWebhooks(status=lost) = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	oldFile, oldWebhooks := *webhooksFile, webhooks
+	t.Cleanup(func() { *webhooksFile, webhooks = oldFile, oldWebhooks })
+
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: `[{"url": "https://bot.example.com/golink", "secret": "s3cret", "events": ["link.create"], "hostnames": ["go"]}]`},
+		{config: `[{"url": "https://bot.example.com/golink"}]`, wantErr: true},
+		{config: `[{"url": "ftp://bot.example.com/", "secret": "s3cret"}]`, wantErr: true},
+		{config: `[{"url": "https://bot.example.com/", "secret": "s3cret", "events": ["link.visit"]}]`, wantErr: true},
+		{config: `[{"url": "https://bot.example.com/", "secret": "s3cret", "hostnames": ["wiki"]}]`, wantErr: true},
+		{config: `[{"url": "https://bot.example.com/", "secret": "a"}, {"url": "https://bot.example.com/", "secret": "b"}]`, wantErr: true},
+		{config: `not json`, wantErr: true},
+	} {
+		*webhooksFile = filepath.Join(t.TempDir(), "webhooks.json")
+		os.WriteFile(*webhooksFile, []byte(tt.config), 0o600)
+		if err := loadWebhooks(); (err != nil) != tt.wantErr {
+			t.Errorf("loadWebhooks(%s) = %v; want error %v", tt.config, err, tt.wantErr)
+		}
+	}
+	if len(webhooks) != 1 || webhooks[0].Secret != "s3cret" {
+		t.Errorf("webhooks = %+v; want the valid config", webhooks)
+	}
+}